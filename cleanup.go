@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/xmdhs/natupnp/natmap"
+	"github.com/xmdhs/natupnp/upnp"
+)
+
+func cleanup(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	all := fs.Bool("all", false, "also remove mappings to other hosts")
+	timeout := fs.Duration("timeout", time.Minute, "timeout")
+	fs.Parse(args)
+
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	up, err := parseUpstream(upstream)
+	if err != nil {
+		return fmt.Errorf("cleanup: %w", err)
+	}
+	gateways, err := upnp.PickGateways(ctx, gatewayOptions(gateway, gatewayIf)...)
+	if err != nil {
+		return fmt.Errorf("cleanup: %w", err)
+	}
+
+	local := getLocalAddrPort().Addr().String()
+	var (
+		n    int
+		errs error
+	)
+	for _, g := range gateways {
+		deleted, err := g.DeletePortMappings(ctx, func(m upnp.PortMapping) bool {
+			return m.Description == natmap.Description && (*all || m.InternalClient == local)
+		})
+		errs = errors.Join(errs, err)
+		for _, m := range deleted {
+			fmt.Printf("deleted %v %v -> %v:%v\n", m.Protocol, m.ExternalPort, m.InternalClient, m.InternalPort)
+		}
+		n += len(deleted)
+		if !cascade {
+			continue
+		}
+		deleted, err = cleanupUpstream(ctx, g, up, deleted, *all)
+		errs = errors.Join(errs, err)
+		for _, m := range deleted {
+			fmt.Printf("deleted upstream %v %v -> %v:%v\n", m.Protocol, m.ExternalPort, m.InternalClient, m.InternalPort)
+		}
+		n += len(deleted)
+	}
+	if errs != nil {
+		return fmt.Errorf("cleanup: %w", errs)
+	}
+	if n == 0 {
+		fmt.Println("no stale mappings")
+	}
+	return nil
+}
+
+// cleanupUpstream deletes the mappings natmap chained through the upstream
+// gateway of g, see upnp.MapUpstream: those forwarding to the external
+// ports of deleted, or with all every natmap mapping to g.
+func cleanupUpstream(ctx context.Context, g *upnp.Gateway, host netip.AddrPort, deleted []upnp.PortMapping, all bool) ([]upnp.PortMapping, error) {
+	if !all && len(deleted) == 0 {
+		return nil, nil
+	}
+	up, err := g.Upstream(ctx, host)
+	if errors.Is(err, upnp.ErrNotCascaded) || errors.Is(err, upnp.ErrNoIGD) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cleanupUpstream: %w", err)
+	}
+	ip, err := g.ExternalIP(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cleanupUpstream: %w", err)
+	}
+	type key struct {
+		protocol string
+		port     uint16
+	}
+	ports := map[key]bool{}
+	for _, m := range deleted {
+		ports[key{m.Protocol, m.ExternalPort}] = true
+	}
+	l, err := up.DeletePortMappings(ctx, func(m upnp.PortMapping) bool {
+		return m.Description == natmap.Description && m.InternalClient == ip.String() &&
+			(all || ports[key{m.Protocol, m.InternalPort}])
+	})
+	if err != nil {
+		return l, fmt.Errorf("cleanupUpstream: %w", err)
+	}
+	return l, nil
+}
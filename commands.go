@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+func runCommand(ctx context.Context, name string, args []string) {
+	var err error
+	switch name {
+	case "detect":
+		err = detect(ctx, args)
+	case "stun-server":
+		err = stunServer(ctx, args)
+	case "probe":
+		err = probe(ctx, args)
+	case "cleanup":
+		err = cleanup(ctx, args)
+	case "upnp":
+		err = upnpCommand(ctx, args)
+	default:
+		err = fmt.Errorf("unknown command %q", name)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xmdhs/natupnp/reuse"
+	"github.com/xmdhs/natupnp/stun"
+)
+
+func detect(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("detect", flag.ExitOnError)
+	server := fs.String("s", strings.Split(stunAddr, ",")[0], "RFC 5780 capable stun server")
+	timeout := fs.Duration("timeout", time.Minute, "timeout")
+	fs.Parse(args)
+
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	u, err := stun.ParseURI(*server)
+	if err != nil {
+		return fmt.Errorf("detect: %w", err)
+	}
+	if u.Secure {
+		return fmt.Errorf("detect: stuns is not supported")
+	}
+
+	laddr := getLocalAddrPort()
+	conn, err := reuse.ListenPacket(ctx, "udp", laddr.String())
+	if err != nil {
+		return fmt.Errorf("detect: %w", err)
+	}
+	defer conn.Close()
+
+	b, err := stun.Detect(ctx, conn, u.Addr())
+	if b.MappedAddr.IsValid() {
+		fmt.Println("mapped address:", b.MappedAddr)
+	}
+	if err != nil {
+		return fmt.Errorf("detect: %w", err)
+	}
+	fmt.Println("mapping:", b.Mapping)
+	fmt.Println("filtering:", b.Filtering)
+	fmt.Println("nat type:", b.NATType())
+	return nil
+}
@@ -8,7 +8,7 @@ require github.com/libp2p/go-reuseport v0.3.0
 
 require (
 	github.com/huin/goupnp v1.2.0
-	github.com/pion/dtls/v2 v2.2.6 // indirect
+	github.com/pion/dtls/v2 v2.2.6
 	github.com/pion/logging v0.2.2 // indirect
 	github.com/pion/transport/v2 v2.2.0 // indirect
 	github.com/pion/udp/v2 v2.0.1 // indirect
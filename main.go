@@ -12,62 +12,108 @@ import (
 	"net/netip"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/xmdhs/natupnp/natmap"
 	"github.com/xmdhs/natupnp/reuse"
+	"github.com/xmdhs/natupnp/stun"
 )
 
 var (
-	stun      string
+	stunAddr  string
 	localAddr string
 	port      string
 	test      bool
 	target    string
 	comm      string
 	udp       bool
+	lease     time.Duration
+	portRange string
+	gateway   string
+	gatewayIf string
+	cascade   bool
+	upstream  string
+	events    bool
+	ipv6      string
+	mode      string
+	verify    time.Duration
+
+	keepalive         string
+	keepaliveURL      string
+	keepaliveAddr     string
+	keepaliveDomain   string
+	keepaliveInterval time.Duration
+	keepaliveTimeout  time.Duration
+	keepaliveFailures int
+	lifetime          time.Duration
 )
 
 func init() {
-	flag.StringVar(&stun, "s", "turn.cloudflare.com:3478", "stun")
+	flag.StringVar(&stunAddr, "s", natmap.DefaultSTUNServer, "stun servers, separated by commas, as host:port or stun:/stuns: uri")
 	flag.StringVar(&localAddr, "l", "", "local addr")
 	flag.StringVar(&port, "p", "8086", "port")
 	flag.StringVar(&target, "d", "", "forward to target host")
 	flag.BoolVar(&test, "t", false, "test server (only tcp)")
 	flag.StringVar(&comm, "e", "", "run script for mapped address")
 	flag.BoolVar(&udp, "u", false, "udp")
+	flag.DurationVar(&lease, "lease", natmap.DefaultLease, "upnp lease duration, renewed at half, 0 for permanent")
+	flag.StringVar(&portRange, "range", "", "upnp external ports to try if -p is taken, e.g. 20000-30000")
+	flag.StringVar(&gateway, "gateway", "", "only use this upnp gateway, by UDN or location url")
+	flag.StringVar(&gatewayIf, "gateway-if", "", "only use upnp gateways found on this network interface")
+	flag.BoolVar(&cascade, "cascade", true, "also map on the upstream upnp gateway if the router is behind another nat")
+	flag.BoolVar(&events, "events", true, "subscribe to upnp gateway events to re-check the mapping at once after a reconnect")
+	flag.StringVar(&ipv6, "6", "", "also open the port on this global ipv6 address, or auto")
+	flag.StringVar(&mode, "mode", natmap.ModeAuto, "router port mapping apis to try in order, separated by commas: auto, upnp, pcp, natpmp or none")
+	flag.DurationVar(&verify, "verify", natmap.DefaultVerifyInterval, "how often to read the upnp mapping back and restore it, 0 to disable")
+	flag.StringVar(&keepalive, "keepalive", "", "keepalive: http, tcp (raw connection with tcp keepalive probes) or stun for tcp, dns or stun for udp; defaults to http or dns")
+	flag.StringVar(&keepaliveURL, "keepalive-url", natmap.DefaultKeepaliveURL, "url for -keepalive http")
+	flag.StringVar(&keepaliveAddr, "keepalive-addr", "", "host:port for -keepalive tcp, defaults to the first stun server, or the dns server for -keepalive dns")
+	flag.StringVar(&keepaliveDomain, "keepalive-domain", natmap.DefaultKeepaliveDomain, "domain looked up for -keepalive dns")
+	flag.DurationVar(&keepaliveInterval, "keepalive-interval", natmap.DefaultKeepaliveInterval, "keepalive interval")
+	flag.DurationVar(&keepaliveTimeout, "keepalive-timeout", natmap.DefaultKeepaliveTimeout, "keepalive timeout")
+	flag.IntVar(&keepaliveFailures, "keepalive-failures", natmap.DefaultKeepaliveFailures, "keepalive failures in a row before the mapping is re-checked")
+	flag.DurationVar(&lifetime, "lifetime", 0, "how long the nat keeps an idle binding, see natupnp probe; overrides -keepalive-interval with a third of it")
+	flag.StringVar(&upstream, "upstream", "", "upstream upnp gateway ip, defaults to x.x.x.1 of the router's external ip")
 	flag.Parse()
 }
 
 func main() {
-	ctx := context.Background()
-	if localAddr == "" {
-		s, err := natmap.GetLocalAddr()
-		if err != nil {
-			panic(err)
-		}
-		h, _, err := net.SplitHostPort(s.String())
-		if err != nil {
-			panic(err)
-		}
-		localAddr = h
+	// Stop on SIGINT/SIGTERM, so the deferred Map.Close removes the port
+	// mappings on the router.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if flag.NArg() > 0 {
+		runCommand(ctx, flag.Arg(0), flag.Args()[1:])
+		return
 	}
-	portu, err := strconv.ParseUint(port, 10, 64)
+	laddrPort := getLocalAddrPort()
+	laddr6 := getLocalAddr6()
+	stunPool, err := stun.NewPool(strings.Split(stunAddr, ",")...)
 	if err != nil {
 		panic(err)
 	}
-	laddrPort := netip.AddrPortFrom(netip.MustParseAddr(localAddr), uint16(portu))
+	stunPool.OnMismatch = func(err error) {
+		log.Println(err)
+	}
 
-	for {
-		err := openPort(ctx, target, laddrPort, stun, func(s netip.AddrPort) {
+	for ctx.Err() == nil {
+		err := openPort(ctx, target, laddrPort, laddr6, stunPool, func(s, s6 netip.AddrPort) {
 			fmt.Println(s)
+			args := []string{localAddr, port, s.Addr().String(), strconv.Itoa(int(s.Port()))}
+			if s6.IsValid() {
+				fmt.Println(s6)
+				args = append(args, s6.Addr().String(), strconv.Itoa(int(s6.Port())))
+			}
 			if comm != "" {
-				c := exec.CommandContext(ctx, comm, localAddr, port, s.Addr().String(), strconv.Itoa(int(s.Port())))
+				c := exec.CommandContext(ctx, comm, args...)
 				c.Stdin = os.Stdin
 				c.Stdout = os.Stdout
 				c.Stderr = os.Stderr
-				err = c.Run()
+				err := c.Run()
 				if err != nil {
 					log.Println(err)
 				}
@@ -80,60 +126,206 @@ func main() {
 	}
 }
 
-func openPort(ctx context.Context, target string, laddr netip.AddrPort,
-	stun string, finish func(netip.AddrPort), udp bool, testserver bool) error {
+func getLocalAddrPort() netip.AddrPort {
+	if localAddr == "" {
+		s, err := natmap.GetLocalAddr()
+		if err != nil {
+			panic(err)
+		}
+		h, _, err := net.SplitHostPort(s.String())
+		if err != nil {
+			panic(err)
+		}
+		localAddr = h
+	}
+	portu, err := strconv.ParseUint(port, 10, 64)
+	if err != nil {
+		panic(err)
+	}
+	return netip.AddrPortFrom(netip.MustParseAddr(localAddr), uint16(portu))
+}
+
+func getLocalAddr6() netip.Addr {
+	if ipv6 == "" {
+		return netip.Addr{}
+	}
+	if ipv6 == "auto" {
+		a, err := natmap.GetLocalAddr6()
+		if err != nil {
+			panic(err)
+		}
+		return a.(*net.UDPAddr).AddrPort().Addr()
+	}
+	return netip.MustParseAddr(ipv6)
+}
+
+// openPort keeps laddr mapped with a natmap.Session until ctx is done, and
+// also opens laddr6 at the same port if it is valid, calling finish with the
+// mapped address and the IPv6 endpoint, if any.
+func openPort(ctx context.Context, target string, laddr netip.AddrPort, laddr6 netip.Addr,
+	stunPool *stun.Pool, finish func(s, s6 netip.AddrPort), udp bool, testserver bool) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	if target != "" {
-		var forward func(ctx context.Context, laddr netip.AddrPort, target string, log func(string)) (io.Closer, error)
-		if udp {
-			forward = natmap.ForwardUdp
-		} else {
-			forward = natmap.Forward
+	listen := []netip.AddrPort{laddr}
+	if laddr6.IsValid() {
+		listen = append(listen, netip.AddrPortFrom(laddr6, laddr.Port()))
+	}
+	for _, laddr := range listen {
+		if target != "" {
+			var forward func(ctx context.Context, laddr netip.AddrPort, target string, log func(string)) (io.Closer, error)
+			if udp {
+				forward = natmap.ForwardUdp
+			} else {
+				forward = natmap.Forward
+			}
+			l, err := forward(ctx, laddr, target, func(s string) {
+				log.Println(s)
+			})
+			if err != nil {
+				return fmt.Errorf("openPort: %w", err)
+			}
+			defer l.Close()
+		}
+		if testserver {
+			l, err := testServer(ctx, laddr)
+			if err != nil {
+				return fmt.Errorf("openPort: %w", err)
+			}
+			defer l.Close()
 		}
-		l, err := forward(ctx, laddr, target, func(s string) {
-			log.Println(s)
-		})
+	}
+	opts := []natmap.MapOption{
+		natmap.WithLease(lease),
+		natmap.WithGateway(gatewayOptions(gateway, gatewayIf)...),
+		natmap.WithCascade(cascade),
+		natmap.WithEvents(events),
+		natmap.WithMode(strings.Split(mode, ",")...),
+		natmap.WithVerifyInterval(verify),
+	}
+	if laddr6.IsValid() {
+		opts = append(opts, natmap.WithIPv6(laddr6))
+	}
+	if upstream != "" {
+		up, err := parseUpstream(upstream)
 		if err != nil {
 			return fmt.Errorf("openPort: %w", err)
 		}
-		defer l.Close()
+		opts = append(opts, natmap.WithUpstream(up))
+	}
+	k, err := keepaliver(stunPool, udp)
+	if err != nil {
+		return fmt.Errorf("openPort: %w", err)
+	}
+	opts = append(opts, natmap.WithKeepalive(k), natmap.WithKeepaliveFailures(keepaliveFailures))
+	if lifetime != 0 {
+		opts = append(opts, natmap.WithBindingLifetime(lifetime))
 	}
-	if testserver {
-		l, err := testServer(ctx, laddr)
+	if portRange != "" {
+		min, max, err := parsePortRange(portRange)
 		if err != nil {
 			return fmt.Errorf("openPort: %w", err)
 		}
-		defer l.Close()
+		opts = append(opts, natmap.WithPortRange(min, max))
 	}
-	errCh := make(chan error, 1)
-	var nmap func(ctx context.Context, stunAddr string, laddr netip.AddrPort, log func(error)) (*natmap.Map, netip.AddrPort, error)
+	protocol := "tcp"
 	if udp {
-		nmap = natmap.NatMapUdp
-	} else {
-		nmap = natmap.NatMap
+		protocol = "udp"
 	}
-
-	m, s, err := nmap(ctx, stun, laddr, func(s error) {
-		cancel()
-		select {
-		case errCh <- s:
-		default:
-		}
-	})
+	session, err := natmap.NewSession(laddr,
+		natmap.WithProtocol(protocol),
+		natmap.WithSTUNPool(stunPool),
+		natmap.WithMapOptions(opts...),
+		natmap.WithLog(func(err error) {
+			log.Println(err)
+		}),
+		natmap.WithOnMap(func(m *natmap.Map) {
+			if d := m.Diagnosis(); d.WAN != natmap.WANPublic {
+				log.Printf("%v: %v", d.WAN, d)
+			}
+			if p := m.RouterPort(); p != 0 && p != laddr.Port() {
+				log.Printf("port %d is taken on a router, mapped external port %d instead", laddr.Port(), p)
+			}
+		}),
+		natmap.WithOnEvent(func(e natmap.Event) {
+			switch e.Type {
+			case natmap.EventUnchanged:
+				log.Println("mapped address unchanged after reconnect:", e.Addr)
+			case natmap.EventDegraded:
+				log.Println("keepalive degraded:", e.Err)
+			case natmap.EventRecovered:
+				log.Println("keepalive recovered")
+			}
+		}),
+		natmap.WithHook(finish),
+	)
 	if err != nil {
 		return fmt.Errorf("openPort: %w", err)
 	}
-	defer m.Close()
+	if err := session.Start(ctx); err != nil {
+		return fmt.Errorf("openPort: %w", err)
+	}
+	defer func() {
+		if err := session.Close(); err != nil {
+			log.Println(err)
+		}
+	}()
+	<-session.Done()
+	if err := session.Err(); !errors.Is(err, context.Canceled) {
+		return fmt.Errorf("openPort: %w", err)
+	}
+	return nil
+}
 
-	finish(s)
+// keepaliver returns the keepalive selected by -keepalive.
+func keepaliver(stunPool *stun.Pool, udp bool) (natmap.Keepaliver, error) {
+	kind := keepalive
+	if kind == "" {
+		kind = "http"
+		if udp {
+			kind = "dns"
+		}
+	}
+	if udp && kind != "dns" && kind != "stun" || !udp && kind == "dns" {
+		return nil, fmt.Errorf("keepaliver: -keepalive %v does not work with -u=%v", kind, udp)
+	}
+	switch kind {
+	case "dns":
+		return natmap.DNSKeepalive{Server: keepaliveAddr, Domain: keepaliveDomain, Interval: keepaliveInterval, Timeout: keepaliveTimeout}, nil
+	case "http":
+		return natmap.HTTPKeepalive{URL: keepaliveURL, Interval: keepaliveInterval, Timeout: keepaliveTimeout}, nil
+	case "tcp":
+		addr := keepaliveAddr
+		if addr == "" {
+			addr = stunPool.Servers()[0].Addr()
+		}
+		return natmap.TCPKeepalive{Addr: addr, Interval: keepaliveInterval, Timeout: keepaliveTimeout}, nil
+	case "stun":
+		return natmap.STUNKeepalive{
+			Servers:   stunPool.Servers(),
+			TLSConfig: stunPool.TLSConfig,
+			Interval:  keepaliveInterval,
+			Timeout:   keepaliveTimeout,
+		}, nil
+	}
+	return nil, fmt.Errorf("keepaliver: unknown keepalive %q", kind)
+}
 
-	err = <-errCh
+// parsePortRange parses min-max.
+func parsePortRange(s string) (uint16, uint16, error) {
+	a, b, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("parsePortRange: bad range %q", s)
+	}
+	min, err := strconv.ParseUint(a, 10, 16)
 	if err != nil {
-		return fmt.Errorf("openPort: %w", err)
+		return 0, 0, fmt.Errorf("parsePortRange: %w", err)
 	}
-	return nil
+	max, err := strconv.ParseUint(b, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parsePortRange: %w", err)
+	}
+	return uint16(min), uint16(max), nil
 }
 
 func testServer(ctx context.Context, laddr netip.AddrPort) (net.Listener, error) {
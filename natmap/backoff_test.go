@@ -0,0 +1,38 @@
+package natmap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		failures int
+		want     time.Duration
+		jitter   bool
+	}{
+		{10 * time.Second, 0, 10 * time.Second, true},
+		{10 * time.Second, 1, time.Second, false},
+		{10 * time.Second, 2, 2 * time.Second, false},
+		{10 * time.Second, 3, 4 * time.Second, false},
+		{10 * time.Second, 4, 8 * time.Second, false},
+		{10 * time.Second, 5, 10 * time.Second, true},
+		{10 * time.Second, 1000, 10 * time.Second, true},
+		{500 * time.Millisecond, 1, 500 * time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			got := backoff(tt.interval, tt.failures)
+			lo, hi := tt.want, tt.want
+			if tt.jitter {
+				lo = time.Duration(float64(tt.want) * (1 - keepaliveJitter))
+				hi = time.Duration(float64(tt.want) * (1 + keepaliveJitter))
+			}
+			if got < lo || got > hi {
+				t.Errorf("backoff(%v, %d) = %v, want %v to %v", tt.interval, tt.failures, got, lo, hi)
+				break
+			}
+		}
+	}
+}
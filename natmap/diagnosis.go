@@ -0,0 +1,86 @@
+package natmap
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// WANType classifies the external address the router reports.
+type WANType int
+
+const (
+	// WANUnknown means no router mapping reported an external address.
+	WANUnknown WANType = iota
+	// WANPublic means the router has the public address STUN sees.
+	WANPublic
+	// WANShared means the router has an RFC 6598 shared address, i.e. the
+	// ISP runs a carrier-grade NAT in front of it.
+	WANShared
+	// WANPrivate means the router has a private address, i.e. another NAT,
+	// such as a modem in router mode, is in front of it.
+	WANPrivate
+	// WANMismatch means the router has a public address other than the one
+	// STUN sees, e.g. traffic leaves over another WAN or a proxy.
+	WANMismatch
+)
+
+func (t WANType) String() string {
+	switch t {
+	case WANPublic:
+		return "public"
+	case WANShared:
+		return "cgnat"
+	case WANPrivate:
+		return "double nat"
+	case WANMismatch:
+		return "mismatch"
+	default:
+		return "unknown"
+	}
+}
+
+// Diagnosis compares the external address of the router with the mapped
+// address seen by STUN.
+type Diagnosis struct {
+	WAN WANType
+	// RouterIP is the external address the router reports, if any.
+	RouterIP netip.Addr
+	// MappedAddr is the address STUN sees.
+	MappedAddr netip.AddrPort
+}
+
+var sharedPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// diagnose classifies routerIP against the STUN mapped address.
+func diagnose(routerIP netip.Addr, mapped netip.AddrPort) Diagnosis {
+	d := Diagnosis{RouterIP: routerIP, MappedAddr: mapped}
+	routerIP = routerIP.Unmap()
+	switch {
+	case !routerIP.IsValid() || routerIP.IsUnspecified():
+		d.WAN = WANUnknown
+	case sharedPrefix.Contains(routerIP):
+		d.WAN = WANShared
+	case routerIP.IsPrivate() || routerIP.IsLoopback() || routerIP.IsLinkLocalUnicast():
+		d.WAN = WANPrivate
+	case routerIP == mapped.Addr().Unmap():
+		d.WAN = WANPublic
+	default:
+		d.WAN = WANMismatch
+	}
+	return d
+}
+
+func (d Diagnosis) String() string {
+	switch d.WAN {
+	case WANPublic:
+		return fmt.Sprintf("router has the public address %v", d.RouterIP)
+	case WANShared:
+		return fmt.Sprintf("router address %v is an RFC 6598 shared address, the ISP's carrier-grade NAT is in front of it; %v is only reachable if that NAT keeps the mapping open", d.RouterIP, d.MappedAddr)
+	case WANPrivate:
+		return fmt.Sprintf("router address %v is private, another NAT is in front of it (double NAT); map the port there too or set the router as its DMZ host", d.RouterIP)
+	case WANMismatch:
+		return fmt.Sprintf("router address %v differs from the address STUN sees %v; traffic may leave over another WAN or a proxy", d.RouterIP, d.MappedAddr)
+	default:
+		return fmt.Sprintf("router external address unknown, STUN sees %v", d.MappedAddr)
+	}
+}
@@ -0,0 +1,52 @@
+package natmap
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestDiagnose(t *testing.T) {
+	mapped := netip.MustParseAddrPort("203.0.113.7:4000")
+	tests := []struct {
+		router string
+		want   WANType
+	}{
+		{"", WANUnknown},
+		{"0.0.0.0", WANUnknown},
+		{"::", WANUnknown},
+		{"203.0.113.7", WANPublic},
+		{"::ffff:203.0.113.7", WANPublic},
+		{"198.51.100.1", WANMismatch},
+		{"100.64.0.0", WANShared},
+		{"100.64.0.1", WANShared},
+		{"100.100.1.1", WANShared},
+		{"100.127.255.255", WANShared},
+		{"::ffff:100.64.0.1", WANShared},
+		{"100.63.255.255", WANMismatch},
+		{"100.128.0.0", WANMismatch},
+		{"10.0.0.2", WANPrivate},
+		{"172.16.0.2", WANPrivate},
+		{"192.168.1.2", WANPrivate},
+		{"127.0.0.1", WANPrivate},
+		{"169.254.1.1", WANPrivate},
+		{"fd00::1", WANPrivate},
+	}
+	for _, tt := range tests {
+		var router netip.Addr
+		if tt.router != "" {
+			router = netip.MustParseAddr(tt.router)
+		}
+		d := diagnose(router, mapped)
+		if d.WAN != tt.want {
+			t.Errorf("diagnose(%q) = %v, want %v", tt.router, d.WAN, tt.want)
+		}
+		if d.RouterIP != router || d.MappedAddr != mapped {
+			t.Errorf("diagnose(%q) = %+v, want the addresses kept", tt.router, d)
+		}
+	}
+
+	// Only the address of the mapping counts, not its port.
+	if d := diagnose(mapped.Addr(), netip.AddrPortFrom(mapped.Addr(), 1)); d.WAN != WANPublic {
+		t.Errorf("diagnose with another port = %v, want %v", d.WAN, WANPublic)
+	}
+}
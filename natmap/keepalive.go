@@ -0,0 +1,408 @@
+package natmap
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/xmdhs/natupnp/stun"
+)
+
+// Keepaliver keeps traffic flowing through the mapping, so the NAT does not
+// drop it while idle. See WithKeepalive.
+type Keepaliver interface {
+	// Keepalive sends traffic from laddr over network ("tcp" or "udp") until
+	// ctx is done. Failures are passed to log, as is nil after a successful
+	// probe, so the Map can tell when the keepalive recovers. After a failure
+	// the next probe should be sent sooner, see WithKeepaliveFailures.
+	Keepalive(ctx context.Context, network string, laddr netip.AddrPort, log func(error))
+}
+
+// KeepaliveFunc adapts a function to Keepaliver.
+type KeepaliveFunc func(ctx context.Context, network string, laddr netip.AddrPort, log func(error))
+
+func (f KeepaliveFunc) Keepalive(ctx context.Context, network string, laddr netip.AddrPort, log func(error)) {
+	f(ctx, network, laddr, log)
+}
+
+// Keepalive defaults, used for zero fields. Intervals vary by 10% at random.
+const (
+	DefaultKeepaliveInterval = 10 * time.Second
+	DefaultKeepaliveTimeout  = 10 * time.Second
+	DefaultKeepaliveURL      = "http://www.gstatic.com/generate_204"
+	DefaultKeepaliveDNS      = "223.5.5.5:53"
+	DefaultKeepaliveDNS6     = "[2400:3200::1]:53"
+	DefaultKeepaliveDomain   = "baidu.com"
+)
+
+// ErrAddrChanged is logged by STUNKeepalive when the mapped address changes.
+var ErrAddrChanged = errors.New("mapped address changed")
+
+var errKeepaliveNetwork = errors.New("keepalive does not support network")
+
+// keepaliveJitter is how far keepalive intervals vary at random, so the
+// probes of many hosts do not line up.
+const keepaliveJitter = 0.1
+
+// keepaliveRetry is how soon a probe is retried after a failure. It doubles
+// with every further failure, up to the keepalive interval.
+const keepaliveRetry = time.Second
+
+// HTTPKeepalive sends a HEAD request to URL every Interval. It only keeps tcp
+// mappings alive.
+type HTTPKeepalive struct {
+	// URL defaults to DefaultKeepaliveURL. It may be https.
+	URL      string
+	Interval time.Duration
+	// Timeout bounds each request.
+	Timeout time.Duration
+}
+
+func (k HTTPKeepalive) Keepalive(ctx context.Context, network string, laddr netip.AddrPort, log func(error)) {
+	if network != "tcp" {
+		log(fmt.Errorf("HTTPKeepalive: %w %v", errKeepaliveNetwork, network))
+		return
+	}
+	url := k.URL
+	if url == "" {
+		url = DefaultKeepaliveURL
+	}
+	interval := orDefault(k.Interval, DefaultKeepaliveInterval)
+	timeout := orDefault(k.Timeout, DefaultKeepaliveTimeout)
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialFrom(ctx, "tcp", laddr, addr)
+	}
+	tr.Proxy = nil
+	c := http.Client{Transport: tr, Timeout: timeout}
+	defer c.CloseIdleConnections()
+
+	probeLoop(ctx, interval, log, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+		if err != nil {
+			return fmt.Errorf("HTTPKeepalive: %w", err)
+		}
+		rep, err := c.Do(req)
+		if err != nil {
+			c.CloseIdleConnections()
+			return fmt.Errorf("HTTPKeepalive: %w", err)
+		}
+		rep.Body.Close()
+		return nil
+	})
+}
+
+func (k HTTPKeepalive) withInterval(d time.Duration) Keepaliver {
+	k.Interval = d
+	return k
+}
+
+// TCPKeepalive holds a tcp connection to Addr, e.g. the STUN server, open and
+// lets the kernel send TCP keepalive probes every Interval. Nothing is sent
+// on the connection itself. It only keeps tcp mappings alive, and the Map
+// then only re-checks the mapping when the connection fails.
+type TCPKeepalive struct {
+	Addr     string
+	Interval time.Duration
+	// Timeout bounds the dial.
+	Timeout time.Duration
+}
+
+func (k TCPKeepalive) Keepalive(ctx context.Context, network string, laddr netip.AddrPort, log func(error)) {
+	if network != "tcp" {
+		log(fmt.Errorf("TCPKeepalive: %w %v", errKeepaliveNetwork, network))
+		return
+	}
+	interval := orDefault(k.Interval, DefaultKeepaliveInterval)
+	timeout := orDefault(k.Timeout, DefaultKeepaliveTimeout)
+
+	failures := 0
+	for {
+		err := k.hold(ctx, laddr, interval, timeout, func() {
+			failures = 0
+			log(nil)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			failures++
+			log(fmt.Errorf("TCPKeepalive: %w", err))
+		}
+		if !sleep(ctx, backoff(interval, failures)) {
+			return
+		}
+	}
+}
+
+// hold dials Addr, calls connected and blocks until the connection fails. A
+// close by the server is not an error, it is just dialed again.
+func (k TCPKeepalive) hold(ctx context.Context, laddr netip.AddrPort, interval, timeout time.Duration, connected func()) error {
+	dctx, cancel := context.WithTimeout(ctx, timeout)
+	conn, err := dialFrom(dctx, "tcp", laddr, k.Addr)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("hold: %w", err)
+	}
+	defer conn.Close()
+	connected()
+	tc := conn.(*net.TCPConn)
+	tc.SetKeepAlive(true)
+	tc.SetKeepAlivePeriod(interval)
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	_, err = io.Copy(io.Discard, conn)
+	if err != nil {
+		return fmt.Errorf("hold: %w", err)
+	}
+	return nil
+}
+
+func (TCPKeepalive) holdsConn() {}
+
+func (k TCPKeepalive) withInterval(d time.Duration) Keepaliver {
+	k.Interval = d
+	return k
+}
+
+// DNSKeepalive looks Domain up on the DNS server Server every Interval. It only
+// keeps udp mappings alive.
+type DNSKeepalive struct {
+	// Server is host:port, it defaults to DefaultKeepaliveDNS, or
+	// DefaultKeepaliveDNS6 for an IPv6 laddr.
+	Server string
+	// Domain defaults to DefaultKeepaliveDomain.
+	Domain   string
+	Interval time.Duration
+	// Timeout bounds each lookup.
+	Timeout time.Duration
+}
+
+func (k DNSKeepalive) Keepalive(ctx context.Context, network string, laddr netip.AddrPort, log func(error)) {
+	if network != "udp" {
+		log(fmt.Errorf("DNSKeepalive: %w %v", errKeepaliveNetwork, network))
+		return
+	}
+	server := k.Server
+	if server == "" {
+		server = DefaultKeepaliveDNS
+		if laddr.Addr().Is6() {
+			server = DefaultKeepaliveDNS6
+		}
+	}
+	domain := k.Domain
+	if domain == "" {
+		domain = DefaultKeepaliveDomain
+	}
+	interval := orDefault(k.Interval, DefaultKeepaliveInterval)
+	timeout := orDefault(k.Timeout, DefaultKeepaliveTimeout)
+
+	r := net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialFrom(ctx, "udp", laddr, server)
+		},
+	}
+	probeLoop(ctx, interval, log, func() error {
+		lctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		if _, err := r.LookupNetIP(lctx, "ip4", domain); err != nil {
+			return fmt.Errorf("DNSKeepalive: %w", err)
+		}
+		return nil
+	})
+}
+
+func (k DNSKeepalive) withInterval(d time.Duration) Keepaliver {
+	k.Interval = d
+	return k
+}
+
+// STUNKeepalive sends a STUN Binding request every Interval over one
+// connection to the first of Servers that answers, and logs ErrAddrChanged
+// if the mapped address changes. It works for tcp and udp mappings. On failure
+// the next server is tried. As it checks the mapped address itself, the Map
+// skips its periodic checks.
+type STUNKeepalive struct {
+	Servers []stun.URI
+	// TLSConfig is used for stuns servers, see stun.Pool.TLSConfig.
+	TLSConfig *tls.Config
+	Interval  time.Duration
+	// Timeout bounds the dial and each request.
+	Timeout time.Duration
+}
+
+func (k STUNKeepalive) Keepalive(ctx context.Context, network string, laddr netip.AddrPort, log func(error)) {
+	if len(k.Servers) == 0 {
+		log(errors.New("STUNKeepalive: no stun server"))
+		return
+	}
+	interval := orDefault(k.Interval, DefaultKeepaliveInterval)
+	timeout := orDefault(k.Timeout, DefaultKeepaliveTimeout)
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialFrom(ctx, network, laddr, addr)
+	}
+
+	var (
+		addr     netip.AddrPort
+		i        int
+		failures int
+	)
+	for {
+		u := k.Servers[i%len(k.Servers)]
+		err := k.session(ctx, network, u, dial, &addr, interval, timeout, func() {
+			failures = 0
+			log(nil)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		log(fmt.Errorf("STUNKeepalive: %v: %w", u, err))
+		if !errors.Is(err, ErrAddrChanged) {
+			failures++
+			i++
+		}
+		if !sleep(ctx, backoff(interval, failures)) {
+			return
+		}
+	}
+}
+
+// session sends Binding requests to u over one connection, calling ok after
+// each answer, until one fails or the mapped address differs from addr,
+// which is then updated. The connection is closed before returning, so the
+// Map can re-check from the same port.
+func (k STUNKeepalive) session(ctx context.Context, network string, u stun.URI, dial stun.DialFunc, addr *netip.AddrPort,
+	interval, timeout time.Duration, ok func()) error {
+	dctx, cancel := context.WithTimeout(ctx, timeout)
+	conn, err := u.Dial(dctx, network, dial, k.TLSConfig)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("session: %w", err)
+	}
+	defer conn.Close()
+
+	for {
+		rctx, cancel := context.WithTimeout(ctx, timeout)
+		xorAddr, err := stun.GetMappedAddress(rctx, conn)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("session: %w", err)
+		}
+		ip, _ := netip.AddrFromSlice(xorAddr.IP)
+		got := netip.AddrPortFrom(ip.Unmap(), uint16(xorAddr.Port))
+		old := *addr
+		*addr = got
+		if old.IsValid() && got != old {
+			return fmt.Errorf("session: %w: %v to %v", ErrAddrChanged, old, got)
+		}
+		ok()
+		if !sleep(ctx, jitter(interval)) {
+			return nil
+		}
+	}
+}
+
+func (STUNKeepalive) holdsConn() {}
+
+func (k STUNKeepalive) withInterval(d time.Duration) Keepaliver {
+	k.Interval = d
+	return k
+}
+
+// intervalSetter is implemented by the built-in Keepalivers, whose interval
+// WithBindingLifetime adapts.
+type intervalSetter interface {
+	withInterval(d time.Duration) Keepaliver
+}
+
+// connHolder is implemented by Keepalivers that hold a connection from the
+// mapped port open. Dialing the same server from that port fails meanwhile,
+// so the Map skips its periodic STUN checks and relies on the keepalive.
+type connHolder interface {
+	holdsConn()
+}
+
+// probeLoop calls probe every interval until ctx is done and passes its
+// result to log. Failed probes are retried sooner, see backoff.
+func probeLoop(ctx context.Context, interval time.Duration, log func(error), probe func() error) {
+	failures := 0
+	for {
+		err := probe()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			failures++
+		} else {
+			failures = 0
+		}
+		log(err)
+		if !sleep(ctx, backoff(interval, failures)) {
+			return
+		}
+	}
+}
+
+// backoff returns how long to wait for the next probe after failures failed
+// probes in a row: keepaliveRetry, doubled for every further failure, or
+// about interval if there were none or it is shorter.
+func backoff(interval time.Duration, failures int) time.Duration {
+	if failures == 0 {
+		return jitter(interval)
+	}
+	d := keepaliveRetry
+	for i := 1; i < failures && d < interval; i++ {
+		d *= 2
+	}
+	if d > interval {
+		return jitter(interval)
+	}
+	return d
+}
+
+// jitter returns d give or take keepaliveJitter.
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration((rand.Float64()*2-1)*keepaliveJitter*float64(d))
+}
+
+// closeOnDone closes conn when ctx is done, until stop is called.
+func closeOnDone(ctx context.Context, conn net.Conn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// sleep waits for d and reports whether ctx is still not done.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
@@ -0,0 +1,281 @@
+package natmap_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	pionstun "github.com/pion/stun"
+	"github.com/xmdhs/natupnp/natmap"
+	"github.com/xmdhs/natupnp/stun"
+)
+
+// runKeepalive runs k from laddr until n results were logged and returns
+// them.
+func runKeepalive(t *testing.T, k natmap.Keepaliver, network string, laddr netip.AddrPort, n int) []error {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	logged := make(chan error)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		k.Keepalive(ctx, network, laddr, func(err error) {
+			select {
+			case logged <- err:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	var l []error
+	for len(l) < n {
+		select {
+		case err := <-logged:
+			l = append(l, err)
+		case <-done:
+			return l
+		case <-time.After(5 * time.Second):
+			t.Fatalf("logged %v, want %d results", l, n)
+		}
+	}
+	return l
+}
+
+// addrSet records remote addresses.
+type addrSet struct {
+	mu sync.Mutex
+	l  []netip.AddrPort
+}
+
+func (s *addrSet) add(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.l = append(s.l, netip.MustParseAddrPort(addr))
+}
+
+func (s *addrSet) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprint(s.l)
+}
+
+// only reports whether every address recorded is want, and there are some.
+func (s *addrSet) only(want netip.AddrPort) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.l {
+		if v != want {
+			return false
+		}
+	}
+	return len(s.l) > 0
+}
+
+func TestHTTPKeepalive(t *testing.T) {
+	var from addrSet
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			t.Errorf("method = %v, want HEAD", r.Method)
+		}
+		from.add(r.RemoteAddr)
+	}))
+	defer srv.Close()
+	laddr := freePort(t, "tcp")
+
+	k := natmap.HTTPKeepalive{URL: srv.URL, Interval: 20 * time.Millisecond}
+	for _, err := range runKeepalive(t, k, "tcp", laddr, 3) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !from.only(laddr) {
+		t.Errorf("requests from %v, want %v", &from, laddr)
+	}
+
+	if l := runKeepalive(t, k, "udp", freePort(t, "udp"), 1); len(l) != 1 || l[0] == nil {
+		t.Errorf("logged %v over udp, want an error", l)
+	}
+
+	srv.Close()
+	if l := runKeepalive(t, k, "tcp", freePort(t, "tcp"), 1); l[0] == nil {
+		t.Error("no error with the server down")
+	}
+}
+
+func TestTCPKeepalive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var from addrSet
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			from.add(c.RemoteAddr().String())
+			// A server closing the connection is no failure.
+			c.Close()
+		}
+	}()
+	laddr := freePort(t, "tcp")
+
+	k := natmap.TCPKeepalive{Addr: l.Addr().String(), Interval: 20 * time.Millisecond}
+	for _, err := range runKeepalive(t, k, "tcp", laddr, 3) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !from.only(laddr) {
+		t.Errorf("connections from %v, want %v", &from, laddr)
+	}
+
+	l.Close()
+	if l := runKeepalive(t, k, "tcp", freePort(t, "tcp"), 1); l[0] == nil {
+		t.Error("no error with the server down")
+	}
+}
+
+func TestSTUNKeepalive(t *testing.T) {
+	dead, err := stun.ParseURI(deadAddr(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := startSTUN(t).Servers()[0]
+	for _, network := range []string{"tcp", "udp"} {
+		t.Run(network, func(t *testing.T) {
+			k := natmap.STUNKeepalive{Servers: []stun.URI{dead, live}, Interval: 20 * time.Millisecond, Timeout: 200 * time.Millisecond}
+			l := runKeepalive(t, k, network, freePort(t, network), 3)
+			// The dead server fails, the next one answers.
+			if l[0] == nil || l[1] != nil || l[2] != nil {
+				t.Errorf("logged %v, want an error then successes", l)
+			}
+		})
+	}
+}
+
+func TestSTUNKeepaliveAddrChanged(t *testing.T) {
+	// The server sees the port move after two requests, as after a NAT
+	// reboot.
+	var n int
+	u := startFakeSTUN(t, func() netip.AddrPort {
+		n++
+		if n <= 2 {
+			return netip.MustParseAddrPort("192.0.2.1:1000")
+		}
+		return netip.MustParseAddrPort("192.0.2.1:2000")
+	})
+	k := natmap.STUNKeepalive{Servers: []stun.URI{u}, Interval: 20 * time.Millisecond}
+	l := runKeepalive(t, k, "udp", freePort(t, "udp"), 4)
+	if l[0] != nil || l[1] != nil || !errors.Is(l[2], natmap.ErrAddrChanged) || l[3] != nil {
+		t.Errorf("logged %v, want %v after two successes, then success", l, natmap.ErrAddrChanged)
+	}
+}
+
+func TestDNSKeepalive(t *testing.T) {
+	var from addrSet
+	server := startFakeDNS(t, &from)
+	laddr := freePort(t, "udp")
+	k := natmap.DNSKeepalive{Server: server, Domain: "example.com", Interval: 20 * time.Millisecond}
+	for _, err := range runKeepalive(t, k, "udp", laddr, 3) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !from.only(laddr) {
+		t.Errorf("queries from %v, want %v", &from, laddr)
+	}
+	if l := runKeepalive(t, k, "tcp", freePort(t, "tcp"), 1); len(l) != 1 || l[0] == nil {
+		t.Errorf("logged %v over tcp, want an error", l)
+	}
+}
+
+// deadAddr returns a loopback address nothing listens on, over tcp or udp.
+func deadAddr(t *testing.T) string {
+	t.Helper()
+	return freePort(t, "tcp").String()
+}
+
+// startFakeDNS answers every A query on loopback with 192.0.2.1, recording
+// where the queries came from.
+func startFakeDNS(t *testing.T, from *addrSet) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			from.add(addr.String())
+			// The header and question of the query, flagged as an answer with
+			// one record pointing back to the question name.
+			end := 12
+			for end < n && buf[end] != 0 {
+				end += int(buf[end]) + 1
+			}
+			end += 5
+			if end > n {
+				continue
+			}
+			res := append([]byte(nil), buf[:end]...)
+			res[2], res[3] = 0x81, 0x80
+			res[6], res[7] = 0, 1
+			res[10], res[11] = 0, 0
+			res = append(res, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 192, 0, 2, 1)
+			conn.WriteTo(res, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// startFakeSTUN answers Binding requests over udp on loopback with the
+// mapped address addr returns.
+func startFakeSTUN(t *testing.T, addr func() netip.AddrPort) stun.URI {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, raddr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := new(pionstun.Message)
+			if err := pionstun.Decode(append([]byte(nil), buf[:n]...), req); err != nil {
+				continue
+			}
+			a := addr()
+			res := pionstun.MustBuild(req, pionstun.BindingSuccess,
+				&pionstun.XORMappedAddress{IP: a.Addr().AsSlice(), Port: int(a.Port())}, pionstun.Fingerprint)
+			conn.WriteTo(res.Raw, raddr)
+		}
+	}()
+	u, err := stun.ParseURI(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
@@ -0,0 +1,210 @@
+package natmap
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/xmdhs/natupnp/stun"
+)
+
+// Lifetime probe defaults, used for zero fields.
+const (
+	DefaultProbeMinGap = 5 * time.Second
+	DefaultProbeMaxGap = 10 * time.Minute
+)
+
+// ErrServerClosed is returned by LifetimeProbe.Probe when the STUN server
+// closed the idle tcp connection before the NAT dropped it.
+var ErrServerClosed = errors.New("stun server closed the idle connection")
+
+// ErrNoResponsePort is returned by LifetimeProbe.Probe over udp when the STUN
+// server does not support the RFC 5780 RESPONSE-PORT attribute, or its
+// responses do not reach the probed port.
+var ErrNoResponsePort = errors.New("stun server cannot answer to the probed port")
+
+// LifetimeProbe measures how long the NAT keeps the binding of an idle local
+// port. The gap doubles until the binding expires or MaxGap is passed.
+//
+// Over tcp it asks Server for the mapped address over one connection, stays
+// idle for a gap and asks again; the binding expired if the mapped address
+// changed or the connection broke.
+//
+// Over udp asking again from the port would create a new binding, which many
+// NATs give the same port. So, as RFC 5780 section 4.6 describes, after each
+// gap a request is sent from a second local port with the RESPONSE-PORT
+// attribute set to the mapped port of the first; the binding expired if the
+// response does not reach it. Server must support RESPONSE-PORT, and stuns is
+// not supported over udp.
+//
+// Nothing else may send from the port meanwhile, so probe before mapping it.
+type LifetimeProbe struct {
+	Server stun.URI
+	// TLSConfig is used for a stuns Server, see stun.Pool.TLSConfig.
+	TLSConfig *tls.Config
+	// MinGap is the first idle gap, it defaults to DefaultProbeMinGap.
+	MinGap time.Duration
+	// MaxGap defaults to DefaultProbeMaxGap.
+	MaxGap time.Duration
+	// Timeout bounds the dial and each request, it defaults to
+	// DefaultKeepaliveTimeout.
+	Timeout time.Duration
+	// Progress, if set, is called after every gap.
+	Progress func(gap time.Duration, alive bool)
+}
+
+// Lifetime is the result of LifetimeProbe: the NAT keeps an idle binding for
+// at least Alive and for less than Expired.
+type Lifetime struct {
+	// Alive is the longest gap the binding survived, 0 if none.
+	Alive time.Duration
+	// Expired is the shortest gap the binding did not survive, 0 if it
+	// survived every gap up to MaxGap.
+	Expired time.Duration
+}
+
+func (l Lifetime) String() string {
+	if l.Expired == 0 {
+		return fmt.Sprintf("at least %v", l.Alive)
+	}
+	return fmt.Sprintf("at least %v, less than %v", l.Alive, l.Expired)
+}
+
+// Probe measures the binding lifetime of laddr over network, "tcp" or "udp".
+// It takes about twice the lifetime found. The Lifetime found so far is
+// returned with an error.
+func (p LifetimeProbe) Probe(ctx context.Context, network string, laddr netip.AddrPort) (Lifetime, error) {
+	if network == "udp" && p.Server.Secure {
+		return Lifetime{}, errors.New("Probe: stuns is not supported over udp")
+	}
+	timeout := orDefault(p.Timeout, DefaultKeepaliveTimeout)
+	dctx, cancel := context.WithTimeout(ctx, timeout)
+	conn, err := p.Server.Dial(dctx, network, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialFrom(ctx, network, laddr, addr)
+	}, p.TLSConfig)
+	cancel()
+	if err != nil {
+		return Lifetime{}, fmt.Errorf("Probe: %w", err)
+	}
+	defer conn.Close()
+
+	var check func(gap time.Duration) (bool, error)
+	if network == "udp" {
+		dctx, cancel := context.WithTimeout(ctx, timeout)
+		var d net.Dialer
+		other, derr := d.DialContext(dctx, "udp", conn.RemoteAddr().String())
+		cancel()
+		if derr != nil {
+			return Lifetime{}, fmt.Errorf("Probe: %w", derr)
+		}
+		defer other.Close()
+		check, err = p.udpCheck(ctx, conn, other)
+	} else {
+		check, err = p.tcpCheck(ctx, conn)
+	}
+	if err != nil {
+		return Lifetime{}, fmt.Errorf("Probe: %w", err)
+	}
+
+	var l Lifetime
+	for gap := orDefault(p.MinGap, DefaultProbeMinGap); gap <= orDefault(p.MaxGap, DefaultProbeMaxGap); gap *= 2 {
+		alive, err := check(gap)
+		if ctx.Err() != nil {
+			return l, fmt.Errorf("Probe: %w", ctx.Err())
+		}
+		if err != nil {
+			return l, fmt.Errorf("Probe: %w", err)
+		}
+		if p.Progress != nil {
+			p.Progress(gap, alive)
+		}
+		if !alive {
+			l.Expired = gap
+			return l, nil
+		}
+		l.Alive = gap
+	}
+	return l, nil
+}
+
+// query asks for the mapped address over conn.
+func (p LifetimeProbe) query(ctx context.Context, conn net.Conn) (netip.AddrPort, error) {
+	ctx, cancel := context.WithTimeout(ctx, orDefault(p.Timeout, DefaultKeepaliveTimeout))
+	defer cancel()
+	xorAddr, err := stun.GetMappedAddress(ctx, conn)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	ip, _ := netip.AddrFromSlice(xorAddr.IP)
+	return netip.AddrPortFrom(ip.Unmap(), uint16(xorAddr.Port)), nil
+}
+
+// tcpCheck returns the check of Probe over tcp: stay idle for the gap and
+// ask again over the connection.
+func (p LifetimeProbe) tcpCheck(ctx context.Context, conn net.Conn) (func(gap time.Duration) (bool, error), error) {
+	first, err := p.query(ctx, conn)
+	if err != nil {
+		return nil, fmt.Errorf("tcpCheck: %w", err)
+	}
+	return func(gap time.Duration) (bool, error) {
+		if !sleep(ctx, gap) {
+			return false, ctx.Err()
+		}
+		addr, err := p.query(ctx, conn)
+		if errors.Is(err, io.EOF) {
+			return false, ErrServerClosed
+		}
+		return err == nil && addr == first, nil
+	}, nil
+}
+
+// udpCheck returns the check of Probe over udp: refresh the binding of conn,
+// stay idle for the gap and ask the server from other, another local port, to
+// answer to the mapped port of conn.
+func (p LifetimeProbe) udpCheck(ctx context.Context, conn, other net.Conn) (func(gap time.Duration) (bool, error), error) {
+	responsePort := func(port uint16, recv net.Conn) error {
+		ctx, cancel := context.WithTimeout(ctx, orDefault(p.Timeout, DefaultKeepaliveTimeout))
+		defer cancel()
+		_, err := stun.ResponsePortBinding(ctx, other, port, recv)
+		return err
+	}
+
+	// other answered on its own port tells whether the server supports
+	// RESPONSE-PORT, then conn whether the answers reach its binding.
+	mapped, err := p.query(ctx, other)
+	if err != nil {
+		return nil, fmt.Errorf("udpCheck: %w", err)
+	}
+	var re *stun.ErrorResponse
+	if err := responsePort(mapped.Port(), other); errors.As(err, &re) || errors.Is(err, stun.ErrTimeout) {
+		return nil, fmt.Errorf("udpCheck: %w: %w", ErrNoResponsePort, err)
+	} else if err != nil {
+		return nil, fmt.Errorf("udpCheck: %w", err)
+	}
+	first, err := p.query(ctx, conn)
+	if err != nil {
+		return nil, fmt.Errorf("udpCheck: %w", err)
+	}
+	if err := responsePort(first.Port(), conn); err != nil {
+		return nil, fmt.Errorf("udpCheck: %w: %w", ErrNoResponsePort, err)
+	}
+	return func(gap time.Duration) (bool, error) {
+		addr, err := p.query(ctx, conn)
+		if err != nil {
+			return false, err
+		}
+		if !sleep(ctx, gap) {
+			return false, ctx.Err()
+		}
+		err = responsePort(addr.Port(), conn)
+		if errors.Is(err, stun.ErrTimeout) {
+			return false, nil
+		}
+		return err == nil, err
+	}, nil
+}
@@ -0,0 +1,38 @@
+package natmap_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/xmdhs/natupnp/natmap"
+)
+
+func TestLifetimeProbe(t *testing.T) {
+	for _, network := range []string{"tcp", "udp"} {
+		t.Run(network, func(t *testing.T) {
+			var gaps []time.Duration
+			p := natmap.LifetimeProbe{
+				Server:  startSTUN(t).Servers()[0],
+				MinGap:  50 * time.Millisecond,
+				MaxGap:  100 * time.Millisecond,
+				Timeout: time.Second,
+				Progress: func(gap time.Duration, alive bool) {
+					if alive {
+						gaps = append(gaps, gap)
+					}
+				},
+			}
+			l, err := p.Probe(context.Background(), network, freePort(t, network))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := (natmap.Lifetime{Alive: 100 * time.Millisecond}); l != want {
+				t.Errorf("lifetime = %+v, want %+v", l, want)
+			}
+			if len(gaps) != 2 {
+				t.Errorf("alive gaps = %v, want 2", gaps)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package natmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// PortMapper is a router API that maps ports, like UPnP IGD, PCP or NAT-PMP.
+// Implement it to plug in another router API, see WithPortMapper.
+type PortMapper interface {
+	// AddPortMapping maps laddr for lease, or permanently if lease is 0 and
+	// the router allows it. It returns an error wrapping ErrNotSupported if
+	// the router does not speak the API, so the next PortMapper is tried.
+	AddPortMapping(ctx context.Context, protocol string, laddr netip.AddrPort, lease time.Duration) (PortMapping, error)
+	// RenewPortMapping refreshes m for lease. It is called at half the lease
+	// of m until the Map is closed.
+	RenewPortMapping(ctx context.Context, m PortMapping, lease time.Duration) (PortMapping, error)
+	// DeletePortMapping removes m.
+	DeletePortMapping(ctx context.Context, m PortMapping) error
+	// ExternalIP returns the external address of the router, or the zero
+	// value if the router does not tell.
+	ExternalIP(ctx context.Context) (netip.Addr, error)
+}
+
+// PortMapping is a port mapping created by a PortMapper.
+type PortMapping struct {
+	Protocol     string
+	Internal     netip.AddrPort
+	ExternalPort uint16
+	// Lease is the lease the router granted, 0 for a permanent mapping,
+	// which is not renewed.
+	Lease time.Duration
+	// State is private to the PortMapper, e.g. the nonce of a PCP mapping.
+	State any
+}
+
+// ErrNotSupported is wrapped by PortMapper.AddPortMapping errors when the
+// router does not speak the API.
+var ErrNotSupported = errors.New("port mapping api not supported by the router")
+
+var errNoRouterMapping = errors.New("no port mapping on router")
+
+// PortVerifier is implemented by PortMappers that can check a mapping on the
+// router. The mapping is then re-verified periodically, see
+// WithVerifyInterval, and added again if it is gone or was changed.
+type PortVerifier interface {
+	// VerifyPortMapping returns an error if m is not on the router as it was
+	// added.
+	VerifyPortMapping(ctx context.Context, m PortMapping) error
+}
+
+// watcher is implemented by PortMappers whose router reports reconnects.
+type watcher interface {
+	// watch calls recheck on every reconnect until ctx is done.
+	watch(ctx context.Context, recheck func(error))
+}
+
+// Port mapping modes, see WithMode.
+const (
+	ModeAuto   = "auto"
+	ModeUPnP   = "upnp"
+	ModePCP    = "pcp"
+	ModeNATPMP = "natpmp"
+	ModeNone   = "none"
+)
+
+// mapperRetry is how soon a failed renewal is retried, at most.
+const mapperRetry = 30 * time.Second
+
+// portMappers returns the PortMappers of c, in the order they are tried.
+func portMappers(c *mapConfig, log func(error)) []PortMapper {
+	mappers := c.mappers
+	if mappers == nil {
+		mappers = []mapperEntry{{mode: ModeAuto}}
+	}
+	var l []PortMapper
+	for _, e := range mappers {
+		switch e.mode {
+		case "":
+			l = append(l, e.pm)
+		case ModeAuto:
+			l = append(l, &upnpMapper{c: c, log: log}, &pcpMapper{}, &natpmpMapper{})
+		case ModeUPnP:
+			l = append(l, &upnpMapper{c: c, log: log})
+		case ModePCP:
+			l = append(l, &pcpMapper{})
+		case ModeNATPMP:
+			l = append(l, &natpmpMapper{})
+		case ModeNone:
+			l = append(l, noneMapper{})
+		}
+	}
+	return l
+}
+
+// mapOnRouter maps laddr with the PortMappers of c, in order, and keeps
+// renewing the mapping until ctx is done. The mapping is re-checked when the
+// router reports a reconnect. It returns an error wrapping errNoRouterMapping
+// if no PortMapper speaks the router's API.
+func (m *Map) mapOnRouter(ctx context.Context, laddr netip.AddrPort, protocol string, c *mapConfig, log func(error)) (*routerMapping, error) {
+	var notSupported, failed error
+	for _, pm := range portMappers(c, log) {
+		rm, err := m.mapWith(ctx, pm, laddr, protocol, c, log)
+		if err == nil {
+			return rm, nil
+		}
+		if errors.Is(err, ErrNotSupported) {
+			notSupported = errors.Join(notSupported, err)
+		} else {
+			failed = errors.Join(failed, err)
+		}
+	}
+	if failed != nil {
+		return nil, fmt.Errorf("mapOnRouter: %w", failed)
+	}
+	return nil, fmt.Errorf("mapOnRouter: %w", errors.Join(errNoRouterMapping, notSupported))
+}
+
+// mapWith maps laddr with pm and renews, and if pm is a PortVerifier
+// verifies, the mapping until ctx is done.
+func (m *Map) mapWith(ctx context.Context, pm PortMapper, laddr netip.AddrPort, protocol string, c *mapConfig, log func(error)) (*routerMapping, error) {
+	lease := c.lease
+	pmap, err := pm.AddPortMapping(ctx, protocol, laddr, lease)
+	if err != nil {
+		return nil, fmt.Errorf("mapWith: %w", err)
+	}
+	ip, err := pm.ExternalIP(ctx)
+	if err != nil {
+		log(fmt.Errorf("mapWith: %w", err))
+	}
+
+	rm := &routerMapping{externalPort: pmap.ExternalPort, externalIP: ip}
+	var mu sync.Mutex
+	get := func() PortMapping {
+		mu.Lock()
+		defer mu.Unlock()
+		return pmap
+	}
+	rm.delete = func(ctx context.Context) error {
+		return pm.DeletePortMapping(ctx, get())
+	}
+	update := func(next PortMapping) {
+		mu.Lock()
+		moved := next.ExternalPort != pmap.ExternalPort
+		pmap = next
+		mu.Unlock()
+		if moved {
+			m.routerPortMoved(laddr, next.ExternalPort)
+		}
+	}
+	if pmap.Lease != 0 {
+		m.goFunc(func() { renewPortMapping(ctx, pm, get, update, lease, log) })
+	}
+	if v, ok := pm.(PortVerifier); ok && c.verifyInterval > 0 {
+		m.goFunc(func() { verifyPortMapping(ctx, pm, v, get, update, lease, c.verifyInterval, m.keepaliveFailed, log) })
+	}
+	if w, ok := pm.(watcher); ok {
+		m.goFunc(func() { w.watch(ctx, m.keepaliveFailed) })
+	}
+	return rm, nil
+}
+
+// routerPortMoved records that the router mapping of laddr moved to port,
+// because the old one was taken by another host when it was restored, and
+// emits the new address as EventChanged. The mapped address only follows the
+// router port if it was on it, i.e. the router is the only NAT.
+func (m *Map) routerPortMoved(laddr netip.AddrPort, port uint16) {
+	m.mu.Lock()
+	if laddr.Addr().Unmap().Is4() {
+		if m.addr.Port() == m.routerPort {
+			m.addr = netip.AddrPortFrom(m.addr.Addr(), port)
+		}
+		m.routerPort = port
+	} else if m.addr6.IsValid() {
+		m.addr6 = netip.AddrPortFrom(m.addr6.Addr(), port)
+	}
+	addr := m.addr
+	m.mu.Unlock()
+	m.sendStatus(Event{Type: EventChanged, Addr: addr})
+}
+
+// renewPortMapping renews the mapping get returns at half its lease until
+// ctx is done, passing every renewed mapping to update.
+func renewPortMapping(ctx context.Context, pm PortMapper, get func() PortMapping, update func(PortMapping), lease time.Duration, log func(error)) {
+	wait := get().Lease / 2
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		// The mapping may have been restored by verifyPortMapping.
+		m := get()
+		rctx, cancel := context.WithTimeout(ctx, mapperRetry)
+		next, err := pm.RenewPortMapping(rctx, m, lease)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log(fmt.Errorf("renewPortMapping: %w", err))
+			wait = mapperRetry
+			if wait > m.Lease/2 {
+				wait = m.Lease / 2
+			}
+			continue
+		}
+		update(next)
+		if next.Lease == 0 {
+			return
+		}
+		wait = next.Lease / 2
+	}
+}
+
+// verifyPortMapping verifies the mapping every interval until ctx is done. A
+// mapping that is gone or was changed is added again, and recheck is called
+// as its external address may have changed. If it had to move to another
+// port, update reports that instead.
+func verifyPortMapping(ctx context.Context, pm PortMapper, v PortVerifier, get func() PortMapping, update func(PortMapping), lease, interval time.Duration, recheck, log func(error)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		m := get()
+		vctx, cancel := context.WithTimeout(ctx, mapperRetry)
+		err := v.VerifyPortMapping(vctx, m)
+		cancel()
+		if err == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log(fmt.Errorf("verifyPortMapping: %w", err))
+		rctx, cancel := context.WithTimeout(ctx, mapperRetry)
+		next, rerr := pm.RenewPortMapping(rctx, m, lease)
+		cancel()
+		if rerr != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log(fmt.Errorf("verifyPortMapping: restore: %w", rerr))
+			continue
+		}
+		update(next)
+		if next.ExternalPort != m.ExternalPort {
+			// update reported the new port, a STUN check would not see it.
+			log(fmt.Errorf("verifyPortMapping: mapping restored on port %d: %w", next.ExternalPort, err))
+			continue
+		}
+		recheck(fmt.Errorf("verifyPortMapping: mapping restored: %w", err))
+	}
+}
+
+// noneMapper creates no mapping, for routers with DMZ or a manual port
+// forwarding rule.
+type noneMapper struct{}
+
+func (noneMapper) AddPortMapping(ctx context.Context, protocol string, laddr netip.AddrPort, lease time.Duration) (PortMapping, error) {
+	return PortMapping{Protocol: protocol, Internal: laddr, ExternalPort: laddr.Port()}, nil
+}
+
+func (noneMapper) RenewPortMapping(ctx context.Context, m PortMapping, lease time.Duration) (PortMapping, error) {
+	return m, nil
+}
+
+func (noneMapper) DeletePortMapping(ctx context.Context, m PortMapping) error {
+	return nil
+}
+
+func (noneMapper) ExternalIP(ctx context.Context) (netip.Addr, error) {
+	return netip.Addr{}, nil
+}
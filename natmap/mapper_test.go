@@ -0,0 +1,55 @@
+package natmap_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/xmdhs/natupnp/natmap"
+	"github.com/xmdhs/natupnp/upnp/fakeigd"
+)
+
+func TestRestoreTakenPort(t *testing.T) {
+	ctx := context.Background()
+	pool := startSTUN(t)
+	d := &fakeigd.Device{}
+	opts := append(startIGD(t, d), natmap.WithVerifyInterval(50*time.Millisecond), natmap.WithCheckInterval(0))
+	laddr := freePort(t, "tcp")
+
+	m, addr, err := natmap.NatMap(ctx, pool, laddr, logTo(t), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	// Another host takes the port over, e.g. after a router reboot.
+	other := fakeigd.Mapping{ExternalPort: laddr.Port(), Protocol: "TCP", InternalPort: 80, InternalClient: "192.168.1.9", Enabled: true}
+	d.SetMapping(other)
+
+	var e natmap.Event
+	select {
+	case e = <-m.Events():
+	case <-time.After(3 * time.Second):
+		t.Fatal("no event after the mapping was taken over")
+	}
+	port := m.RouterPort()
+	if e.Type != natmap.EventChanged || e.Addr.Addr() != addr.Addr() || e.Addr.Port() != port || port == laddr.Port() {
+		t.Fatalf("event = %v %v, router port %d, want changed to a new port", e.Type, e.Addr, port)
+	}
+	if m.Addr() != e.Addr {
+		t.Errorf("Addr = %v, want %v", m.Addr(), e.Addr)
+	}
+	if got, ok := find(d, "TCP", laddr.Port()); !ok || got != other {
+		t.Errorf("mapping of the other host = %+v, %v, want it kept", got, ok)
+	}
+	if got, ok := find(d, "TCP", port); !ok || got.InternalClient != "127.0.0.1" || got.InternalPort != laddr.Port() {
+		t.Errorf("restored mapping = %+v, %v, want one to %v", got, ok, laddr)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if l := d.Mappings(); len(l) != 1 || l[0] != other {
+		t.Errorf("router mappings = %+v after Close, want the other host's only", l)
+	}
+}
@@ -0,0 +1,177 @@
+package natmap
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/xmdhs/natupnp/stun"
+)
+
+type EventType int
+
+const (
+	// EventChanged means the mapped address changed, Event.Addr is the new one.
+	EventChanged EventType = iota + 1
+	// EventUnchanged means the keepalive kept failing, the router reported a
+	// reconnect or the router port mapping had to be restored, but the
+	// mapped address survived it. Event.Err tells which.
+	EventUnchanged
+	// EventLost means the mapped address could not be determined any more.
+	// No further events follow.
+	EventLost
+	// EventDegraded means a keepalive probe failed, Event.Err tells why. The
+	// mapping is re-checked only if it keeps failing, see
+	// WithKeepaliveFailures.
+	EventDegraded
+	// EventRecovered means a keepalive probe succeeded again after
+	// EventDegraded.
+	EventRecovered
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventChanged:
+		return "changed"
+	case EventUnchanged:
+		return "unchanged after reconnect"
+	case EventLost:
+		return "lost"
+	case EventDegraded:
+		return "degraded"
+	case EventRecovered:
+		return "recovered"
+	default:
+		return "unknown"
+	}
+}
+
+// Event reports a change of the mapping, see Map.Events.
+type Event struct {
+	Type EventType
+	Addr netip.AddrPort
+	Err  error
+}
+
+// monitor re-checks the mapped address periodically and whenever the
+// keepalive keeps failing or the router reports a reconnect, and emits events
+// on m.events until ctx is done or the mapping is lost. Keepalive events from
+// m.status are passed on.
+func (m *Map) monitor(ctx context.Context, stunPool *stun.Pool, laddr netip.AddrPort, network string, interval time.Duration) {
+	defer close(m.events)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		var keepaliveErr error
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+		case keepaliveErr = <-m.recheck:
+		case e := <-m.status:
+			m.send(e)
+			continue
+		}
+
+		addr, err := mappedAddress(ctx, stunPool, laddr, network)
+		if ctx.Err() != nil {
+			return
+		}
+		switch {
+		case err != nil:
+			m.send(Event{Type: EventLost, Err: err})
+			return
+		case addr != m.Addr():
+			m.mu.Lock()
+			m.addr = addr
+			m.mu.Unlock()
+			m.send(Event{Type: EventChanged, Addr: addr})
+		case keepaliveErr != nil:
+			m.send(Event{Type: EventUnchanged, Addr: addr, Err: keepaliveErr})
+		}
+	}
+}
+
+// send emits e on m.events without blocking the monitor: if the reader fell
+// behind, the oldest event is dropped. Only the monitor sends, so e, and
+// EventLost in particular, always gets in.
+func (m *Map) send(e Event) {
+	for {
+		select {
+		case m.events <- e:
+			return
+		default:
+		}
+		select {
+		case <-m.events:
+		default:
+		}
+	}
+}
+
+// keepaliveLog returns the log func passed to the Keepaliver. Errors are
+// passed on to log. The first failure in a row emits EventDegraded, and a
+// success after it EventRecovered; every failures failures in a row, or a
+// changed mapped address, re-check the mapping. It never blocks the
+// Keepaliver.
+func (m *Map) keepaliveLog(failures int, log func(error)) func(error) {
+	var (
+		mu sync.Mutex
+		n  int
+	)
+	return func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err == nil {
+			if n > 0 {
+				n = 0
+				m.sendStatus(Event{Type: EventRecovered, Addr: m.Addr()})
+			}
+			return
+		}
+		log(err)
+		if errors.Is(err, ErrAddrChanged) {
+			m.keepaliveFailed(err)
+			return
+		}
+		n++
+		if n == 1 {
+			m.sendStatus(Event{Type: EventDegraded, Addr: m.Addr(), Err: err})
+		}
+		if n%failures == 0 {
+			m.keepaliveFailed(err)
+		}
+	}
+}
+
+// sendStatus passes e to the monitor, which emits it on m.events. Like send
+// it does not block: while the monitor is busy re-checking the mapping, the
+// oldest pending event is dropped.
+func (m *Map) sendStatus(e Event) {
+	for {
+		select {
+		case m.status <- e:
+			return
+		default:
+		}
+		select {
+		case <-m.status:
+		default:
+		}
+	}
+}
+
+// keepaliveFailed asks the monitor to re-check the mapping, err tells why.
+func (m *Map) keepaliveFailed(err error) {
+	select {
+	case m.recheck <- err:
+	default:
+	}
+}
@@ -0,0 +1,176 @@
+package natmap_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xmdhs/natupnp/natmap"
+	"github.com/xmdhs/natupnp/stun"
+)
+
+// failingKeepalive fails a probe every 5ms, the error tells how many failed.
+type failingKeepalive struct {
+	n atomic.Int32
+}
+
+func (k *failingKeepalive) Keepalive(ctx context.Context, network string, laddr netip.AddrPort, log func(error)) {
+	for sleepCtx(ctx, 5*time.Millisecond) {
+		log(fmt.Errorf("probe %d failed", k.n.Add(1)))
+	}
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func TestEventsUndrained(t *testing.T) {
+	k := &failingKeepalive{}
+	m, _, err := natmap.NatMap(context.Background(), startSTUN(t), freePort(t, "tcp"), func(error) {},
+		natmap.WithMode(natmap.ModeNone), natmap.WithKeepalive(k), natmap.WithKeepaliveFailures(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	// Every failure re-checks the mapping and emits EventUnchanged, far more
+	// than Events holds.
+	time.Sleep(500 * time.Millisecond)
+	var last natmap.Event
+	for len(m.Events()) > 0 {
+		last = <-m.Events()
+	}
+	var n int32
+	if last.Type != natmap.EventUnchanged || last.Err == nil {
+		t.Fatalf("last event = %v %v, want unchanged", last.Type, last.Err)
+	}
+	fmt.Sscanf(last.Err.Error(), "probe %d", &n)
+	if n <= 10 {
+		t.Errorf("last event after probe %d of %d, want a recent one", n, k.n.Load())
+	}
+}
+
+func TestEventsUndrainedLost(t *testing.T) {
+	srv := stun.NewServer(netip.AddrPortFrom(loopback, 0), netip.AddrPort{})
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	pool, err := stun.NewPool(srv.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _, err := natmap.NatMap(context.Background(), pool, freePort(t, "tcp"), func(error) {},
+		natmap.WithMode(natmap.ModeNone), natmap.WithKeepalive(&failingKeepalive{}), natmap.WithKeepaliveFailures(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	time.Sleep(200 * time.Millisecond)
+	srv.Close()
+
+	// The events fill up unread, but the loss still gets in.
+	time.Sleep(200 * time.Millisecond)
+	var last natmap.Event
+	for len(m.Events()) > 0 {
+		last = <-m.Events()
+	}
+	if last.Type != natmap.EventLost || last.Err == nil {
+		t.Errorf("last event = %v %v, want lost", last.Type, last.Err)
+	}
+	if _, ok := <-m.Events(); ok {
+		t.Error("Events not closed after EventLost")
+	}
+}
+
+// scriptedKeepalive passes the results sent on it to log.
+type scriptedKeepalive chan error
+
+func (k scriptedKeepalive) Keepalive(ctx context.Context, network string, laddr netip.AddrPort, log func(error)) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-k:
+			log(err)
+		}
+	}
+}
+
+func TestKeepaliveDegraded(t *testing.T) {
+	k := make(scriptedKeepalive)
+	m, addr, err := natmap.NatMap(context.Background(), startSTUN(t), freePort(t, "tcp"), func(error) {},
+		natmap.WithMode(natmap.ModeNone), natmap.WithKeepalive(k), natmap.WithKeepaliveFailures(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	failed := errors.New("probe failed")
+	for _, err := range []error{failed, failed, nil, nil} {
+		k <- err
+	}
+	want := []natmap.Event{
+		{Type: natmap.EventDegraded, Addr: addr, Err: failed},
+		{Type: natmap.EventRecovered, Addr: addr},
+	}
+	for _, w := range want {
+		select {
+		case e := <-m.Events():
+			if e != w {
+				t.Errorf("event = %+v, want %+v", e, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no %v event", w.Type)
+		}
+	}
+	// Two failures are below the threshold, so nothing re-checked the mapping.
+	select {
+	case e := <-m.Events():
+		t.Errorf("unexpected event %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// flappingKeepalive fails and succeeds in turn every 10ms, counting probes.
+type flappingKeepalive struct {
+	n atomic.Int32
+}
+
+func (k *flappingKeepalive) Keepalive(ctx context.Context, network string, laddr netip.AddrPort, log func(error)) {
+	for sleepCtx(ctx, 10*time.Millisecond) {
+		if k.n.Add(1)%2 == 1 {
+			log(errors.New("probe failed"))
+		} else {
+			log(nil)
+		}
+	}
+}
+
+func TestKeepaliveUndrained(t *testing.T) {
+	k := &flappingKeepalive{}
+	m, _, err := natmap.NatMap(context.Background(), startSTUN(t), freePort(t, "tcp"), func(error) {},
+		natmap.WithMode(natmap.ModeNone), natmap.WithKeepalive(k))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	// Every pair of probes emits EventDegraded and EventRecovered, nobody
+	// reads them.
+	time.Sleep(500 * time.Millisecond)
+	n := k.n.Load()
+	time.Sleep(500 * time.Millisecond)
+	if got := k.n.Load(); got < n+10 {
+		t.Errorf("%d probes, then %d: keepalive stalled", n, got)
+	}
+}
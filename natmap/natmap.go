@@ -6,20 +6,52 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"net/http"
 	"net/netip"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/xmdhs/natupnp/reuse"
 	"github.com/xmdhs/natupnp/stun"
-	"github.com/xmdhs/natupnp/upnp"
 )
 
+// Description is set on the port mappings natupnp creates, so stale ones can
+// be found again.
+const Description = "github.com/xmdhs/natupnp"
+
+// cleanupTimeout bounds the removal of port mappings on Close.
+const cleanupTimeout = 5 * time.Second
+
+// Map is a mapped port kept alive in the background.
 type Map struct {
-	cancel func()
+	cancel    func()
+	events    chan Event
+	recheck   chan error
+	status    chan Event
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+
+	mu         sync.Mutex
+	addr       netip.AddrPort
+	addr6      netip.AddrPort
+	routerPort uint16
+	routerIP   netip.Addr
+	diagnosis  Diagnosis
+	cleanup    []func(context.Context) error
 }
 
-func getPubulicPort(ctx context.Context, stunAddr string, laddr netip.AddrPort, isTcp bool) (netip.AddrPort, error) {
+// routerMapping is a port mapping created on the router.
+type routerMapping struct {
+	externalPort uint16
+	// externalIP is the external address the router reports, if known.
+	externalIP netip.Addr
+	delete     func(context.Context) error
+}
+
+// getPubulicPort maps laddr on the router, see mapOnRouter, and returns the
+// public address STUN sees. ctx also bounds the mapping renewal. The router
+// mapping is removed when m is closed.
+func (m *Map) getPubulicPort(ctx context.Context, stunPool *stun.Pool, laddr netip.AddrPort, isTcp bool, c *mapConfig, log func(error)) (netip.AddrPort, error) {
 	var (
 		upnpP = "TCP"
 		dialP = "tcp"
@@ -28,73 +60,182 @@ func getPubulicPort(ctx context.Context, stunAddr string, laddr netip.AddrPort,
 		upnpP = "UDP"
 		dialP = "udp"
 	}
-	err := upnp.AddPortMapping(ctx, "", laddr.Port(), upnpP, laddr.Port(), laddr.Addr().String(), true, "github.com/xmdhs/natupnp", 0)
+	rm, err := m.mapOnRouter(ctx, laddr, upnpP, c, log)
+	if rm != nil {
+		m.mu.Lock()
+		m.routerPort = rm.externalPort
+		m.routerIP = rm.externalIP
+		m.cleanup = append(m.cleanup, rm.delete)
+		m.mu.Unlock()
+	}
+	if errors.Is(err, errNoRouterMapping) {
+		// The router may still forward the port (DMZ or a manual rule),
+		// so go on and let STUN tell.
+		log(fmt.Errorf("getPubulicPort: %w", err))
+		err = nil
+	}
 	if err != nil {
 		return netip.AddrPort{}, fmt.Errorf("getPubulicPort: %w", err)
 	}
-	stunConn, err := reuse.DialContext(ctx, dialP, laddr.String(), stunAddr)
+	mapAddr, err := mappedAddress(ctx, stunPool, laddr, dialP)
 	if err != nil {
 		return netip.AddrPort{}, fmt.Errorf("getPubulicPort: %w", err)
 	}
-	defer stunConn.Close()
-	mapAddr, err := stun.GetMappedAddress(ctx, stunConn)
+	return mapAddr, nil
+}
+
+// mappedAddress asks stunPool for the mapped address of laddr.
+func mappedAddress(ctx context.Context, stunPool *stun.Pool, laddr netip.AddrPort, network string) (netip.AddrPort, error) {
+	mapping, err := stunPool.MappedAddress(ctx, network, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialFrom(ctx, network, laddr, addr)
+	})
 	if err != nil {
-		return netip.AddrPort{}, fmt.Errorf("getPubulicPort: %w", err)
+		return netip.AddrPort{}, fmt.Errorf("mappedAddress: %w", err)
 	}
-	addr, _ := netip.AddrFromSlice(mapAddr.IP)
-	return netip.AddrPortFrom(addr, uint16(mapAddr.Port)), nil
+	return mapping.Addr, nil
 }
 
-func NatMap(ctx context.Context, stunAddr string, laddr netip.AddrPort, log func(error)) (*Map, netip.AddrPort, error) {
-	m := Map{}
-	ctx, cancel := context.WithCancel(ctx)
-	m.cancel = cancel
+// dialFrom dials addr from laddr. Tcp conns are reset on close instead of
+// lingering in TIME_WAIT, which would keep the same server from being dialed
+// from laddr again for a minute.
+func dialFrom(ctx context.Context, network string, laddr netip.AddrPort, addr string) (net.Conn, error) {
+	conn, err := reuse.DialContext(ctx, network, laddr.String(), addr)
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	return conn, nil
+}
 
-	mapAddr, err := getPubulicPort(ctx, stunAddr, laddr, true)
+// NatMap maps the tcp port laddr and keeps it alive. Keepalive errors are
+// passed to log, and if they repeat trigger a STUN re-check, see Map.Events
+// and WithKeepaliveFailures, as do reconnects reported by a UPnP gateway.
+func NatMap(ctx context.Context, stunPool *stun.Pool, laddr netip.AddrPort, log func(error), opts ...MapOption) (*Map, netip.AddrPort, error) {
+	m, mapAddr, err := natMap(ctx, stunPool, laddr, true, HTTPKeepalive{}, log, opts)
 	if err != nil {
 		return nil, netip.AddrPort{}, fmt.Errorf("NatMap: %w", err)
 	}
-	go keepalive(ctx, laddr, log)
-	return &m, mapAddr, nil
+	return m, mapAddr, nil
 }
 
-func (m Map) Close() error {
-	m.cancel()
-	return nil
-}
+func natMap(ctx context.Context, stunPool *stun.Pool, laddr netip.AddrPort, isTcp bool,
+	keepalive Keepaliver, log func(error), opts []MapOption) (*Map, netip.AddrPort, error) {
+	c, err := newMapConfig(opts)
+	if err != nil {
+		return nil, netip.AddrPort{}, fmt.Errorf("natMap: %w", err)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	m := &Map{
+		cancel:  cancel,
+		events:  make(chan Event, 4),
+		recheck: make(chan error, 1),
+		status:  make(chan Event, 4),
+	}
 
-func keepalive(ctx context.Context, laddr netip.AddrPort, log func(error)) {
-	tr := http.DefaultTransport.(*http.Transport).Clone()
-	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-		return reuse.DialContext(ctx, "tcp", laddr.String(), addr)
+	mapAddr, err := m.getPubulicPort(ctx, stunPool, laddr, isTcp, c, log)
+	if err != nil {
+		// Also removes the router mapping if only the STUN step failed.
+		m.Close()
+		return nil, netip.AddrPort{}, fmt.Errorf("natMap: %w", err)
 	}
-	tr.Proxy = nil
-	c := http.Client{Transport: tr, Timeout: 5 * time.Second}
+	m.addr = mapAddr
+	m.diagnosis = diagnose(m.routerIP, mapAddr)
 
-	for {
-		func() {
-			ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-			defer cancel()
-			reqs, err := http.NewRequestWithContext(ctx, "HEAD", "http://www.gstatic.com/generate_204", nil)
-			if err != nil {
-				panic(err)
-			}
-			defer time.Sleep(10 * time.Second)
+	network := "tcp"
+	if !isTcp {
+		network = "udp"
+	}
+	if c.ipv6.IsValid() {
+		m.openIPv6(ctx, c.ipv6, laddr, strings.ToUpper(network), c, log)
+	}
+	if c.keepalive != nil {
+		keepalive = c.keepalive
+	}
+	if s, ok := keepalive.(intervalSetter); ok && c.lifetime > 0 {
+		keepalive = s.withInterval(c.lifetime / 3)
+	}
+	checkInterval := c.checkInterval
+	if _, ok := keepalive.(connHolder); ok {
+		checkInterval = 0
+	}
+	m.goFunc(func() { m.monitor(ctx, stunPool, laddr, network, checkInterval) })
+	m.goFunc(func() { keepalive.Keepalive(ctx, network, laddr, m.keepaliveLog(c.keepaliveFailures, log)) })
+	return m, mapAddr, nil
+}
 
-			rep, err := c.Do(reqs)
-			if err != nil {
-				c.CloseIdleConnections()
-				log(err)
-				return
-			}
-			defer rep.Body.Close()
-		}()
-		select {
-		case <-ctx.Done():
-			return
-		default:
+// Events returns the mapping events. The channel is closed after EventLost or
+// when the Map is closed. It need not be read: it holds the last few events,
+// older ones are dropped, and EventLost is always kept.
+func (m *Map) Events() <-chan Event {
+	return m.events
+}
+
+// Addr returns the current mapped address.
+func (m *Map) Addr() netip.AddrPort {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.addr
+}
+
+// Addr6 returns the IPv6 endpoint opened with WithIPv6, or the zero value if
+// there is none. Its port is the local port, IPv6 needs no NAT.
+func (m *Map) Addr6() netip.AddrPort {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.addr6
+}
+
+// RouterPort returns the external port of the port mapping on the router, or
+// 0 if there is none. It differs from the local port when another host
+// already had that port mapped.
+func (m *Map) RouterPort() uint16 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.routerPort
+}
+
+// Diagnosis compares the external address of the router with the mapped
+// address found when the Map was created. It tells e.g. whether a carrier-grade
+// NAT or a second router is in front of the mapping.
+func (m *Map) Diagnosis() Diagnosis {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.diagnosis
+}
+
+// goFunc runs f in a goroutine that Close waits for.
+func (m *Map) goFunc(f func()) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		f()
+	}()
+}
+
+// Close stops keeping the mapping alive, waits for the goroutines of m and
+// removes the port mappings it created on the router.
+func (m *Map) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		m.cancel()
+		m.wg.Wait()
+
+		ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		defer cancel()
+		m.mu.Lock()
+		cleanup := m.cleanup
+		m.cleanup = nil
+		m.mu.Unlock()
+		for _, f := range cleanup {
+			err = errors.Join(err, f(ctx))
 		}
-	}
+		if err != nil {
+			err = fmt.Errorf("Close: %w", err)
+		}
+	})
+	return err
 }
 
 func GetLocalAddr() (net.Addr, error) {
@@ -106,6 +247,17 @@ func GetLocalAddr() (net.Addr, error) {
 	return l.LocalAddr(), nil
 }
 
+// GetLocalAddr6 is GetLocalAddr for the IPv6 address used to reach the
+// internet.
+func GetLocalAddr6() (net.Addr, error) {
+	l, err := net.Dial("udp6", "[2400:3200::1]:53")
+	if err != nil {
+		return nil, fmt.Errorf("GetLocalAddr6: %w", err)
+	}
+	defer l.Close()
+	return l.LocalAddr(), nil
+}
+
 func Forward(ctx context.Context, laddr netip.AddrPort, target string, log func(string)) (io.Closer, error) {
 	l, err := reuse.Listen(ctx, "tcp", laddr.String())
 	if err != nil {
@@ -0,0 +1,276 @@
+package natmap_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xmdhs/natupnp/natmap"
+	"github.com/xmdhs/natupnp/stun"
+	"github.com/xmdhs/natupnp/upnp"
+	"github.com/xmdhs/natupnp/upnp/fakeigd"
+)
+
+var loopback = netip.MustParseAddr("127.0.0.1")
+
+// startSTUN returns a pool of a STUN server on loopback, which sees the local
+// address as the mapped one.
+func startSTUN(t *testing.T) *stun.Pool {
+	t.Helper()
+	s := stun.NewServer(netip.AddrPortFrom(loopback, 0), netip.AddrPort{})
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	p, err := stun.NewPool(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// startIGD serves d on loopback and returns the options mapping on it only.
+func startIGD(t *testing.T, d *fakeigd.Device) []natmap.MapOption {
+	t.Helper()
+	if err := d.Start(context.Background(), loopback); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return []natmap.MapOption{
+		natmap.WithMode(natmap.ModeUPnP),
+		natmap.WithGateway(upnp.WithLocation(d.Location())),
+		natmap.WithCascade(false),
+		natmap.WithEvents(false),
+		natmap.WithKeepalive(noKeepalive),
+	}
+}
+
+// noKeepalive keeps the tests off the internet.
+var noKeepalive = natmap.KeepaliveFunc(func(ctx context.Context, network string, laddr netip.AddrPort, log func(error)) {
+	<-ctx.Done()
+})
+
+// freePort returns a loopback address with a port free for network.
+func freePort(t *testing.T, network string) netip.AddrPort {
+	t.Helper()
+	if network == "tcp" {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		return l.Addr().(*net.TCPAddr).AddrPort()
+	}
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func logTo(t *testing.T) func(error) {
+	return func(err error) {
+		if err != nil {
+			t.Log(err)
+		}
+	}
+}
+
+// find returns the mapping of d for port, or false.
+func find(d *fakeigd.Device, protocol string, port uint16) (fakeigd.Mapping, bool) {
+	for _, m := range d.Mappings() {
+		if m.Protocol == protocol && m.ExternalPort == port {
+			return m, true
+		}
+	}
+	return fakeigd.Mapping{}, false
+}
+
+func TestNatMapUPnP(t *testing.T) {
+	for _, network := range []string{"tcp", "udp"} {
+		t.Run(network, func(t *testing.T) {
+			ctx := context.Background()
+			pool := startSTUN(t)
+			d := &fakeigd.Device{}
+			opts := startIGD(t, d)
+			laddr := freePort(t, network)
+
+			natMap := natmap.NatMap
+			protocol := "TCP"
+			if network == "udp" {
+				natMap = natmap.NatMapUdp
+				protocol = "UDP"
+			}
+			m, addr, err := natMap(ctx, pool, laddr, logTo(t), opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr != laddr || m.Addr() != laddr {
+				t.Errorf("mapped address = %v, want %v", addr, laddr)
+			}
+			if m.RouterPort() != laddr.Port() {
+				t.Errorf("router port = %d, want %d", m.RouterPort(), laddr.Port())
+			}
+			want := fakeigd.Mapping{
+				ExternalPort:   laddr.Port(),
+				Protocol:       protocol,
+				InternalPort:   laddr.Port(),
+				InternalClient: "127.0.0.1",
+				Enabled:        true,
+				Description:    natmap.Description,
+				LeaseDuration:  uint32(natmap.DefaultLease / time.Second),
+			}
+			if got, _ := find(d, protocol, laddr.Port()); got != want {
+				t.Errorf("router mapping = %+v, want %+v", got, want)
+			}
+
+			if err := m.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if l := d.Mappings(); len(l) != 0 {
+				t.Errorf("router mappings = %+v after Close, want none", l)
+			}
+		})
+	}
+}
+
+func TestNatMapPortTaken(t *testing.T) {
+	ctx := context.Background()
+	pool := startSTUN(t)
+	d := &fakeigd.Device{}
+	opts := startIGD(t, d)
+	laddr := freePort(t, "tcp")
+	other := fakeigd.Mapping{ExternalPort: laddr.Port(), Protocol: "TCP", InternalPort: 80, InternalClient: "192.168.1.9", Enabled: true}
+	d.SetMapping(other)
+
+	m, _, err := natmap.NatMap(ctx, pool, laddr, logTo(t), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := m.RouterPort()
+	if port == 0 || port == laddr.Port() {
+		t.Fatalf("router port = %d, want another free port", port)
+	}
+	if got, ok := find(d, "TCP", port); !ok || got.InternalPort != laddr.Port() || got.InternalClient != "127.0.0.1" {
+		t.Errorf("router mapping = %+v, %v, want one to %v", got, ok, laddr)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if l := d.Mappings(); len(l) != 1 || l[0] != other {
+		t.Errorf("router mappings = %+v after Close, want the other host's only", l)
+	}
+}
+
+func TestNatMapRenew(t *testing.T) {
+	ctx := context.Background()
+	pool := startSTUN(t)
+	d := &fakeigd.Device{}
+	opts := append(startIGD(t, d), natmap.WithLease(2*time.Second))
+	laddr := freePort(t, "udp")
+
+	m, _, err := natmap.NatMapUdp(ctx, pool, laddr, logTo(t), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	adds := func() int {
+		n := 0
+		for _, v := range d.Calls() {
+			if v == "AddPortMapping" {
+				n++
+			}
+		}
+		return n
+	}
+	first := adds()
+	deadline := time.Now().Add(3 * time.Second)
+	for adds() == first {
+		if time.Now().After(deadline) {
+			t.Fatalf("mapping not renewed: %v", d.Calls())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got, ok := find(d, "UDP", laddr.Port()); !ok || got.LeaseDuration != 2 {
+		t.Errorf("router mapping = %+v, %v after renewal, want a 2s lease", got, ok)
+	}
+}
+
+func TestNatMapCascade(t *testing.T) {
+	ctx := context.Background()
+	router := &fakeigd.Device{UDN: "uuid:fa4e16d0-0000-4000-8000-0000000000a1", ExternalIP: "192.168.1.2"}
+	modem := &fakeigd.Device{UDN: "uuid:fa4e16d0-0000-4000-8000-0000000000a2"}
+	opts := startIGD(t, router)
+	if err := modem.Start(ctx, loopback); err != nil {
+		t.Fatal(err)
+	}
+	defer modem.Close()
+	upstream, err := modem.ListenSSDPUnicast(netip.AddrPortFrom(loopback, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	laddr := freePort(t, "udp")
+
+	m, _, err := natmap.NatMapUdp(ctx, startSTUN(t), laddr, logTo(t), append(opts, natmap.WithCascade(true), natmap.WithUpstream(upstream))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := find(router, "UDP", laddr.Port()); !ok || got.InternalClient != "127.0.0.1" || got.InternalPort != laddr.Port() {
+		t.Errorf("router mapping = %+v, %v, want one to %v", got, ok, laddr)
+	}
+	if got, ok := find(modem, "UDP", laddr.Port()); !ok || got.InternalClient != router.ExternalIP || got.InternalPort != laddr.Port() {
+		t.Errorf("modem mapping = %+v, %v, want one to %v:%d", got, ok, router.ExternalIP, laddr.Port())
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if l, l2 := router.Mappings(), modem.Mappings(); len(l) != 0 || len(l2) != 0 {
+		t.Errorf("mappings = %+v and %+v after Close, want none", l, l2)
+	}
+}
+
+func TestNatMapEvents(t *testing.T) {
+	d := &fakeigd.Device{}
+	opts := append(startIGD(t, d), natmap.WithEvents(true))
+	m, addr, err := natmap.NatMap(context.Background(), startSTUN(t), freePort(t, "tcp"), logTo(t), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	// The subscription is made in the background and its first event only
+	// reports the current address, so change it until one gets through.
+	for i := 2; ; i++ {
+		if i > 30 {
+			t.Fatal("no re-check after the gateway reported a new address")
+		}
+		d.SetExternalIP(fmt.Sprintf("203.0.113.%d", i))
+		select {
+		case e := <-m.Events():
+			if e.Type != natmap.EventUnchanged || e.Addr != addr || !strings.Contains(fmt.Sprint(e.Err), "external address changed") {
+				t.Fatalf("event = %v %v %v, want a re-check of %v", e.Type, e.Addr, e.Err, addr)
+			}
+			if !called(d, "SUBSCRIBE") {
+				t.Errorf("SUBSCRIBE not called: %v", d.Calls())
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func called(d *fakeigd.Device, action string) bool {
+	for _, v := range d.Calls() {
+		if v == action {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package natmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/xmdhs/natupnp/natpmp"
+)
+
+const (
+	natpmpLifetime     = 2 * time.Hour
+	natpmpProbeTimeout = 3 * time.Second
+)
+
+// natpmpMapper maps IPv4 ports over NAT-PMP on the default gateway.
+type natpmpMapper struct {
+	mu sync.Mutex
+	c  *natpmp.Client
+}
+
+// AddPortMapping maps laddr. NAT-PMP mappings are never permanent, a lease of
+// 0 asks for natpmpLifetime.
+func (n *natpmpMapper) AddPortMapping(ctx context.Context, protocol string, laddr netip.AddrPort, lease time.Duration) (PortMapping, error) {
+	if !laddr.Addr().Is4() {
+		return PortMapping{}, fmt.Errorf("AddPortMapping: %w", errors.Join(ErrNotSupported, errors.New("NAT-PMP is IPv4 only")))
+	}
+	if lease == 0 {
+		lease = natpmpLifetime
+	}
+	c, err := natpmp.NewClient()
+	if err != nil {
+		return PortMapping{}, fmt.Errorf("AddPortMapping: %w", errors.Join(ErrNotSupported, err))
+	}
+	c.Local = laddr.Addr()
+
+	pctx, cancel := context.WithTimeout(ctx, natpmpProbeTimeout)
+	defer cancel()
+	m, err := c.AddPortMapping(pctx, protocol, laddr.Port(), laddr.Port(), lease)
+	if err != nil {
+		var re *natpmp.ResultError
+		if errors.Is(err, natpmp.ErrTimeout) || errors.Is(err, context.DeadlineExceeded) || errors.As(err, &re) && (re.Code == 1 || re.Code == 5) {
+			err = errors.Join(ErrNotSupported, err)
+		}
+		return PortMapping{}, fmt.Errorf("AddPortMapping: %w", err)
+	}
+	n.mu.Lock()
+	n.c = c
+	n.mu.Unlock()
+	return natpmpPortMapping(m, laddr), nil
+}
+
+// RenewPortMapping asks for the same mapping again.
+func (n *natpmpMapper) RenewPortMapping(ctx context.Context, m PortMapping, lease time.Duration) (PortMapping, error) {
+	if lease == 0 {
+		lease = natpmpLifetime
+	}
+	n.mu.Lock()
+	c := n.c
+	n.mu.Unlock()
+	next, err := c.AddPortMapping(ctx, m.Protocol, m.Internal.Port(), m.ExternalPort, lease)
+	if err != nil {
+		return m, fmt.Errorf("RenewPortMapping: %w", err)
+	}
+	return natpmpPortMapping(next, m.Internal), nil
+}
+
+func (n *natpmpMapper) DeletePortMapping(ctx context.Context, m PortMapping) error {
+	n.mu.Lock()
+	c := n.c
+	n.mu.Unlock()
+	if err := c.DeletePortMapping(ctx, m.Protocol, m.Internal.Port()); err != nil {
+		return fmt.Errorf("DeletePortMapping: %w", err)
+	}
+	return nil
+}
+
+func (n *natpmpMapper) ExternalIP(ctx context.Context) (netip.Addr, error) {
+	n.mu.Lock()
+	c := n.c
+	n.mu.Unlock()
+	pctx, cancel := context.WithTimeout(ctx, natpmpProbeTimeout)
+	defer cancel()
+	ip, err := c.ExternalAddress(pctx)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("ExternalIP: %w", err)
+	}
+	return ip, nil
+}
+
+func natpmpPortMapping(m natpmp.Mapping, laddr netip.AddrPort) PortMapping {
+	return PortMapping{
+		Protocol:     m.Protocol,
+		Internal:     laddr,
+		ExternalPort: m.ExternalPort,
+		Lease:        m.Lifetime,
+		State:        m,
+	}
+}
@@ -0,0 +1,242 @@
+package natmap
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"time"
+
+	"github.com/xmdhs/natupnp/upnp"
+)
+
+// mapConfig is the configuration of NatMap and NatMapUdp.
+type mapConfig struct {
+	checkInterval     time.Duration
+	lease             time.Duration
+	portRange         upnp.PortRange
+	gateway           []upnp.Option
+	cascade           bool
+	upstream          netip.AddrPort
+	events            bool
+	ipv6              netip.Addr
+	mappers           []mapperEntry
+	verifyInterval    time.Duration
+	keepalive         Keepaliver
+	keepaliveFailures int
+	lifetime          time.Duration
+}
+
+// mapperEntry is a mode of WithMode, or a PortMapper of WithPortMapper.
+type mapperEntry struct {
+	mode string
+	pm   PortMapper
+}
+
+// MapOption customizes NatMap and NatMapUdp.
+type MapOption func(*mapConfig) error
+
+// DefaultCheckInterval is how often the mapped address is re-checked over
+// STUN by default.
+const DefaultCheckInterval = time.Minute
+
+// DefaultLease is the lease duration of UPnP port mappings by default.
+const DefaultLease = time.Hour
+
+// DefaultVerifyInterval is how often router port mappings are read back by
+// default, see PortVerifier.
+const DefaultVerifyInterval = 5 * time.Minute
+
+// DefaultKeepaliveFailures is how many keepalive probes in a row must fail
+// before the mapping is re-checked by default.
+const DefaultKeepaliveFailures = 3
+
+func newMapConfig(opts []MapOption) (*mapConfig, error) {
+	c := &mapConfig{
+		checkInterval:     DefaultCheckInterval,
+		lease:             DefaultLease,
+		cascade:           true,
+		events:            true,
+		verifyInterval:    DefaultVerifyInterval,
+		keepaliveFailures: DefaultKeepaliveFailures,
+	}
+	for _, o := range opts {
+		if err := o(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// WithCheckInterval sets how often the mapped address is re-checked over
+// STUN from the mapped local port. Zero disables periodic checks; keepalive
+// failures still trigger one.
+func WithCheckInterval(d time.Duration) MapOption {
+	return func(c *mapConfig) error {
+		c.checkInterval = d
+		return nil
+	}
+}
+
+// WithLease sets the lease duration of UPnP port mappings. The mapping is
+// renewed at half the lease for as long as the Map is open. Zero asks for a
+// permanent mapping, which some IGDv2 gateways reject.
+func WithLease(d time.Duration) MapOption {
+	return func(c *mapConfig) error {
+		if d < 0 || d > time.Duration(math.MaxUint32)*time.Second {
+			return errors.New("WithLease: lease out of range")
+		}
+		if d != 0 && d < time.Second {
+			return errors.New("WithLease: lease shorter than a second")
+		}
+		c.lease = d
+		return nil
+	}
+}
+
+// WithPortRange sets the external ports tried for the UPnP mapping when the
+// local port is already mapped to another host. Without it an IGDv2 gateway
+// picks the port.
+func WithPortRange(min, max uint16) MapOption {
+	return func(c *mapConfig) error {
+		if min == 0 || min > max {
+			return errors.New("WithPortRange: invalid port range")
+		}
+		c.portRange = upnp.PortRange{Min: min, Max: max}
+		return nil
+	}
+}
+
+// WithGateway pins the UPnP gateway, see upnp.WithLocation, upnp.WithUDN and
+// upnp.WithInterface.
+func WithGateway(opts ...upnp.Option) MapOption {
+	return func(c *mapConfig) error {
+		c.gateway = append(c.gateway, opts...)
+		return nil
+	}
+}
+
+// WithCascade sets whether a UPnP gateway with a private external address
+// gets the mapping chained through the gateway above it, see
+// upnp.MapUpstream. It is on by default.
+func WithCascade(on bool) MapOption {
+	return func(c *mapConfig) error {
+		c.cascade = on
+		return nil
+	}
+}
+
+// WithUpstream sets where the upstream gateway of a cascaded setup is searched
+// for, instead of x.x.x.1 of the external address of the first gateway.
+func WithUpstream(host netip.AddrPort) MapOption {
+	return func(c *mapConfig) error {
+		c.upstream = host
+		return nil
+	}
+}
+
+// WithEvents sets whether the UPnP gateways are subscribed to, so that a
+// reconnect they report, e.g. of PPPoE, re-checks the mapping at once instead
+// of when the keepalive fails. It is on by default.
+func WithEvents(on bool) MapOption {
+	return func(c *mapConfig) error {
+		c.events = on
+		return nil
+	}
+}
+
+// WithIPv6 also opens the port on the global IPv6 address addr, with a pinhole
+// on the UPnP IPv6 firewall or over PCP, see Map.Addr6. The IPv4 mapping
+// does not fail if this does.
+func WithIPv6(addr netip.Addr) MapOption {
+	return func(c *mapConfig) error {
+		if !addr.Is6() || addr.Is4In6() || !addr.IsGlobalUnicast() || addr.IsPrivate() {
+			return errors.New("WithIPv6: not a global ipv6 address")
+		}
+		c.ipv6 = addr
+		return nil
+	}
+}
+
+// WithMode sets the router APIs tried, in order: ModeUPnP, ModePCP,
+// ModeNATPMP, ModeNone for routers with DMZ or a manual port forwarding rule,
+// or ModeAuto, which is the default and tries UPnP, PCP and NAT-PMP.
+func WithMode(modes ...string) MapOption {
+	return func(c *mapConfig) error {
+		var l []mapperEntry
+		for _, e := range c.mappers {
+			if e.mode == "" {
+				l = append(l, e)
+			}
+		}
+		c.mappers = l
+		for _, m := range modes {
+			switch m {
+			case ModeAuto, ModeUPnP, ModePCP, ModeNATPMP, ModeNone:
+			default:
+				return fmt.Errorf("WithMode: unknown mode %q", m)
+			}
+			c.mappers = append(c.mappers, mapperEntry{mode: m})
+		}
+		return nil
+	}
+}
+
+// WithPortMapper adds pm to the router APIs tried, e.g. the HTTP API of a
+// router. Without WithMode only the PortMappers added are tried; put
+// WithMode first to try pm before or after the built-in ones.
+func WithPortMapper(pm PortMapper) MapOption {
+	return func(c *mapConfig) error {
+		c.mappers = append(c.mappers, mapperEntry{pm: pm})
+		return nil
+	}
+}
+
+// WithVerifyInterval sets how often the router port mapping is read back and
+// restored if it is gone or was changed, e.g. by a router reboot or another
+// device. Zero disables it. UPnP mappings are read back; for PCP the epoch of
+// the server is checked, which tells whether it lost its mappings.
+func WithVerifyInterval(d time.Duration) MapOption {
+	return func(c *mapConfig) error {
+		c.verifyInterval = d
+		return nil
+	}
+}
+
+// WithKeepalive sets how traffic is kept flowing through the mapping, see
+// HTTPKeepalive, TCPKeepalive, DNSKeepalive and STUNKeepalive. It defaults to
+// HTTPKeepalive for NatMap and DNSKeepalive for NatMapUdp.
+func WithKeepalive(k Keepaliver) MapOption {
+	return func(c *mapConfig) error {
+		c.keepalive = k
+		return nil
+	}
+}
+
+// WithKeepaliveFailures sets how many keepalive probes in a row must fail
+// before the mapping is re-checked over STUN, and again after as many more.
+// Fewer failures only emit EventDegraded, and EventRecovered once a probe
+// succeeds again, so transient packet loss does not end the mapping. Failed
+// probes are retried after 1s, doubling up to the keepalive interval.
+func WithKeepaliveFailures(n int) MapOption {
+	return func(c *mapConfig) error {
+		if n < 1 {
+			return errors.New("WithKeepaliveFailures: n must be at least 1")
+		}
+		c.keepaliveFailures = n
+		return nil
+	}
+}
+
+// WithBindingLifetime sets how long the NAT keeps an idle binding, e.g.
+// Lifetime.Alive as measured by LifetimeProbe. The interval of the built-in
+// Keepalivers is then adapted to a third of it.
+func WithBindingLifetime(d time.Duration) MapOption {
+	return func(c *mapConfig) error {
+		if d < 3*time.Second {
+			return errors.New("WithBindingLifetime: lifetime shorter than 3s")
+		}
+		c.lifetime = d
+		return nil
+	}
+}
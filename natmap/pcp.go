@@ -0,0 +1,119 @@
+package natmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/xmdhs/natupnp/pcp"
+)
+
+const (
+	pcpLifetime     = 2 * time.Hour
+	pcpProbeTimeout = 3 * time.Second
+)
+
+// pcpMapper maps ports, IPv4 or IPv6, over PCP on the default gateway.
+type pcpMapper struct {
+	mu       sync.Mutex
+	c        *pcp.Client
+	external netip.Addr
+}
+
+// AddPortMapping maps laddr. PCP mappings are never permanent, a lease of 0
+// asks for pcpLifetime.
+func (p *pcpMapper) AddPortMapping(ctx context.Context, protocol string, laddr netip.AddrPort, lease time.Duration) (PortMapping, error) {
+	if lease == 0 {
+		lease = pcpLifetime
+	}
+	c, err := pcp.NewClient(laddr.Addr())
+	if err != nil {
+		return PortMapping{}, fmt.Errorf("AddPortMapping: %w", errors.Join(ErrNotSupported, err))
+	}
+	pctx, cancel := context.WithTimeout(ctx, pcpProbeTimeout)
+	defer cancel()
+	m, err := c.AddPortMapping(pctx, protocol, laddr.Port(), netip.AddrPort{}, lease)
+	if err != nil {
+		var re *pcp.ResultError
+		if errors.Is(err, pcp.ErrTimeout) || errors.Is(err, pcp.ErrUnsupportedVersion) || errors.As(err, &re) && (re.Code == 1 || re.Code == 4) {
+			// No answer, or a NAT-PMP gateway rejecting the version.
+			err = errors.Join(ErrNotSupported, err)
+		}
+		return PortMapping{}, fmt.Errorf("AddPortMapping: %w", err)
+	}
+	p.mu.Lock()
+	p.c = c
+	p.external = m.ExternalAddr.Addr()
+	p.mu.Unlock()
+	return pcpPortMapping(m, laddr), nil
+}
+
+// RenewPortMapping extends m. Renewals keep the nonce, so the mapping stays
+// the same. A server that lost its state, see VerifyPortMapping, creates the
+// mapping again on renewal.
+func (p *pcpMapper) RenewPortMapping(ctx context.Context, m PortMapping, lease time.Duration) (PortMapping, error) {
+	if lease == 0 {
+		lease = pcpLifetime
+	}
+	p.mu.Lock()
+	c := p.c
+	p.mu.Unlock()
+	next, err := c.RenewPortMapping(ctx, m.State.(pcp.Mapping), lease)
+	if err != nil && !errors.Is(err, pcp.ErrEpochReset) {
+		return m, fmt.Errorf("RenewPortMapping: %w", err)
+	}
+	p.mu.Lock()
+	p.external = next.ExternalAddr.Addr()
+	p.mu.Unlock()
+	return pcpPortMapping(next, m.Internal), nil
+}
+
+// VerifyPortMapping asks the server for its epoch, see pcp.Client.Announce.
+// PCP cannot read a mapping back, but an epoch that jumped means the server
+// lost its mappings, e.g. in a reboot, and m must be created again.
+func (p *pcpMapper) VerifyPortMapping(ctx context.Context, m PortMapping) error {
+	p.mu.Lock()
+	c := p.c
+	p.mu.Unlock()
+	err := c.Announce(ctx)
+	var re *pcp.ResultError
+	if errors.As(err, &re) && re.Code == 4 {
+		// UNSUPP_OPCODE, the epoch is then only checked on renewal.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("VerifyPortMapping: %w", err)
+	}
+	return nil
+}
+
+func (p *pcpMapper) DeletePortMapping(ctx context.Context, m PortMapping) error {
+	p.mu.Lock()
+	c := p.c
+	p.mu.Unlock()
+	if err := c.DeletePortMapping(ctx, m.State.(pcp.Mapping)); err != nil {
+		return fmt.Errorf("DeletePortMapping: %w", err)
+	}
+	return nil
+}
+
+// ExternalIP returns the external address of the last mapping, PCP has no
+// request for it.
+func (p *pcpMapper) ExternalIP(ctx context.Context) (netip.Addr, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.external, nil
+}
+
+func pcpPortMapping(m pcp.Mapping, laddr netip.AddrPort) PortMapping {
+	return PortMapping{
+		Protocol:     m.Protocol,
+		Internal:     laddr,
+		ExternalPort: m.ExternalAddr.Port(),
+		Lease:        m.Lifetime,
+		State:        m,
+	}
+}
@@ -0,0 +1,88 @@
+package natmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/xmdhs/natupnp/upnp"
+)
+
+// mapPinhole opens a pinhole to the IPv6 address laddr on the UPnP IPv6
+// firewalls. There is no NAT on IPv6, so the external address is laddr
+// itself.
+func (u *upnpMapper) mapPinhole(ctx context.Context, protocol string, laddr netip.AddrPort, lease time.Duration) (PortMapping, error) {
+	if lease == 0 || lease > upnp.MaxPinholeLease*time.Second {
+		lease = upnp.MaxPinholeLease * time.Second
+	}
+	pinholes, err := upnp.AddPinhole(ctx, protocol, laddr.Addr(), laddr.Port(), uint32(lease/time.Second), u.c.gateway...)
+	if err != nil {
+		if len(pinholes) == 0 {
+			if errors.Is(err, upnp.ErrNoFirewall) {
+				err = errors.Join(ErrNotSupported, err)
+			}
+			return PortMapping{}, fmt.Errorf("mapPinhole: %w", err)
+		}
+		u.log(fmt.Errorf("mapPinhole: %w", err))
+	}
+	u.mu.Lock()
+	u.external = laddr.Addr()
+	u.mu.Unlock()
+	return PortMapping{
+		Protocol:     protocol,
+		Internal:     laddr,
+		ExternalPort: laddr.Port(),
+		Lease:        lease,
+		State:        upnpState{pinholes: pinholes},
+	}, nil
+}
+
+func renewPinholes(ctx context.Context, m PortMapping, pinholes []upnp.Pinhole) (PortMapping, error) {
+	var err error
+	for _, p := range pinholes {
+		err = errors.Join(err, p.Update(ctx, uint32(m.Lease/time.Second)))
+	}
+	if err != nil {
+		return m, fmt.Errorf("renewPinholes: %w", err)
+	}
+	return m, nil
+}
+
+func deletePinholes(ctx context.Context, pinholes []upnp.Pinhole) error {
+	var err error
+	for _, p := range pinholes {
+		err = errors.Join(err, p.Delete(ctx))
+	}
+	if err != nil {
+		return fmt.Errorf("deletePinholes: %w", err)
+	}
+	return nil
+}
+
+// openIPv6 opens addr at the port of laddr on the router, see mapOnRouter,
+// and records it as the IPv6 endpoint of m. Failures are only logged, the
+// IPv4 mapping does not depend on it.
+func (m *Map) openIPv6(ctx context.Context, addr netip.Addr, laddr netip.AddrPort, protocol string, c *mapConfig, log func(error)) {
+	laddr6 := netip.AddrPortFrom(addr, laddr.Port())
+	rm, err := m.mapOnRouter(ctx, laddr6, protocol, c, log)
+	if err != nil {
+		log(fmt.Errorf("openIPv6: %w", err))
+		if !errors.Is(err, errNoRouterMapping) {
+			return
+		}
+		// Without a firewall to open the address may still be reachable.
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addr6 = laddr6
+	if rm != nil {
+		// ModeNone, and PortMappers whose router does not tell, report no
+		// external address.
+		if rm.externalIP.IsValid() {
+			m.addr6 = netip.AddrPortFrom(rm.externalIP, rm.externalPort)
+		}
+		m.cleanup = append(m.cleanup, rm.delete)
+	}
+}
@@ -0,0 +1,112 @@
+package natmap_test
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xmdhs/natupnp/natmap"
+	"github.com/xmdhs/natupnp/upnp/fakeigd"
+)
+
+// silentMapper maps every address but, like many router APIs, does not tell
+// the external address.
+type silentMapper struct {
+	mu      sync.Mutex
+	deleted []netip.AddrPort
+}
+
+func (s *silentMapper) AddPortMapping(ctx context.Context, protocol string, laddr netip.AddrPort, lease time.Duration) (natmap.PortMapping, error) {
+	return natmap.PortMapping{Protocol: protocol, Internal: laddr, ExternalPort: laddr.Port()}, nil
+}
+
+func (s *silentMapper) RenewPortMapping(ctx context.Context, m natmap.PortMapping, lease time.Duration) (natmap.PortMapping, error) {
+	return m, nil
+}
+
+func (s *silentMapper) DeletePortMapping(ctx context.Context, m natmap.PortMapping) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleted = append(s.deleted, m.Internal)
+	return nil
+}
+
+func (s *silentMapper) ExternalIP(ctx context.Context) (netip.Addr, error) {
+	return netip.Addr{}, nil
+}
+
+func TestIPv6NoExternalIP(t *testing.T) {
+	ip6 := netip.MustParseAddr("2001:db8::1")
+	tests := []struct {
+		name string
+		opt  natmap.MapOption
+	}{
+		{"none", natmap.WithMode(natmap.ModeNone)},
+		{"PortMapper", natmap.WithPortMapper(&silentMapper{})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			laddr := freePort(t, "tcp")
+			m, _, err := natmap.NatMap(context.Background(), startSTUN(t), laddr, logTo(t),
+				tt.opt, natmap.WithIPv6(ip6), natmap.WithKeepalive(noKeepalive))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+			if want := netip.AddrPortFrom(ip6, laddr.Port()); m.Addr6() != want {
+				t.Errorf("Addr6 = %v, want %v", m.Addr6(), want)
+			}
+		})
+	}
+}
+
+func TestIPv6Cleanup(t *testing.T) {
+	ip6 := netip.MustParseAddr("2001:db8::1")
+	pm := &silentMapper{}
+	laddr := freePort(t, "udp")
+	m, _, err := natmap.NatMapUdp(context.Background(), startSTUN(t), laddr, logTo(t),
+		natmap.WithPortMapper(pm), natmap.WithIPv6(ip6), natmap.WithKeepalive(noKeepalive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := netip.AddrPortFrom(ip6, laddr.Port())
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	got := map[netip.AddrPort]bool{}
+	for _, v := range pm.deleted {
+		got[v] = true
+	}
+	if len(pm.deleted) != 2 || !got[laddr] || !got[want] {
+		t.Errorf("deleted %v on Close, want %v and %v", pm.deleted, laddr, want)
+	}
+}
+
+func TestIPv6UPnPPinhole(t *testing.T) {
+	ip6 := netip.MustParseAddr("2001:db8::1")
+	d := &fakeigd.Device{}
+	laddr := freePort(t, "tcp")
+	m, _, err := natmap.NatMap(context.Background(), startSTUN(t), laddr, logTo(t),
+		append(startIGD(t, d), natmap.WithIPv6(ip6))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := netip.AddrPortFrom(ip6, laddr.Port()); m.Addr6() != want {
+		t.Errorf("Addr6 = %v, want %v", m.Addr6(), want)
+	}
+	l := d.Pinholes()
+	if len(l) != 1 || l[0].InternalClient != ip6.String() || l[0].InternalPort != laddr.Port() || l[0].Protocol != 6 {
+		t.Errorf("firewall pinholes = %+v, want one to %v", l, netip.AddrPortFrom(ip6, laddr.Port()))
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if l := d.Pinholes(); len(l) != 0 {
+		t.Errorf("firewall pinholes = %+v after Close, want none", l)
+	}
+}
@@ -0,0 +1,363 @@
+package natmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/xmdhs/natupnp/stun"
+)
+
+// DefaultSTUNServer is the STUN server of a Session by default.
+const DefaultSTUNServer = "turn.cloudflare.com:3478"
+
+// DefaultRetry is how long a Session waits before mapping the port again
+// after the mapping was lost, by default.
+const DefaultRetry = time.Second
+
+// ErrSessionClosed is returned by Session.Err after Session.Close.
+var ErrSessionClosed = errors.New("session closed")
+
+// Session maps a local port and keeps it mapped: the port is mapped again
+// whenever the mapping is lost, and the hooks are called whenever the public
+// address changes. The local port is not listened on, do that with
+// SO_REUSEPORT, see the reuse package.
+type Session struct {
+	laddr netip.AddrPort
+	c     *sessionConfig
+	done  chan struct{}
+	wg    sync.WaitGroup
+
+	mu       sync.Mutex
+	started  bool
+	ended    bool
+	cancel   func()
+	err      error
+	closeErr error
+	addr     netip.AddrPort
+	addr6    netip.AddrPort
+	// hooked is the addr and addr6 the hooks were last called with.
+	hooked [2]netip.AddrPort
+}
+
+// sessionConfig is the configuration of a Session.
+type sessionConfig struct {
+	udp     bool
+	pool    *stun.Pool
+	mapOpts []MapOption
+	log     func(error)
+	hooks   []func(addr, addr6 netip.AddrPort)
+	onMap   []func(m *Map)
+	onEvent []func(e Event)
+	retry   time.Duration
+}
+
+// SessionOption customizes a Session.
+type SessionOption func(*sessionConfig) error
+
+// NewSession returns a Session for laddr. It maps a tcp port over the
+// DefaultSTUNServer unless opts say otherwise.
+func NewSession(laddr netip.AddrPort, opts ...SessionOption) (*Session, error) {
+	c := &sessionConfig{
+		log:   func(error) {},
+		retry: DefaultRetry,
+	}
+	for _, o := range opts {
+		if err := o(c); err != nil {
+			return nil, fmt.Errorf("NewSession: %w", err)
+		}
+	}
+	if c.pool == nil {
+		pool, err := stun.NewPool(DefaultSTUNServer)
+		if err != nil {
+			return nil, fmt.Errorf("NewSession: %w", err)
+		}
+		c.pool = pool
+	}
+	return &Session{laddr: laddr, c: c, done: make(chan struct{})}, nil
+}
+
+// WithProtocol sets whether a "tcp" or a "udp" port is mapped. It defaults to
+// tcp.
+func WithProtocol(network string) SessionOption {
+	return func(c *sessionConfig) error {
+		switch network {
+		case "tcp":
+			c.udp = false
+		case "udp":
+			c.udp = true
+		default:
+			return fmt.Errorf("WithProtocol: unknown protocol %q", network)
+		}
+		return nil
+	}
+}
+
+// WithSTUNServers sets the STUN servers, see stun.NewPool.
+func WithSTUNServers(servers ...string) SessionOption {
+	return func(c *sessionConfig) error {
+		pool, err := stun.NewPool(servers...)
+		if err != nil {
+			return fmt.Errorf("WithSTUNServers: %w", err)
+		}
+		c.pool = pool
+		return nil
+	}
+}
+
+// WithSTUNPool sets the STUN servers to pool, e.g. to set its TLSConfig.
+func WithSTUNPool(pool *stun.Pool) SessionOption {
+	return func(c *sessionConfig) error {
+		c.pool = pool
+		return nil
+	}
+}
+
+// WithMapOptions adds options for every mapping, e.g. WithMode or
+// WithPortMapper to pick the router API and WithKeepalive.
+func WithMapOptions(opts ...MapOption) SessionOption {
+	return func(c *sessionConfig) error {
+		c.mapOpts = append(c.mapOpts, opts...)
+		return nil
+	}
+}
+
+// WithLog sets where errors that do not end the Session are passed, e.g.
+// keepalive failures. They are dropped by default.
+func WithLog(log func(error)) SessionOption {
+	return func(c *sessionConfig) error {
+		c.log = log
+		return nil
+	}
+}
+
+// WithHook adds a hook called with the public address, and the IPv6
+// endpoint if WithIPv6 is used, when the port is first mapped and whenever
+// either changes. Mapping the port again at the same addresses does not call
+// it.
+func WithHook(hook func(addr, addr6 netip.AddrPort)) SessionOption {
+	return func(c *sessionConfig) error {
+		c.hooks = append(c.hooks, hook)
+		return nil
+	}
+}
+
+// WithOnMap adds a hook called with every new Map, e.g. to check its
+// Diagnosis. The Map is closed by the Session.
+func WithOnMap(f func(m *Map)) SessionOption {
+	return func(c *sessionConfig) error {
+		c.onMap = append(c.onMap, f)
+		return nil
+	}
+}
+
+// WithOnEvent adds a hook called with every event of the mappings, see
+// Map.Events.
+func WithOnEvent(f func(e Event)) SessionOption {
+	return func(c *sessionConfig) error {
+		c.onEvent = append(c.onEvent, f)
+		return nil
+	}
+}
+
+// WithRetry sets how long to wait before mapping the port again after the
+// mapping was lost, and between failed attempts. Zero ends the Session
+// instead.
+func WithRetry(d time.Duration) SessionOption {
+	return func(c *sessionConfig) error {
+		if d < 0 {
+			return errors.New("WithRetry: negative retry")
+		}
+		c.retry = d
+		return nil
+	}
+}
+
+// Start maps the port and keeps it mapped in the background until ctx is
+// done or the Session is closed. If the first mapping fails the Session ends
+// with its error.
+func (s *Session) Start(ctx context.Context) error {
+	s.mu.Lock()
+	if s.started || s.ended {
+		s.mu.Unlock()
+		return errors.New("Start: session already started")
+	}
+	s.started = true
+	ctx, s.cancel = context.WithCancel(ctx)
+	// Close waits for the first mapping too.
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	m, err := s.mapPort(ctx)
+	if err != nil {
+		s.end(err)
+		s.wg.Done()
+		return fmt.Errorf("Start: %w", err)
+	}
+	go func() {
+		defer s.wg.Done()
+		s.run(ctx, m)
+	}()
+	return nil
+}
+
+// Done returns a channel that is closed when the Session ends.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the Session ended: ErrSessionClosed, the error of the
+// context passed to Start, or the error the mapping was lost with if
+// WithRetry is zero. It returns nil while the Session runs.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// PublicAddr returns the public address of the port, or the zero value while
+// it is not mapped.
+func (s *Session) PublicAddr() netip.AddrPort {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addr
+}
+
+// PublicAddr6 returns the IPv6 endpoint opened with WithIPv6, see Map.Addr6.
+func (s *Session) PublicAddr6() netip.AddrPort {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addr6
+}
+
+// Close ends the Session, waits for its goroutines and removes the port
+// mappings it created on the router. It must not be called from a hook.
+func (s *Session) Close() error {
+	s.end(ErrSessionClosed)
+	s.wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closeErr != nil {
+		return fmt.Errorf("Close: %w", s.closeErr)
+	}
+	return nil
+}
+
+// end ends the Session with err, unless it already ended.
+func (s *Session) end(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	if s.ended {
+		return
+	}
+	s.ended = true
+	s.err = err
+	s.addr, s.addr6 = netip.AddrPort{}, netip.AddrPort{}
+	close(s.done)
+}
+
+// run follows the events of m, and maps the port again when it is lost,
+// until ctx is done.
+func (s *Session) run(ctx context.Context, m *Map) {
+	for {
+		err := s.follow(ctx, m)
+		if cerr := m.Close(); cerr != nil {
+			if ctx.Err() != nil {
+				s.mu.Lock()
+				s.closeErr = cerr
+				s.mu.Unlock()
+			} else {
+				s.c.log(cerr)
+			}
+		}
+		if ctx.Err() != nil {
+			s.end(ctx.Err())
+			return
+		}
+		if s.c.retry == 0 {
+			s.end(err)
+			return
+		}
+		s.c.log(fmt.Errorf("run: %w", err))
+		s.setAddr(netip.AddrPort{}, netip.AddrPort{})
+
+		for {
+			if !sleep(ctx, s.c.retry) {
+				s.end(ctx.Err())
+				return
+			}
+			m, err = s.mapPort(ctx)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				s.end(ctx.Err())
+				return
+			}
+			s.c.log(fmt.Errorf("run: %w", err))
+		}
+	}
+}
+
+// follow passes the events of m to the hooks until the mapping is lost or
+// ctx is done, and returns why it was lost.
+func (s *Session) follow(ctx context.Context, m *Map) error {
+	for e := range m.Events() {
+		for _, f := range s.c.onEvent {
+			f(e)
+		}
+		switch e.Type {
+		case EventChanged:
+			s.setAddr(e.Addr, m.Addr6())
+			s.callHooks(e.Addr, m.Addr6())
+		case EventLost:
+			return e.Err
+		}
+	}
+	return ctx.Err()
+}
+
+// mapPort maps the port once and calls the hooks if the addresses changed.
+func (s *Session) mapPort(ctx context.Context) (*Map, error) {
+	nmap := NatMap
+	if s.c.udp {
+		nmap = NatMapUdp
+	}
+	m, addr, err := nmap(ctx, s.c.pool, s.laddr, s.c.log, s.c.mapOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("mapPort: %w", err)
+	}
+	for _, f := range s.c.onMap {
+		f(m)
+	}
+	s.setAddr(addr, m.Addr6())
+	s.callHooks(addr, m.Addr6())
+	return m, nil
+}
+
+func (s *Session) setAddr(addr, addr6 netip.AddrPort) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addr, s.addr6 = addr, addr6
+}
+
+// callHooks calls the hooks unless they were last called with the same
+// addresses.
+func (s *Session) callHooks(addr, addr6 netip.AddrPort) {
+	s.mu.Lock()
+	same := s.hooked == [2]netip.AddrPort{addr, addr6}
+	s.hooked = [2]netip.AddrPort{addr, addr6}
+	s.mu.Unlock()
+	if same {
+		return
+	}
+	for _, f := range s.c.hooks {
+		f(addr, addr6)
+	}
+}
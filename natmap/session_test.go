@@ -0,0 +1,81 @@
+package natmap_test
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xmdhs/natupnp/natmap"
+	"github.com/xmdhs/natupnp/stun"
+)
+
+func TestSessionHookUnchanged(t *testing.T) {
+	srv := stun.NewServer(netip.AddrPortFrom(loopback, 0), netip.AddrPort{})
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	saddr := srv.Addr()
+	defer func() { srv.Close() }()
+	pool, err := stun.NewPool(saddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu    sync.Mutex
+		hooks []netip.AddrPort
+	)
+	maps := make(chan *natmap.Map, 2)
+	laddr := freePort(t, "tcp")
+	s, err := natmap.NewSession(laddr,
+		natmap.WithSTUNPool(pool),
+		natmap.WithMapOptions(natmap.WithMode(natmap.ModeNone), natmap.WithKeepalive(noKeepalive), natmap.WithCheckInterval(50*time.Millisecond)),
+		natmap.WithRetry(50*time.Millisecond),
+		natmap.WithLog(logTo(t)),
+		natmap.WithOnMap(func(m *natmap.Map) { maps <- m }),
+		natmap.WithHook(func(addr, addr6 netip.AddrPort) {
+			mu.Lock()
+			defer mu.Unlock()
+			hooks = append(hooks, addr)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	<-maps
+
+	// The check fails while the server is down, so the port is mapped again
+	// once it is back, at the same address.
+	srv.Close()
+	deadline := time.Now().Add(3 * time.Second)
+	for s.PublicAddr().IsValid() {
+		if time.Now().After(deadline) {
+			t.Fatal("mapping not lost")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	srv = stun.NewServer(saddr, netip.AddrPort{})
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-maps:
+	case <-time.After(3 * time.Second):
+		t.Fatal("port not mapped again")
+	}
+	// Close waits for the hooks of the new mapping.
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(hooks) != 1 || hooks[0] != laddr {
+		t.Errorf("hooks called with %v, want %v once", hooks, laddr)
+	}
+}
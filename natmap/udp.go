@@ -7,57 +7,18 @@ import (
 	"net"
 	"net/netip"
 	"strings"
-	"time"
 
 	"github.com/xmdhs/natupnp/reuse"
+	"github.com/xmdhs/natupnp/stun"
 )
 
-func NatMapUdp(ctx context.Context, stunAddr string, laddr netip.AddrPort, log func(error)) (*Map, netip.AddrPort, error) {
-	m := Map{}
-	ctx, cancel := context.WithCancel(ctx)
-	m.cancel = cancel
-
-	mapAddr, err := getPubulicPort(ctx, stunAddr, laddr, false)
+// NatMapUdp is NatMap for a udp port.
+func NatMapUdp(ctx context.Context, stunPool *stun.Pool, laddr netip.AddrPort, log func(error), opts ...MapOption) (*Map, netip.AddrPort, error) {
+	m, mapAddr, err := natMap(ctx, stunPool, laddr, false, DNSKeepalive{}, log, opts)
 	if err != nil {
-		return nil, netip.AddrPort{}, fmt.Errorf("NatMap: %w", err)
-	}
-	go keepaliveUDP(ctx, laddr, log)
-	return &m, mapAddr, nil
-
-}
-
-func keepaliveUDP(ctx context.Context, laddr netip.AddrPort, log func(error)) {
-	raddr := "223.5.5.5:53"
-	if laddr.Addr().Is6() {
-		raddr = "[2400:3200::1]:53"
-	}
-	r := net.Resolver{
-		PreferGo: true,
-		Dial: func(context context.Context, network, address string) (net.Conn, error) {
-			conn, err := reuse.DialContext(context, "udp", laddr.String(), raddr)
-			if err != nil {
-				return nil, err
-			}
-			return conn, nil
-		},
-	}
-	for {
-		func() {
-			ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-			defer cancel()
-			_, err := r.LookupNetIP(ctx, "ip4", "baidu.com")
-			if err != nil {
-				log(err)
-				return
-			}
-			defer time.Sleep(10 * time.Second)
-		}()
-		select {
-		case <-ctx.Done():
-			return
-		default:
-		}
+		return nil, netip.AddrPort{}, fmt.Errorf("NatMapUdp: %w", err)
 	}
+	return m, mapAddr, nil
 }
 
 type logger struct {
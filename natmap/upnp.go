@@ -0,0 +1,281 @@
+package natmap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/xmdhs/natupnp/upnp"
+)
+
+// upnpMapper maps ports over UPnP IGD, and opens pinholes on the UPnP IPv6
+// firewall for IPv6 addresses, see mapPinhole.
+type upnpMapper struct {
+	c   *mapConfig
+	log func(error)
+
+	mu       sync.Mutex
+	gateways []*upnp.Gateway
+	hops     []upnp.Hop
+	external netip.Addr
+}
+
+// upnpState is the PortMapping.State of upnpMapper. The gateways found when
+// the mapping was added are kept, so renewing and deleting it do not search
+// for them again.
+type upnpState struct {
+	gateways []*upnp.Gateway
+	hops     []upnp.Hop
+	pinholes []upnp.Pinhole
+}
+
+// AddPortMapping maps laddr on the gateways. The external port is the local
+// port if it is free on the gateway, see upnp.MapPort. If the gateway is
+// itself behind a NAT, the mapping is chained through the upstream gateway,
+// see upnp.MapUpstream, and the external port is the one of the upstream
+// gateway.
+func (u *upnpMapper) AddPortMapping(ctx context.Context, protocol string, laddr netip.AddrPort, lease time.Duration) (PortMapping, error) {
+	if !laddr.Addr().Unmap().Is4() {
+		return u.mapPinhole(ctx, protocol, laddr, lease)
+	}
+	c := u.c
+	gateways, err := upnp.PickGateways(ctx, c.gateway...)
+	if err != nil {
+		if errors.Is(err, upnp.ErrNoIGD) {
+			err = errors.Join(ErrNotSupported, err)
+		}
+		return PortMapping{}, fmt.Errorf("AddPortMapping: %w", err)
+	}
+	leaseSec := uint32(lease / time.Second)
+	port, err := upnp.MapPort(ctx, protocol, laddr.Port(), laddr.Port(), laddr.Addr().String(), Description, leaseSec, c.portRange, upnp.WithGateways(gateways...))
+	if err != nil {
+		return PortMapping{}, fmt.Errorf("AddPortMapping: %w", err)
+	}
+	var hops []upnp.Hop
+	if c.cascade {
+		hops, err = upnp.MapUpstream(ctx, protocol, port, Description, leaseSec, c.portRange, c.upstream, upnp.WithGateways(gateways...))
+		if err != nil {
+			// The first hop is mapped, STUN tells whether that is enough.
+			u.log(fmt.Errorf("AddPortMapping: %w", err))
+		}
+	}
+	m := PortMapping{
+		Protocol:     protocol,
+		Internal:     laddr,
+		ExternalPort: port,
+		Lease:        lease,
+		State:        upnpState{gateways: gateways, hops: hops},
+	}
+	if len(hops) > 0 {
+		m.ExternalPort = hops[0].ExternalPort
+	}
+	u.mu.Lock()
+	u.gateways = gateways
+	u.hops = hops
+	u.mu.Unlock()
+	return m, nil
+}
+
+// RenewPortMapping adds the mapping again with upnp.MapPort. Re-adding an
+// existing mapping for the same client refreshes its lease. If the port was
+// mapped to another host meanwhile, e.g. after a router reboot, it is not
+// taken over: the mapping moves to a free port and the hops are chained to
+// it again.
+func (u *upnpMapper) RenewPortMapping(ctx context.Context, m PortMapping, lease time.Duration) (PortMapping, error) {
+	st := m.State.(upnpState)
+	if !m.Internal.Addr().Unmap().Is4() {
+		return renewPinholes(ctx, m, st.pinholes)
+	}
+	leaseSec := uint32(lease / time.Second)
+	port := m.ExternalPort
+	if len(st.hops) > 0 {
+		port = st.hops[0].InternalPort
+	}
+	port, err := upnp.MapPort(ctx, m.Protocol, port, m.Internal.Port(), m.Internal.Addr().String(), Description, leaseSec, u.c.portRange, upnp.WithGateways(st.gateways...))
+	if err != nil {
+		return m, fmt.Errorf("RenewPortMapping: %w", err)
+	}
+	hops := make([]upnp.Hop, len(st.hops))
+	for i, h := range st.hops {
+		if h.InternalPort != port {
+			if err := h.Gateway.DeletePortMapping(ctx, "", h.ExternalPort, m.Protocol); err != nil {
+				u.log(fmt.Errorf("RenewPortMapping: %w", err))
+			}
+			h.InternalPort = port
+		}
+		ext, err := h.Gateway.MapPort(ctx, m.Protocol, h.ExternalPort, h.InternalPort, h.InternalClient, Description, leaseSec, u.c.portRange)
+		if err != nil {
+			// The first hop is mapped, as in AddPortMapping. The hop is
+			// kept to be tried again on the next renewal.
+			u.log(fmt.Errorf("RenewPortMapping: %v: %w", h.Gateway, err))
+		} else {
+			h.ExternalPort = ext
+		}
+		hops[i] = h
+	}
+	next := m
+	next.ExternalPort = port
+	if len(hops) > 0 {
+		next.ExternalPort = hops[0].ExternalPort
+	}
+	next.State = upnpState{gateways: st.gateways, hops: hops}
+	u.mu.Lock()
+	u.hops = hops
+	u.mu.Unlock()
+	return next, nil
+}
+
+// DeletePortMapping removes the mapping and the hops chained to it.
+func (u *upnpMapper) DeletePortMapping(ctx context.Context, m PortMapping) error {
+	st := m.State.(upnpState)
+	if !m.Internal.Addr().Unmap().Is4() {
+		return deletePinholes(ctx, st.pinholes)
+	}
+	port := m.ExternalPort
+	if len(st.hops) > 0 {
+		port = st.hops[0].InternalPort
+	}
+	err := upnp.DeletePortMapping(ctx, "", port, m.Protocol, upnp.WithGateways(st.gateways...))
+	for _, h := range st.hops {
+		err = errors.Join(err, h.Gateway.DeletePortMapping(ctx, "", h.ExternalPort, m.Protocol))
+	}
+	if err != nil {
+		return fmt.Errorf("DeletePortMapping: %w", err)
+	}
+	return nil
+}
+
+// VerifyPortMapping reads the mapping and the hops chained to it back from
+// the gateways, see upnp.VerifyPortMapping. Pinholes are not verified.
+func (u *upnpMapper) VerifyPortMapping(ctx context.Context, m PortMapping) error {
+	st := m.State.(upnpState)
+	if !m.Internal.Addr().Unmap().Is4() {
+		return nil
+	}
+	port := m.ExternalPort
+	if len(st.hops) > 0 {
+		port = st.hops[0].InternalPort
+	}
+	err := upnp.VerifyPortMapping(ctx, upnp.PortMapping{
+		ExternalPort:   port,
+		Protocol:       m.Protocol,
+		InternalPort:   m.Internal.Port(),
+		InternalClient: m.Internal.Addr().String(),
+		Enabled:        true,
+	}, upnp.WithGateways(st.gateways...))
+	for _, h := range st.hops {
+		err = errors.Join(err, h.Gateway.VerifyPortMapping(ctx, hopMapping(h, m.Protocol, 0)))
+	}
+	if err != nil {
+		return fmt.Errorf("VerifyPortMapping: %w", err)
+	}
+	return nil
+}
+
+// ExternalIP returns the external address of the upstream gateway of a
+// chained mapping, or else of the gateway. There is no NAT on IPv6, so a
+// pinhole's external address is the local one.
+func (u *upnpMapper) ExternalIP(ctx context.Context) (netip.Addr, error) {
+	u.mu.Lock()
+	gateways, hops, external := u.gateways, u.hops, u.external
+	u.mu.Unlock()
+	if external.IsValid() {
+		return external, nil
+	}
+	var (
+		ip  netip.Addr
+		err error
+	)
+	if len(hops) > 0 {
+		ip, err = hops[0].Gateway.ExternalIP(ctx)
+	} else {
+		ip, err = upnp.ExternalIP(ctx, upnp.WithGateways(gateways...))
+	}
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("ExternalIP: %w", err)
+	}
+	return ip, nil
+}
+
+func (u *upnpMapper) watch(ctx context.Context, recheck func(error)) {
+	u.mu.Lock()
+	gateways, hops, external := u.gateways, u.hops, u.external
+	u.mu.Unlock()
+	if !u.c.events || external.IsValid() {
+		return
+	}
+	watchUPnP(ctx, gateways, hops, recheck, u.log)
+}
+
+// watchUPnP subscribes to the events of the gateways and of the hops above
+// them until ctx is done, and calls recheck when one reports a new external
+// address or a new connection, as after a PPPoE reconnect. It returns once the
+// subscriptions are closed.
+func watchUPnP(ctx context.Context, gateways []*upnp.Gateway, hops []upnp.Hop, recheck, log func(error)) {
+	var (
+		mu     sync.Mutex
+		status = map[*upnp.Gateway][2]string{}
+	)
+	onEvent := func(g *upnp.Gateway, vars map[string]string) {
+		ip, hasIP := vars["ExternalIPAddress"]
+		conn, hasConn := vars["ConnectionStatus"]
+		mu.Lock()
+		last, seen := status[g]
+		next := last
+		if hasIP {
+			next[0] = ip
+		}
+		if hasConn {
+			next[1] = conn
+		}
+		status[g] = next
+		mu.Unlock()
+		// The first event after subscribing reports the current state.
+		if !seen || next == last {
+			return
+		}
+		switch {
+		case hasIP && ip != last[0] && ip != "":
+			recheck(fmt.Errorf("watchUPnP: %v: external address changed to %v", g, ip))
+		case hasConn && conn == "Connected" && last[1] != "Connected":
+			recheck(fmt.Errorf("watchUPnP: %v: reconnected", g))
+		}
+	}
+	onError := func(err error) {
+		log(fmt.Errorf("watchUPnP: %w", err))
+	}
+	subs, err := upnp.Subscribe(ctx, onEvent, onError, upnp.WithGateways(gateways...))
+	if err != nil {
+		onError(err)
+	}
+	for _, h := range hops {
+		g := h.Gateway
+		sub, err := g.Subscribe(ctx, func(vars map[string]string) {
+			onEvent(g, vars)
+		}, onError)
+		if err != nil {
+			onError(err)
+			continue
+		}
+		subs = append(subs, sub)
+	}
+	<-ctx.Done()
+	for _, sub := range subs {
+		sub.Close()
+	}
+}
+
+func hopMapping(h upnp.Hop, protocol string, lease uint32) upnp.PortMapping {
+	return upnp.PortMapping{
+		ExternalPort:   h.ExternalPort,
+		Protocol:       protocol,
+		InternalPort:   h.InternalPort,
+		InternalClient: h.InternalClient,
+		Enabled:        true,
+		Description:    Description,
+		LeaseDuration:  lease,
+	}
+}
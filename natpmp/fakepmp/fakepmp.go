@@ -0,0 +1,230 @@
+// Package fakepmp is an in-memory NAT-PMP (RFC 6886) gateway, for running the
+// natpmp package without a router. Port mappings are kept in memory and never
+// forward traffic.
+package fakepmp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// NAT-PMP result codes the gateway returns.
+const (
+	ResultUnsupportedVersion = 1
+	ResultNotAuthorized      = 2
+	ResultNetworkFailure     = 3
+	ResultOutOfResources     = 4
+	ResultUnsupportedOpcode  = 5
+)
+
+// Mapping is an entry of the mapping table.
+type Mapping struct {
+	// Protocol is "UDP" or "TCP".
+	Protocol       string
+	InternalClient netip.Addr
+	InternalPort   uint16
+	ExternalPort   uint16
+	Lifetime       time.Duration
+}
+
+// Gateway is a fake NAT-PMP gateway. Set the exported fields before Start.
+type Gateway struct {
+	// ExternalIP is returned for the external address request. It defaults
+	// to 203.0.113.1.
+	ExternalIP netip.Addr
+	// Fail, if not nil, is called with the opcode of every request. A
+	// non-zero result code is returned instead of running the request.
+	Fail func(op byte) uint16
+
+	mu       sync.Mutex
+	mappings []Mapping
+	start    time.Time
+	requests int
+	conn     *net.UDPConn
+	wg       sync.WaitGroup
+}
+
+// Start serves the gateway on a free udp port of ip, e.g. 127.0.0.1.
+func (g *Gateway) Start(ctx context.Context, ip netip.Addr) error {
+	if !g.ExternalIP.IsValid() {
+		g.ExternalIP = netip.MustParseAddr("203.0.113.1")
+	}
+	var lc net.ListenConfig
+	pc, err := lc.ListenPacket(ctx, "udp", netip.AddrPortFrom(ip, 0).String())
+	if err != nil {
+		return fmt.Errorf("Start: %w", err)
+	}
+	g.mu.Lock()
+	g.conn = pc.(*net.UDPConn)
+	g.start = time.Now()
+	g.mu.Unlock()
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		g.serve()
+	}()
+	return nil
+}
+
+// Addr returns the address the gateway listens on, for natpmp.Client.Gateway.
+func (g *Gateway) Addr() netip.AddrPort {
+	return g.conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+// Mappings returns a copy of the mapping table.
+func (g *Gateway) Mappings() []Mapping {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]Mapping(nil), g.mappings...)
+}
+
+// SetMapping adds m to the mapping table, e.g. to simulate another host
+// holding a port.
+func (g *Gateway) SetMapping(m Mapping) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.mappings = append(g.mappings, m)
+}
+
+// Requests returns the number of requests answered so far.
+func (g *Gateway) Requests() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.requests
+}
+
+// Reboot drops all port mappings and restarts the epoch, like a gateway
+// reboot.
+func (g *Gateway) Reboot() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.mappings = nil
+	g.start = time.Now()
+}
+
+// Close stops the gateway.
+func (g *Gateway) Close() error {
+	err := g.conn.Close()
+	g.wg.Wait()
+	return err
+}
+
+func (g *Gateway) serve() {
+	buf := make([]byte, 1100)
+	for {
+		n, raddr, err := g.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if res := g.handle(buf[:n], raddr.Addr().Unmap()); res != nil {
+			g.conn.WriteToUDPAddrPort(res, raddr)
+		}
+	}
+}
+
+// handle returns the response to req from client, or nil to drop it.
+func (g *Gateway) handle(req []byte, client netip.Addr) []byte {
+	if len(req) < 2 || req[1]&0x80 != 0 {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.requests++
+
+	op := req[1]
+	res := make([]byte, 16)
+	res[1] = op | 0x80
+	binary.BigEndian.PutUint32(res[4:], uint32(time.Since(g.start)/time.Second))
+	code := uint16(0)
+	switch {
+	case req[0] != 0:
+		code = ResultUnsupportedVersion
+	case g.Fail != nil:
+		code = g.Fail(op)
+	}
+	if code == 0 && op > 2 {
+		code = ResultUnsupportedOpcode
+	}
+	if code != 0 {
+		binary.BigEndian.PutUint16(res[2:], code)
+		return res[:8]
+	}
+	if op == 0 {
+		ip := g.ExternalIP.As4()
+		copy(res[8:12], ip[:])
+		return res[:12]
+	}
+	if len(req) < 12 {
+		return nil
+	}
+	protocol := "UDP"
+	if op == 2 {
+		protocol = "TCP"
+	}
+	iport := binary.BigEndian.Uint16(req[4:6])
+	eport := binary.BigEndian.Uint16(req[6:8])
+	lifetime := time.Duration(binary.BigEndian.Uint32(req[8:12])) * time.Second
+	copy(res[8:10], req[4:6])
+	if lifetime == 0 {
+		g.deleteLocked(protocol, client, iport)
+		return res
+	}
+	m := g.mapLocked(protocol, client, iport, eport, lifetime)
+	binary.BigEndian.PutUint16(res[10:], m.ExternalPort)
+	binary.BigEndian.PutUint32(res[12:], uint32(m.Lifetime/time.Second))
+	return res
+}
+
+// mapLocked renews the mapping of client:iport, or maps it to eport, or to
+// another port if eport is taken.
+func (g *Gateway) mapLocked(protocol string, client netip.Addr, iport, eport uint16, lifetime time.Duration) Mapping {
+	for i, v := range g.mappings {
+		if v.Protocol == protocol && v.InternalClient == client && v.InternalPort == iport {
+			g.mappings[i].Lifetime = lifetime
+			return g.mappings[i]
+		}
+	}
+	if eport == 0 {
+		eport = iport
+	}
+	for g.takenLocked(protocol, eport) {
+		eport++
+		if eport == 0 {
+			eport = 1024
+		}
+	}
+	m := Mapping{Protocol: protocol, InternalClient: client, InternalPort: iport, ExternalPort: eport, Lifetime: lifetime}
+	g.mappings = append(g.mappings, m)
+	return m
+}
+
+func (g *Gateway) takenLocked(protocol string, eport uint16) bool {
+	for _, v := range g.mappings {
+		if v.Protocol == protocol && v.ExternalPort == eport {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteLocked removes the mapping of client:iport, or every mapping of
+// client for iport 0.
+func (g *Gateway) deleteLocked(protocol string, client netip.Addr, iport uint16) {
+	l := g.mappings[:0]
+	for _, v := range g.mappings {
+		if v.Protocol == protocol && v.InternalClient == client && (iport == 0 || v.InternalPort == iport) {
+			continue
+		}
+		l = append(l, v)
+	}
+	g.mappings = l
+}
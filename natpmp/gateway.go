@@ -0,0 +1,6 @@
+package natpmp
+
+import "errors"
+
+// ErrNoGateway is returned when the default gateway could not be found.
+var ErrNoGateway = errors.New("natpmp: default gateway not found")
@@ -0,0 +1,68 @@
+package natpmp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// nativeEndian is the byte order of the host.
+var nativeEndian binary.ByteOrder = binary.BigEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		nativeEndian = binary.LittleEndian
+	}
+}
+
+// DefaultGateway returns the IPv4 gateway of the default route, read from
+// /proc/net/route.
+func DefaultGateway() (netip.Addr, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("DefaultGateway: %w", err)
+	}
+	defer f.Close()
+	gw, err := parseRoute(f)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("DefaultGateway: %w", err)
+	}
+	return gw, nil
+}
+
+// parseRoute returns the gateway of the default route in r, in the format of
+// /proc/net/route.
+func parseRoute(r io.Reader) (netip.Addr, error) {
+	s := bufio.NewScanner(r)
+	s.Scan() // header
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		// The kernel prints the address, which is in network byte order in
+		// memory, as a number in host byte order.
+		v, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil {
+			continue
+		}
+		var ip [4]byte
+		nativeEndian.PutUint32(ip[:], uint32(v))
+		gw := netip.AddrFrom4(ip)
+		if gw.IsUnspecified() {
+			continue
+		}
+		return gw, nil
+	}
+	if err := s.Err(); err != nil {
+		return netip.Addr{}, fmt.Errorf("parseRoute: %w", err)
+	}
+	return netip.Addr{}, fmt.Errorf("parseRoute: %w", ErrNoGateway)
+}
@@ -0,0 +1,34 @@
+package natpmp
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// routeHex prints ip the way /proc/net/route does on this host.
+func routeHex(ip string) string {
+	b := netip.MustParseAddr(ip).As4()
+	return fmt.Sprintf("%08X", nativeEndian.Uint32(b[:]))
+}
+
+func TestParseRoute(t *testing.T) {
+	table := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n" +
+		"eth0\t" + routeHex("192.168.1.0") + "\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\n" +
+		"eth0\t00000000\t" + routeHex("192.168.1.254") + "\t0003\t0\t0\t0\t00000000\t0\t0\t0\n"
+	gw, err := parseRoute(strings.NewReader(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := netip.MustParseAddr("192.168.1.254"); gw != want {
+		t.Errorf("gateway = %v, want %v", gw, want)
+	}
+
+	table = "Iface\tDestination\tGateway \tFlags\n" +
+		"eth0\t" + routeHex("10.0.0.0") + "\t00000000\t0001\n"
+	if _, err := parseRoute(strings.NewReader(table)); !errors.Is(err, ErrNoGateway) {
+		t.Errorf("err = %v, want %v", err, ErrNoGateway)
+	}
+}
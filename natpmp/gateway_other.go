@@ -0,0 +1,27 @@
+//go:build !linux
+
+package natpmp
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// DefaultGateway guesses the IPv4 gateway as the first address of the /24 of
+// the address used for the default route, which is what most home routers
+// use. Set Client.Gateway directly if that guess is wrong.
+func DefaultGateway() (netip.Addr, error) {
+	c, err := net.Dial("udp4", "223.5.5.5:53")
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("DefaultGateway: %w", err)
+	}
+	defer c.Close()
+	local := c.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap()
+	if !local.Is4() {
+		return netip.Addr{}, fmt.Errorf("DefaultGateway: %w", ErrNoGateway)
+	}
+	ip := local.As4()
+	ip[3] = 1
+	return netip.AddrFrom4(ip), nil
+}
@@ -0,0 +1,212 @@
+// Package natpmp is a NAT Port Mapping Protocol (RFC 6886) client.
+package natpmp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Port is the NAT-PMP server port on the gateway.
+const Port = 5351
+
+const (
+	opExternalAddress = 0
+	opMapUDP          = 1
+	opMapTCP          = 2
+
+	initialRTO = 250 * time.Millisecond
+	maxTries   = 9
+)
+
+// ErrTimeout is returned when the gateway did not answer, i.e. it most likely
+// does not speak NAT-PMP.
+var ErrTimeout = errors.New("natpmp: gateway did not respond")
+
+// ResultError is a non-zero NAT-PMP result code.
+type ResultError struct {
+	Code uint16
+}
+
+func (e *ResultError) Error() string {
+	var s string
+	switch e.Code {
+	case 1:
+		s = "unsupported version"
+	case 2:
+		s = "not authorized/refused"
+	case 3:
+		s = "network failure"
+	case 4:
+		s = "out of resources"
+	case 5:
+		s = "unsupported opcode"
+	default:
+		s = "unknown"
+	}
+	return fmt.Sprintf("natpmp: result code %d (%s)", e.Code, s)
+}
+
+// Client talks to the NAT-PMP server of one gateway.
+type Client struct {
+	// Gateway is the NAT-PMP server, normally the default gateway on Port.
+	Gateway netip.AddrPort
+	// Local, if set, is the address requests are sent from. The gateway
+	// maps ports for the source address of the request.
+	Local netip.Addr
+	// Tries is the number of requests sent before giving up, with the
+	// interval starting at 250 ms and doubling. Defaults to 9 (RFC 6886).
+	Tries int
+}
+
+// NewClient returns a client for the gateway of the default route.
+func NewClient() (*Client, error) {
+	gw, err := DefaultGateway()
+	if err != nil {
+		return nil, fmt.Errorf("NewClient: %w", err)
+	}
+	return &Client{Gateway: netip.AddrPortFrom(gw, Port)}, nil
+}
+
+// Mapping is a port mapping granted by the gateway.
+type Mapping struct {
+	Protocol     string
+	InternalPort uint16
+	ExternalPort uint16
+	Lifetime     time.Duration
+	// Epoch is the gateway's seconds since start of epoch. A value lower
+	// than expected means the gateway rebooted and lost its mappings.
+	Epoch uint32
+}
+
+// ExternalAddress returns the gateway's external IPv4 address.
+func (c *Client) ExternalAddress(ctx context.Context) (netip.Addr, error) {
+	res, err := c.do(ctx, []byte{0, opExternalAddress}, 12)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("ExternalAddress: %w", err)
+	}
+	return netip.AddrFrom4([4]byte(res[8:12])), nil
+}
+
+// AddPortMapping asks for a mapping of internalPort, preferably to
+// externalPort, for lifetime. The gateway may grant another external port or
+// a shorter lifetime; the granted values are returned. Call it again before
+// the lifetime ends to renew the mapping.
+func (c *Client) AddPortMapping(ctx context.Context, protocol string, internalPort, externalPort uint16, lifetime time.Duration) (Mapping, error) {
+	if lifetime <= 0 {
+		return Mapping{}, fmt.Errorf("AddPortMapping: lifetime must be positive")
+	}
+	m, err := c.mapPort(ctx, protocol, internalPort, externalPort, uint32(lifetime/time.Second))
+	if err != nil {
+		return Mapping{}, fmt.Errorf("AddPortMapping: %w", err)
+	}
+	return m, nil
+}
+
+// DeletePortMapping removes the mapping of internalPort.
+func (c *Client) DeletePortMapping(ctx context.Context, protocol string, internalPort uint16) error {
+	_, err := c.mapPort(ctx, protocol, internalPort, 0, 0)
+	if err != nil {
+		return fmt.Errorf("DeletePortMapping: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) mapPort(ctx context.Context, protocol string, internalPort, externalPort uint16, lifetime uint32) (Mapping, error) {
+	var op byte
+	switch strings.ToUpper(protocol) {
+	case "UDP":
+		op = opMapUDP
+	case "TCP":
+		op = opMapTCP
+	default:
+		return Mapping{}, fmt.Errorf("mapPort: unknown protocol %q", protocol)
+	}
+	req := make([]byte, 12)
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:], internalPort)
+	binary.BigEndian.PutUint16(req[6:], externalPort)
+	binary.BigEndian.PutUint32(req[8:], lifetime)
+	res, err := c.do(ctx, req, 16)
+	if err != nil {
+		return Mapping{}, fmt.Errorf("mapPort: %w", err)
+	}
+	return Mapping{
+		Protocol:     strings.ToUpper(protocol),
+		InternalPort: binary.BigEndian.Uint16(res[8:10]),
+		ExternalPort: binary.BigEndian.Uint16(res[10:12]),
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(res[12:16])) * time.Second,
+		Epoch:        binary.BigEndian.Uint32(res[4:8]),
+	}, nil
+}
+
+// do sends req and returns the matching response of at least size bytes,
+// retransmitting as RFC 6886 section 3.1 describes.
+func (c *Client) do(ctx context.Context, req []byte, size int) ([]byte, error) {
+	var d net.Dialer
+	if c.Local.IsValid() {
+		d.LocalAddr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(c.Local, 0))
+	}
+	conn, err := d.DialContext(ctx, "udp4", c.Gateway.String())
+	if err != nil {
+		return nil, fmt.Errorf("do: %w", err)
+	}
+	defer conn.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	tries := c.Tries
+	if tries <= 0 {
+		tries = maxTries
+	}
+	buf := make([]byte, 1100)
+	rto := initialRTO
+	for i := 0; i < tries; i++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, fmt.Errorf("do: %w", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(rto))
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("do: %w", err)
+		}
+		rto *= 2
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, fmt.Errorf("do: %w", ctx.Err())
+				}
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() {
+					break
+				}
+				return nil, fmt.Errorf("do: %w", err)
+			}
+			res := buf[:n]
+			if n < 4 || res[0] != 0 || res[1] != req[1]|0x80 {
+				continue
+			}
+			if code := binary.BigEndian.Uint16(res[2:4]); code != 0 {
+				return nil, fmt.Errorf("do: %w", &ResultError{Code: code})
+			}
+			if n < size {
+				continue
+			}
+			return append([]byte(nil), res...), nil
+		}
+	}
+	return nil, fmt.Errorf("do: %w", ErrTimeout)
+}
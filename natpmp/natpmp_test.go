@@ -0,0 +1,114 @@
+package natpmp_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/xmdhs/natupnp/natpmp"
+	"github.com/xmdhs/natupnp/natpmp/fakepmp"
+)
+
+var loopback = netip.MustParseAddr("127.0.0.1")
+
+func start(t *testing.T, g *fakepmp.Gateway) *natpmp.Client {
+	t.Helper()
+	if err := g.Start(context.Background(), loopback); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { g.Close() })
+	return &natpmp.Client{Gateway: g.Addr(), Local: loopback}
+}
+
+func TestExternalAddress(t *testing.T) {
+	g := &fakepmp.Gateway{ExternalIP: netip.MustParseAddr("198.51.100.7")}
+	c := start(t, g)
+	ip, err := c.ExternalAddress(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != g.ExternalIP {
+		t.Errorf("external address = %v, want %v", ip, g.ExternalIP)
+	}
+}
+
+func TestMapRenewDelete(t *testing.T) {
+	ctx := context.Background()
+	g := &fakepmp.Gateway{}
+	c := start(t, g)
+
+	m, err := c.AddPortMapping(ctx, "tcp", 8080, 8080, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := natpmp.Mapping{Protocol: "TCP", InternalPort: 8080, ExternalPort: 8080, Lifetime: time.Hour, Epoch: m.Epoch}
+	if m != want {
+		t.Errorf("mapping = %+v, want %+v", m, want)
+	}
+
+	renewed, err := c.AddPortMapping(ctx, "tcp", 8080, m.ExternalPort, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.ExternalPort != m.ExternalPort || renewed.Lifetime != 2*time.Hour {
+		t.Errorf("renewed mapping = %+v, want port %d for 2h", renewed, m.ExternalPort)
+	}
+	if l := g.Mappings(); len(l) != 1 || l[0].Lifetime != 2*time.Hour {
+		t.Errorf("gateway mappings = %+v, want one renewed for 2h", l)
+	}
+
+	if err := c.DeletePortMapping(ctx, "tcp", 8080); err != nil {
+		t.Fatal(err)
+	}
+	if l := g.Mappings(); len(l) != 0 {
+		t.Errorf("gateway mappings = %+v after delete, want none", l)
+	}
+}
+
+func TestMapTakenPort(t *testing.T) {
+	g := &fakepmp.Gateway{}
+	c := start(t, g)
+	g.SetMapping(fakepmp.Mapping{Protocol: "UDP", InternalClient: netip.MustParseAddr("192.168.1.9"), InternalPort: 9000, ExternalPort: 9000, Lifetime: time.Hour})
+
+	m, err := c.AddPortMapping(context.Background(), "udp", 9000, 9000, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ExternalPort == 9000 {
+		t.Fatal("gateway granted a port mapped to another host")
+	}
+	if l := g.Mappings(); len(l) != 2 || l[0].InternalClient != netip.MustParseAddr("192.168.1.9") {
+		t.Errorf("gateway mappings = %+v, want the other host's mapping kept", l)
+	}
+}
+
+func TestResultError(t *testing.T) {
+	g := &fakepmp.Gateway{Fail: func(op byte) uint16 { return fakepmp.ResultNotAuthorized }}
+	c := start(t, g)
+	_, err := c.AddPortMapping(context.Background(), "tcp", 8080, 8080, time.Hour)
+	var re *natpmp.ResultError
+	if !errors.As(err, &re) || re.Code != fakepmp.ResultNotAuthorized {
+		t.Fatalf("err = %v, want result code %d", err, fakepmp.ResultNotAuthorized)
+	}
+	if n := g.Requests(); n != 1 {
+		t.Errorf("%d requests sent, want 1: errors are not retried", n)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	// A socket that never answers, like a gateway without NAT-PMP that
+	// drops the requests.
+	conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(loopback, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &natpmp.Client{Gateway: conn.LocalAddr().(*net.UDPAddr).AddrPort(), Local: loopback, Tries: 2}
+	_, err = c.ExternalAddress(context.Background())
+	if !errors.Is(err, natpmp.ErrTimeout) {
+		t.Fatalf("err = %v, want %v", err, natpmp.ErrTimeout)
+	}
+}
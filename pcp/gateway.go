@@ -0,0 +1,28 @@
+package pcp
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/xmdhs/natupnp/natpmp"
+)
+
+// ErrNoGateway is returned when the default gateway could not be found.
+var ErrNoGateway = errors.New("pcp: default gateway not found")
+
+// DefaultGateway returns the gateway of the IPv4 or IPv6 default route.
+func DefaultGateway(v6 bool) (netip.Addr, error) {
+	if !v6 {
+		gw, err := natpmp.DefaultGateway()
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("DefaultGateway: %w", err)
+		}
+		return gw, nil
+	}
+	gw, err := defaultGateway6()
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("DefaultGateway: %w", err)
+	}
+	return gw, nil
+}
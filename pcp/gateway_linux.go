@@ -0,0 +1,45 @@
+package pcp
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// defaultGateway6 reads the IPv6 default route from /proc/net/ipv6_route.
+// Link-local gateways get the zone of the route's interface.
+func defaultGateway6() (netip.Addr, error) {
+	f, err := os.Open("/proc/net/ipv6_route")
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("defaultGateway6: %w", err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// dest dest_plen src src_plen nexthop metric refcnt use flags iface
+		fields := strings.Fields(s.Text())
+		if len(fields) < 10 || fields[1] != "00" || strings.Trim(fields[0], "0") != "" {
+			continue
+		}
+		b, err := hex.DecodeString(fields[4])
+		if err != nil || len(b) != 16 {
+			continue
+		}
+		gw := netip.AddrFrom16([16]byte(b))
+		if gw.IsUnspecified() {
+			continue
+		}
+		if gw.IsLinkLocalUnicast() {
+			gw = gw.WithZone(fields[9])
+		}
+		return gw, nil
+	}
+	if err := s.Err(); err != nil {
+		return netip.Addr{}, fmt.Errorf("defaultGateway6: %w", err)
+	}
+	return netip.Addr{}, fmt.Errorf("defaultGateway6: %w", ErrNoGateway)
+}
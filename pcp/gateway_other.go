@@ -0,0 +1,14 @@
+//go:build !linux
+
+package pcp
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// defaultGateway6 is only implemented on Linux. Set Client.Server directly
+// elsewhere.
+func defaultGateway6() (netip.Addr, error) {
+	return netip.Addr{}, fmt.Errorf("defaultGateway6: %w", ErrNoGateway)
+}
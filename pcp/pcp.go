@@ -0,0 +1,351 @@
+// Package pcp is a Port Control Protocol (RFC 6887) client supporting the MAP
+// opcode over IPv4 and IPv6.
+package pcp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Port is the PCP server port.
+const Port = 5351
+
+const (
+	version    = 2
+	opAnnounce = 0
+	opMap      = 1
+
+	headerSize = 24
+	mapSize    = 36
+
+	// Retransmission, RFC 6887 section 8.1.1.
+	irt = 3 * time.Second
+	mrt = 1024 * time.Second
+)
+
+// ErrTimeout is returned when the server did not answer in time.
+var ErrTimeout = errors.New("pcp: server did not respond")
+
+// ErrEpochReset is returned when the epoch of the server shows it lost its
+// state, e.g. because it rebooted, see RFC 6887 section 8.5.
+var ErrEpochReset = errors.New("pcp: server lost its mappings")
+
+// ErrUnsupportedVersion is returned when the server answered with a NAT-PMP
+// (RFC 6886) UNSUPP_VERSION reply, as NAT-PMP only gateways do, see RFC 6887
+// section 9.
+var ErrUnsupportedVersion = errors.New("pcp: server only supports NAT-PMP")
+
+// ResultError is a non-zero PCP result code.
+type ResultError struct {
+	Code uint8
+	// Lifetime is how long the error is expected to last; for
+	// NETWORK_FAILURE and NO_RESOURCES the client should not retry sooner.
+	Lifetime time.Duration
+}
+
+var resultNames = map[uint8]string{
+	1:  "UNSUPP_VERSION",
+	2:  "NOT_AUTHORIZED",
+	3:  "MALFORMED_REQUEST",
+	4:  "UNSUPP_OPCODE",
+	5:  "UNSUPP_OPTION",
+	6:  "MALFORMED_OPTION",
+	7:  "NETWORK_FAILURE",
+	8:  "NO_RESOURCES",
+	9:  "UNSUPP_PROTOCOL",
+	10: "USER_EX_QUOTA",
+	11: "CANNOT_PROVIDE_EXTERNAL",
+	12: "ADDRESS_MISMATCH",
+	13: "EXCESSIVE_REMOTE_PEERS",
+}
+
+func (e *ResultError) Error() string {
+	name, ok := resultNames[e.Code]
+	if !ok {
+		name = "unknown"
+	}
+	return fmt.Sprintf("pcp: result code %d (%s)", e.Code, name)
+}
+
+// Client talks to one PCP server.
+type Client struct {
+	// Server is the PCP server, normally the default gateway on Port.
+	Server netip.AddrPort
+	// Local is the address requests are sent from, and so the address
+	// mappings are created for. If not set the system picks one.
+	Local netip.Addr
+
+	mu        sync.Mutex
+	epoch     uint32
+	epochAt   time.Time
+	epochSeen bool
+}
+
+// NewClient returns a client for the default gateway of local's address
+// family.
+func NewClient(local netip.Addr) (*Client, error) {
+	gw, err := DefaultGateway(local.Is6() && !local.Is4In6())
+	if err != nil {
+		return nil, fmt.Errorf("NewClient: %w", err)
+	}
+	return &Client{Server: netip.AddrPortFrom(gw, Port), Local: local}, nil
+}
+
+// Mapping is a mapping granted by the server. It is identified by its nonce,
+// which must be used to renew or delete it.
+type Mapping struct {
+	Nonce        [12]byte
+	Protocol     string
+	InternalAddr netip.AddrPort
+	ExternalAddr netip.AddrPort
+	Lifetime     time.Duration
+	// Epoch is the server's epoch time. The Client checks it on every
+	// response, see ErrEpochReset.
+	Epoch uint32
+}
+
+// AddPortMapping requests a new mapping for internalPort, suggesting
+// external (which may be the zero value). The server may grant another
+// external address and a different lifetime.
+//
+// Every request checks the epoch of the server. If it lost its state, the
+// mapping is still returned, along with an error wrapping ErrEpochReset: the
+// other mappings of the client are gone.
+func (c *Client) AddPortMapping(ctx context.Context, protocol string, internalPort uint16, external netip.AddrPort, lifetime time.Duration) (Mapping, error) {
+	if lifetime <= 0 {
+		return Mapping{}, fmt.Errorf("AddPortMapping: lifetime must be positive")
+	}
+	m := Mapping{Protocol: strings.ToUpper(protocol), ExternalAddr: external}
+	if _, err := rand.Read(m.Nonce[:]); err != nil {
+		return Mapping{}, fmt.Errorf("AddPortMapping: %w", err)
+	}
+	m, err := c.do(ctx, m, internalPort, lifetime)
+	if errors.Is(err, ErrEpochReset) {
+		return m, fmt.Errorf("AddPortMapping: %w", err)
+	}
+	if err != nil {
+		return Mapping{}, fmt.Errorf("AddPortMapping: %w", err)
+	}
+	return m, nil
+}
+
+// RenewPortMapping extends m, keeping its nonce and external address. A
+// server that lost its state creates the mapping again, which is returned
+// along with an error wrapping ErrEpochReset, see AddPortMapping.
+func (c *Client) RenewPortMapping(ctx context.Context, m Mapping, lifetime time.Duration) (Mapping, error) {
+	if lifetime <= 0 {
+		return Mapping{}, fmt.Errorf("RenewPortMapping: lifetime must be positive")
+	}
+	m, err := c.do(ctx, m, m.InternalAddr.Port(), lifetime)
+	if errors.Is(err, ErrEpochReset) {
+		return m, fmt.Errorf("RenewPortMapping: %w", err)
+	}
+	if err != nil {
+		return Mapping{}, fmt.Errorf("RenewPortMapping: %w", err)
+	}
+	return m, nil
+}
+
+// DeletePortMapping removes m. A server that lost its state has no m
+// anyway, so ErrEpochReset is not returned.
+func (c *Client) DeletePortMapping(ctx context.Context, m Mapping) error {
+	_, err := c.do(ctx, m, m.InternalAddr.Port(), 0)
+	if err != nil && !errors.Is(err, ErrEpochReset) {
+		return fmt.Errorf("DeletePortMapping: %w", err)
+	}
+	return nil
+}
+
+func protocolNumber(protocol string) (byte, error) {
+	switch protocol {
+	case "TCP":
+		return 6, nil
+	case "UDP":
+		return 17, nil
+	default:
+		return 0, fmt.Errorf("unknown protocol %q", protocol)
+	}
+}
+
+// do sends a MAP request for m and waits for the response with the same
+// nonce, retransmitting until ctx is done. If the epoch of the response shows
+// the server lost its state, the mapping is returned along with an error
+// wrapping ErrEpochReset.
+func (c *Client) do(ctx context.Context, m Mapping, internalPort uint16, lifetime time.Duration) (Mapping, error) {
+	proto, err := protocolNumber(m.Protocol)
+	if err != nil {
+		return Mapping{}, fmt.Errorf("do: %w", err)
+	}
+	build := func(local netip.Addr) []byte {
+		req := make([]byte, headerSize+mapSize)
+		req[0] = version
+		req[1] = opMap
+		binary.BigEndian.PutUint32(req[4:], uint32(lifetime/time.Second))
+		ip16 := local.As16()
+		copy(req[8:24], ip16[:])
+		copy(req[24:36], m.Nonce[:])
+		req[36] = proto
+		binary.BigEndian.PutUint16(req[40:], internalPort)
+		binary.BigEndian.PutUint16(req[42:], m.ExternalAddr.Port())
+		if m.ExternalAddr.Addr().IsValid() {
+			ext := m.ExternalAddr.Addr().As16()
+			copy(req[44:60], ext[:])
+		} else if local.Is4() || local.Is4In6() {
+			// The all-zeros IPv4 address, ::ffff:0.0.0.0.
+			req[54], req[55] = 0xff, 0xff
+		}
+		return req
+	}
+	match := func(res []byte) bool {
+		if res[3] != 0 {
+			// Error responses may be shorter and lack the nonce.
+			return len(res) < headerSize+12 || [12]byte(res[24:36]) == m.Nonce
+		}
+		return len(res) >= headerSize+mapSize && res[0] == version && [12]byte(res[24:36]) == m.Nonce
+	}
+	res, local, reset, err := c.exchange(ctx, opMap, build, match)
+	if err != nil {
+		return Mapping{}, fmt.Errorf("do: %w", err)
+	}
+	ext := netip.AddrFrom16([16]byte(res[44:60])).Unmap()
+	next := Mapping{
+		Nonce:        m.Nonce,
+		Protocol:     m.Protocol,
+		InternalAddr: netip.AddrPortFrom(local.Unmap(), binary.BigEndian.Uint16(res[40:42])),
+		ExternalAddr: netip.AddrPortFrom(ext, binary.BigEndian.Uint16(res[42:44])),
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(res[4:8])) * time.Second,
+		Epoch:        binary.BigEndian.Uint32(res[8:12]),
+	}
+	if reset {
+		return next, fmt.Errorf("do: %w", ErrEpochReset)
+	}
+	return next, nil
+}
+
+// Announce asks the server for its epoch. It returns an error wrapping
+// ErrEpochReset if the server lost its state since the last response, e.g.
+// because it rebooted; the mappings of the client must then be re-created.
+func (c *Client) Announce(ctx context.Context) error {
+	build := func(local netip.Addr) []byte {
+		req := make([]byte, headerSize)
+		req[0] = version
+		req[1] = opAnnounce
+		ip16 := local.As16()
+		copy(req[8:24], ip16[:])
+		return req
+	}
+	_, _, reset, err := c.exchange(ctx, opAnnounce, build, func(res []byte) bool { return true })
+	if err != nil {
+		return fmt.Errorf("Announce: %w", err)
+	}
+	if reset {
+		return fmt.Errorf("Announce: %w", ErrEpochReset)
+	}
+	return nil
+}
+
+// exchange sends the request build returns for the local address of the
+// request, and waits for the response to op that match accepts,
+// retransmitting until ctx is done. reset tells whether the epoch of the
+// response shows the server lost its state, see checkEpoch.
+func (c *Client) exchange(ctx context.Context, op byte, build func(local netip.Addr) []byte, match func(res []byte) bool) (res []byte, local netip.Addr, reset bool, err error) {
+	var d net.Dialer
+	if c.Local.IsValid() {
+		d.LocalAddr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(c.Local, 0))
+	}
+	conn, err := d.DialContext(ctx, "udp", c.Server.String())
+	if err != nil {
+		return nil, netip.Addr{}, false, fmt.Errorf("exchange: %w", err)
+	}
+	defer conn.Close()
+	local = conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr()
+	req := build(local)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	buf := make([]byte, 1100)
+	rt := jitter(irt)
+	for {
+		if _, err := conn.Write(req); err != nil {
+			return nil, local, false, fmt.Errorf("exchange: %w", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(rt))
+		if err := ctx.Err(); err != nil {
+			return nil, local, false, fmt.Errorf("exchange: %w", errors.Join(ErrTimeout, err))
+		}
+		if rt = jitter(2 * rt); rt > mrt {
+			rt = jitter(mrt)
+		}
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, local, false, fmt.Errorf("exchange: %w", errors.Join(ErrTimeout, ctx.Err()))
+				}
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() {
+					break
+				}
+				return nil, local, false, fmt.Errorf("exchange: %w", err)
+			}
+			res := buf[:n]
+			// A NAT-PMP reply is version 0 and only 8 bytes long.
+			if n >= 4 && res[0] == 0 && res[1] == op|0x80 && binary.BigEndian.Uint16(res[2:4]) == 1 {
+				return nil, local, false, fmt.Errorf("exchange: %w", ErrUnsupportedVersion)
+			}
+			if n < headerSize || res[1] != op|0x80 || !match(res) {
+				continue
+			}
+			reset := !c.checkEpoch(binary.BigEndian.Uint32(res[8:12]), time.Now())
+			if code := res[3]; code != 0 {
+				return nil, local, reset, fmt.Errorf("exchange: %w", &ResultError{
+					Code:     code,
+					Lifetime: time.Duration(binary.BigEndian.Uint32(res[4:8])) * time.Second,
+				})
+			}
+			return append([]byte(nil), res...), local, reset, nil
+		}
+	}
+}
+
+// checkEpoch records the epoch of a response received at now and reports
+// whether it is consistent with the previous one, as RFC 6887 section 8.5
+// describes: the epoch must not go backwards, and must advance about as fast
+// as the clock of the client.
+func (c *Client) checkEpoch(epoch uint32, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prev, prevAt, seen := c.epoch, c.epochAt, c.epochSeen
+	c.epoch, c.epochAt, c.epochSeen = epoch, now, true
+	if !seen {
+		return true
+	}
+	if int64(epoch) < int64(prev)-1 {
+		return false
+	}
+	clientDelta := int64(now.Sub(prevAt) / time.Second)
+	serverDelta := int64(epoch) - int64(prev)
+	return clientDelta+2 >= serverDelta-serverDelta/16 && serverDelta+2 >= clientDelta-clientDelta/16
+}
+
+// jitter applies the RFC 6887 RAND factor of -0.1 to +0.1.
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration((mrand.Float64()*0.2-0.1)*float64(d))
+}
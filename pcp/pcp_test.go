@@ -0,0 +1,228 @@
+package pcp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xmdhs/natupnp/natpmp/fakepmp"
+)
+
+// fakeServer answers MAP and ANNOUNCE requests on loopback with the epoch
+// set by the test.
+type fakeServer struct {
+	conn *net.UDPConn
+
+	mu       sync.Mutex
+	epoch    uint32
+	result   uint8
+	mappings map[[12]byte]uint16
+}
+
+var external = netip.MustParseAddr("203.0.113.1")
+
+func startServer(t *testing.T) (*fakeServer, *Client) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:0")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{conn: conn, epoch: 1000, mappings: map[[12]byte]uint16{}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.serve()
+	}()
+	t.Cleanup(func() {
+		conn.Close()
+		<-done
+	})
+	c := &Client{Server: conn.LocalAddr().(*net.UDPAddr).AddrPort(), Local: netip.MustParseAddr("127.0.0.1")}
+	return s, c
+}
+
+func (s *fakeServer) setEpoch(epoch uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.epoch = epoch
+}
+
+func (s *fakeServer) serve() {
+	buf := make([]byte, 1100)
+	for {
+		n, raddr, err := s.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		if res := s.handle(buf[:n]); res != nil {
+			s.conn.WriteToUDPAddrPort(res, raddr)
+		}
+	}
+}
+
+func (s *fakeServer) handle(req []byte) []byte {
+	if len(req) < headerSize || req[0] != version {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]byte, len(req))
+	copy(res, req)
+	res[1] = req[1] | 0x80
+	res[3] = s.result
+	binary.BigEndian.PutUint32(res[8:], s.epoch)
+	for i := 12; i < headerSize; i++ {
+		res[i] = 0
+	}
+	if req[1] != opMap || s.result != 0 {
+		return res
+	}
+	if len(req) < headerSize+mapSize {
+		return nil
+	}
+	nonce := [12]byte(req[24:36])
+	lifetime := binary.BigEndian.Uint32(req[4:8])
+	if lifetime == 0 {
+		delete(s.mappings, nonce)
+		return res
+	}
+	port, ok := s.mappings[nonce]
+	if !ok {
+		if port = binary.BigEndian.Uint16(req[42:44]); port == 0 {
+			port = binary.BigEndian.Uint16(req[40:42])
+		}
+		s.mappings[nonce] = port
+	}
+	binary.BigEndian.PutUint16(res[42:], port)
+	ext := netip.AddrFrom4(external.As4()).As16()
+	copy(res[44:60], ext[:])
+	return res
+}
+
+func TestMapRenewDelete(t *testing.T) {
+	ctx := context.Background()
+	s, c := startServer(t)
+
+	m, err := c.AddPortMapping(ctx, "tcp", 8080, netip.AddrPort{}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := netip.AddrPortFrom(external, 8080); m.ExternalAddr != want {
+		t.Errorf("external address = %v, want %v", m.ExternalAddr, want)
+	}
+	if m.InternalAddr != netip.MustParseAddrPort("127.0.0.1:8080") || m.Lifetime != time.Hour || m.Epoch != 1000 {
+		t.Errorf("mapping = %+v", m)
+	}
+
+	s.setEpoch(1001)
+	renewed, err := c.RenewPortMapping(ctx, m, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.Nonce != m.Nonce || renewed.ExternalAddr != m.ExternalAddr || renewed.Lifetime != 2*time.Hour {
+		t.Errorf("renewed mapping = %+v, want %v for 2h", renewed, m.ExternalAddr)
+	}
+
+	if err := c.DeletePortMapping(ctx, renewed); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	n := len(s.mappings)
+	s.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d mappings left after delete", n)
+	}
+}
+
+func TestResultError(t *testing.T) {
+	s, c := startServer(t)
+	s.result = 2
+	_, err := c.AddPortMapping(context.Background(), "udp", 9000, netip.AddrPort{}, time.Hour)
+	var re *ResultError
+	if !errors.As(err, &re) || re.Code != 2 {
+		t.Fatalf("err = %v, want NOT_AUTHORIZED", err)
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	ctx := context.Background()
+	g := &fakepmp.Gateway{}
+	if err := g.Start(ctx, netip.MustParseAddr("127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { g.Close() })
+	c := &Client{Server: g.Addr(), Local: netip.MustParseAddr("127.0.0.1")}
+
+	// The 8 byte NAT-PMP reply ends the exchange at once, rather than after
+	// the retransmissions.
+	start := time.Now()
+	_, err := c.AddPortMapping(ctx, "udp", 9000, netip.AddrPort{}, time.Hour)
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("AddPortMapping: err = %v, want %v", err, ErrUnsupportedVersion)
+	}
+	if d := time.Since(start); d > irt/2 {
+		t.Errorf("AddPortMapping took %v", d)
+	}
+	if err := c.Announce(ctx); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("Announce: err = %v, want %v", err, ErrUnsupportedVersion)
+	}
+}
+
+func TestAnnounceEpochReset(t *testing.T) {
+	ctx := context.Background()
+	s, c := startServer(t)
+	m, err := c.AddPortMapping(ctx, "udp", 9000, netip.AddrPort{}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Announce(ctx); err != nil {
+		t.Fatalf("Announce with a stable epoch: %v", err)
+	}
+
+	// A reboot: the epoch restarts near zero.
+	s.setEpoch(3)
+	if err := c.Announce(ctx); !errors.Is(err, ErrEpochReset) {
+		t.Fatalf("Announce after reboot: err = %v, want %v", err, ErrEpochReset)
+	}
+	// The renewal after the reset is consistent with the new epoch.
+	if _, err := c.RenewPortMapping(ctx, m, time.Hour); err != nil {
+		t.Fatalf("RenewPortMapping after reset: %v", err)
+	}
+
+	// An epoch running far ahead of the client clock.
+	s.setEpoch(100000)
+	_, err = c.RenewPortMapping(ctx, m, time.Hour)
+	if !errors.Is(err, ErrEpochReset) {
+		t.Fatalf("RenewPortMapping after epoch jump: err = %v, want %v", err, ErrEpochReset)
+	}
+}
+
+func TestCheckEpoch(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name  string
+		epoch uint32
+		after time.Duration
+		want  bool
+	}{
+		{"same", 100, 0, true},
+		{"one back", 99, 0, true},
+		{"backwards", 50, 0, false},
+		{"in step", 700, 10 * time.Minute, true},
+		{"slow clock", 670, 10 * time.Minute, true},
+		{"too slow", 200, 10 * time.Minute, false},
+		{"too fast", 5000, 10 * time.Minute, false},
+	}
+	for _, tt := range tests {
+		var c Client
+		c.checkEpoch(100, start)
+		if got := c.checkEpoch(tt.epoch, start.Add(tt.after)); got != tt.want {
+			t.Errorf("%s: checkEpoch(%d) after %v = %v, want %v", tt.name, tt.epoch, tt.after, got, tt.want)
+		}
+	}
+}
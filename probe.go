@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/xmdhs/natupnp/natmap"
+	"github.com/xmdhs/natupnp/stun"
+)
+
+func probe(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	server := fs.String("s", strings.Split(stunAddr, ",")[0], "stun server")
+	isUDP := fs.Bool("u", udp, "probe a udp binding, the stun server must support RESPONSE-PORT")
+	minGap := fs.Duration("min", natmap.DefaultProbeMinGap, "first idle gap, doubled until the binding expires")
+	maxGap := fs.Duration("max", natmap.DefaultProbeMaxGap, "longest idle gap")
+	fs.Parse(args)
+
+	u, err := stun.ParseURI(*server)
+	if err != nil {
+		return fmt.Errorf("probe: %w", err)
+	}
+	network := "tcp"
+	if *isUDP {
+		network = "udp"
+	}
+	laddr := getLocalAddrPort()
+	p := natmap.LifetimeProbe{
+		Server: u,
+		MinGap: *minGap,
+		MaxGap: *maxGap,
+		Progress: func(gap time.Duration, alive bool) {
+			if alive {
+				fmt.Printf("idle %v: alive\n", gap)
+			} else {
+				fmt.Printf("idle %v: expired\n", gap)
+			}
+		},
+	}
+	l, err := p.Probe(ctx, network, laddr)
+	fmt.Println("binding lifetime:", l)
+	if err != nil {
+		return fmt.Errorf("probe: %w", err)
+	}
+	if l.Alive > 0 {
+		fmt.Printf("use -lifetime %v\n", l.Alive)
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package stun
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+// ErrNoOtherAddress is returned by Detect when the server does not advertise
+// an OTHER-ADDRESS, i.e. it does not support RFC 5780.
+var ErrNoOtherAddress = errors.New("server does not support RFC 5780 (no OTHER-ADDRESS)")
+
+var filteringRetransmit = Retransmit{RTO: 500 * time.Millisecond, Rc: 3, Rm: 4}
+
+type MappingBehavior int
+
+const (
+	MappingUnknown MappingBehavior = iota
+	MappingEndpointIndependent
+	MappingAddressDependent
+	MappingAddressAndPortDependent
+)
+
+func (b MappingBehavior) String() string {
+	switch b {
+	case MappingEndpointIndependent:
+		return "endpoint-independent"
+	case MappingAddressDependent:
+		return "address-dependent"
+	case MappingAddressAndPortDependent:
+		return "address-and-port-dependent"
+	default:
+		return "unknown"
+	}
+}
+
+type FilteringBehavior int
+
+const (
+	FilteringUnknown FilteringBehavior = iota
+	FilteringEndpointIndependent
+	FilteringAddressDependent
+	FilteringAddressAndPortDependent
+)
+
+func (b FilteringBehavior) String() string {
+	switch b {
+	case FilteringEndpointIndependent:
+		return "endpoint-independent"
+	case FilteringAddressDependent:
+		return "address-dependent"
+	case FilteringAddressAndPortDependent:
+		return "address-and-port-dependent"
+	default:
+		return "unknown"
+	}
+}
+
+// Behavior is the result of RFC 5780 NAT behavior discovery.
+type Behavior struct {
+	MappedAddr netip.AddrPort
+	Mapping    MappingBehavior
+	Filtering  FilteringBehavior
+}
+
+// NATType maps the behavior to the classic NAT1-NAT4 naming.
+func (b Behavior) NATType() string {
+	if b.Mapping != MappingEndpointIndependent {
+		if b.Mapping == MappingUnknown {
+			return "unknown"
+		}
+		return "NAT4 (symmetric)"
+	}
+	switch b.Filtering {
+	case FilteringEndpointIndependent:
+		return "NAT1 (full cone)"
+	case FilteringAddressDependent:
+		return "NAT2 (restricted cone)"
+	case FilteringAddressAndPortDependent:
+		return "NAT3 (port restricted cone)"
+	default:
+		return "unknown"
+	}
+}
+
+// Detect runs the RFC 5780 mapping and filtering tests from conn against the
+// STUN server at server. conn must not be connected, since the tests send to
+// the server's alternate address and receive from changed addresses.
+func Detect(ctx context.Context, conn net.PacketConn, server string) (Behavior, error) {
+	raddr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return Behavior{}, fmt.Errorf("Detect: %w", err)
+	}
+
+	// Test I: plain binding against the primary address.
+	res, err := binding(ctx, conn, raddr, false, false)
+	if err != nil {
+		return Behavior{}, fmt.Errorf("Detect: %w", err)
+	}
+	var b Behavior
+	b.MappedAddr, err = mappedAddress(res)
+	if err != nil {
+		return Behavior{}, fmt.Errorf("Detect: %w", err)
+	}
+	var other stun.OtherAddress
+	if err := other.GetFrom(res); err != nil {
+		return b, fmt.Errorf("Detect: %w", ErrNoOtherAddress)
+	}
+	otherAddr := &net.UDPAddr{IP: other.IP, Port: other.Port}
+
+	// Filtering first: the mapping tests send to the alternate IP, which
+	// would let its responses through an address-dependent filter.
+	b.Filtering, err = filteringBehavior(ctx, conn, raddr)
+	if err != nil {
+		return b, fmt.Errorf("Detect: %w", err)
+	}
+	b.Mapping, err = mappingBehavior(ctx, conn, b.MappedAddr, raddr, otherAddr)
+	if err != nil {
+		return b, fmt.Errorf("Detect: %w", err)
+	}
+	return b, nil
+}
+
+func mappingBehavior(ctx context.Context, conn net.PacketConn, mapped netip.AddrPort, primary, other *net.UDPAddr) (MappingBehavior, error) {
+	// Test II: alternate IP, primary port.
+	res, err := binding(ctx, conn, &net.UDPAddr{IP: other.IP, Port: primary.Port}, false, false)
+	if err != nil {
+		return MappingUnknown, fmt.Errorf("mappingBehavior: %w", err)
+	}
+	mapped2, err := mappedAddress(res)
+	if err != nil {
+		return MappingUnknown, fmt.Errorf("mappingBehavior: %w", err)
+	}
+	if mapped2 == mapped {
+		return MappingEndpointIndependent, nil
+	}
+
+	// Test III: alternate IP, alternate port.
+	res, err = binding(ctx, conn, other, false, false)
+	if err != nil {
+		return MappingUnknown, fmt.Errorf("mappingBehavior: %w", err)
+	}
+	mapped3, err := mappedAddress(res)
+	if err != nil {
+		return MappingUnknown, fmt.Errorf("mappingBehavior: %w", err)
+	}
+	if mapped3 == mapped2 {
+		return MappingAddressDependent, nil
+	}
+	return MappingAddressAndPortDependent, nil
+}
+
+func filteringBehavior(ctx context.Context, conn net.PacketConn, primary *net.UDPAddr) (FilteringBehavior, error) {
+	// Test II: ask the server to answer from the alternate IP and port.
+	_, err := binding(ctx, conn, primary, true, true)
+	if err == nil {
+		return FilteringEndpointIndependent, nil
+	}
+	if !errors.Is(err, ErrTimeout) {
+		return FilteringUnknown, fmt.Errorf("filteringBehavior: %w", err)
+	}
+
+	// Test III: only the port changes.
+	_, err = binding(ctx, conn, primary, false, true)
+	if err == nil {
+		return FilteringAddressDependent, nil
+	}
+	if !errors.Is(err, ErrTimeout) {
+		return FilteringUnknown, fmt.Errorf("filteringBehavior: %w", err)
+	}
+	return FilteringAddressAndPortDependent, nil
+}
+
+func binding(ctx context.Context, conn net.PacketConn, raddr net.Addr, changeIP, changePort bool) (*stun.Message, error) {
+	setters := []stun.Setter{stun.TransactionID, stun.BindingRequest}
+	if changeIP || changePort {
+		setters = append(setters, changeRequest{IP: changeIP, Port: changePort})
+	}
+	req, err := stun.Build(setters...)
+	if err != nil {
+		return nil, fmt.Errorf("binding: %w", err)
+	}
+	r := DefaultRetransmit
+	if changeIP || changePort {
+		// No response is an expected outcome of the filtering tests, so
+		// don't wait the full 39.5 s for it.
+		r = filteringRetransmit
+	}
+	res, err := roundTrip(ctx, conn, raddr, req, r)
+	if err != nil {
+		return nil, fmt.Errorf("binding: %w", err)
+	}
+	return res, nil
+}
+
+// changeRequest is the RFC 5780 CHANGE-REQUEST attribute.
+type changeRequest struct {
+	IP   bool
+	Port bool
+}
+
+func (c changeRequest) AddTo(m *stun.Message) error {
+	var v uint32
+	if c.IP {
+		v |= 0x04
+	}
+	if c.Port {
+		v |= 0x02
+	}
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	m.Add(stun.AttrChangeRequest, b)
+	return nil
+}
+
+func (c *changeRequest) GetFrom(m *stun.Message) error {
+	v, err := m.Get(stun.AttrChangeRequest)
+	if err != nil {
+		return err
+	}
+	if len(v) != 4 {
+		return fmt.Errorf("bad CHANGE-REQUEST length %d", len(v))
+	}
+	flags := binary.BigEndian.Uint32(v)
+	c.IP = flags&0x04 != 0
+	c.Port = flags&0x02 != 0
+	return nil
+}
+
+// responsePort is the RFC 5780 RESPONSE-PORT attribute.
+type responsePort uint16
+
+func (p responsePort) AddTo(m *stun.Message) error {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint16(b, uint16(p))
+	m.Add(stun.AttrResponsePort, b)
+	return nil
+}
+
+func (p *responsePort) GetFrom(m *stun.Message) error {
+	v, err := m.Get(stun.AttrResponsePort)
+	if err != nil {
+		return err
+	}
+	if len(v) != 4 {
+		return fmt.Errorf("bad RESPONSE-PORT length %d", len(v))
+	}
+	*p = responsePort(binary.BigEndian.Uint16(v))
+	return nil
+}
+
+// mappedAddress reads XOR-MAPPED-ADDRESS, falling back to MAPPED-ADDRESS for
+// RFC 3489 servers.
+func mappedAddress(m *stun.Message) (netip.AddrPort, error) {
+	var xorAddr stun.XORMappedAddress
+	if err := xorAddr.GetFrom(m); err == nil {
+		return toAddrPort(xorAddr.IP, xorAddr.Port), nil
+	}
+	var addr stun.MappedAddress
+	if err := addr.GetFrom(m); err != nil {
+		if errors.Is(err, stun.ErrAttributeNotFound) {
+			err = &MissingAttributeError{Attr: stun.AttrXORMappedAddress}
+		}
+		return netip.AddrPort{}, fmt.Errorf("mappedAddress: %w", err)
+	}
+	return toAddrPort(addr.IP, addr.Port), nil
+}
+
+func toAddrPort(ip net.IP, port int) netip.AddrPort {
+	addr, _ := netip.AddrFromSlice(ip)
+	return netip.AddrPortFrom(addr.Unmap(), uint16(port))
+}
@@ -0,0 +1,132 @@
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startServer starts a Server on loopback, with the RFC 5780 alternate
+// address on 127.0.0.2 if rfc5780 is set.
+func startServer(t *testing.T, rfc5780 bool) *Server {
+	t.Helper()
+	var other netip.AddrPort
+	if rfc5780 {
+		other = netip.MustParseAddrPort("127.0.0.2:0")
+	}
+	s := NewServer(netip.MustParseAddrPort("127.0.0.1:0"), other)
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func listenUDP(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// filterConn drops packets the way a NAT with the given filtering behavior
+// does: only packets from addresses (or addresses and ports) sent to before
+// pass.
+type filterConn struct {
+	net.PacketConn
+	filtering FilteringBehavior
+
+	mu   sync.Mutex
+	sent map[netip.AddrPort]bool
+}
+
+func (c *filterConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	if c.sent == nil {
+		c.sent = map[netip.AddrPort]bool{}
+	}
+	c.sent[unmap(addr)] = true
+	c.mu.Unlock()
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *filterConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || c.pass(unmap(addr)) {
+			return n, addr, err
+		}
+	}
+}
+
+func unmap(addr net.Addr) netip.AddrPort {
+	a := addr.(*net.UDPAddr).AddrPort()
+	return netip.AddrPortFrom(a.Addr().Unmap(), a.Port())
+}
+
+func (c *filterConn) pass(from netip.AddrPort) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for to := range c.sent {
+		switch c.filtering {
+		case FilteringAddressDependent:
+			if to.Addr() == from.Addr() {
+				return true
+			}
+		case FilteringAddressAndPortDependent:
+			if to == from {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+func TestDetect(t *testing.T) {
+	s := startServer(t, true)
+	for _, want := range []FilteringBehavior{
+		FilteringEndpointIndependent,
+		FilteringAddressDependent,
+		FilteringAddressAndPortDependent,
+	} {
+		t.Run(want.String(), func(t *testing.T) {
+			conn := listenUDP(t)
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			b, err := Detect(ctx, &filterConn{PacketConn: conn, filtering: want}, s.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b.MappedAddr != conn.LocalAddr().(*net.UDPAddr).AddrPort() {
+				t.Errorf("MappedAddr = %v, want %v", b.MappedAddr, conn.LocalAddr())
+			}
+			if b.Mapping != MappingEndpointIndependent {
+				t.Errorf("Mapping = %v, want %v", b.Mapping, MappingEndpointIndependent)
+			}
+			if b.Filtering != want {
+				t.Errorf("Filtering = %v, want %v", b.Filtering, want)
+			}
+		})
+	}
+}
+
+func TestDetectNoOtherAddress(t *testing.T) {
+	s := startServer(t, false)
+	conn := listenUDP(t)
+	b, err := Detect(context.Background(), conn, s.Addr().String())
+	if !errors.Is(err, ErrNoOtherAddress) {
+		t.Fatalf("err = %v, want %v", err, ErrNoOtherAddress)
+	}
+	if b.MappedAddr != conn.LocalAddr().(*net.UDPAddr).AddrPort() {
+		t.Errorf("MappedAddr = %v, want %v", b.MappedAddr, conn.LocalAddr())
+	}
+}
@@ -0,0 +1,233 @@
+package stun
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DialFunc dials a STUN server, usually from the reused local port.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// ErrNoServer is returned when every server in the pool failed.
+var ErrNoServer = errors.New("no stun server available")
+
+const (
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+)
+
+// Mapping is a mapped address as seen by one server.
+type Mapping struct {
+	Addr   netip.AddrPort
+	Server string
+	RTT    time.Duration
+}
+
+// MismatchError reports servers that saw different mapped addresses for the
+// same local port, which means the NAT is not a cone NAT.
+type MismatchError struct {
+	Mappings []Mapping
+}
+
+func (e *MismatchError) Error() string {
+	s := make([]string, 0, len(e.Mappings))
+	for _, m := range e.Mappings {
+		s = append(s, m.Server+" -> "+m.Addr.String())
+	}
+	return "mapped address mismatch, NAT is probably not a cone NAT: " + strings.Join(s, ", ")
+}
+
+// Pool is a set of STUN servers. Servers are tried in order of measured RTT,
+// and servers that fail are skipped with exponential backoff.
+type Pool struct {
+	// Parallel is the number of servers queried at once. Answers from
+	// these servers are compared to detect non-cone NATs. Defaults to 2.
+	Parallel int
+	// Timeout bounds each query, so one silent server doesn't hold up
+	// the others. Defaults to 5 s.
+	Timeout time.Duration
+	// OnMismatch, if set, is called with a *MismatchError when servers
+	// disagree about the mapped address.
+	OnMismatch func(error)
+	// TLSConfig is used for stuns servers, over TLS and DTLS. May be nil.
+	TLSConfig *tls.Config
+
+	mu      sync.Mutex
+	servers []*server
+}
+
+type server struct {
+	uri      URI
+	rtt      time.Duration
+	failures int
+	retryAt  time.Time
+}
+
+// NewPool parses each server with ParseURI and returns a pool of them.
+func NewPool(servers ...string) (*Pool, error) {
+	p := &Pool{Parallel: 2, Timeout: 5 * time.Second}
+	for _, v := range servers {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		u, err := ParseURI(v)
+		if err != nil {
+			return nil, fmt.Errorf("NewPool: %w", err)
+		}
+		p.servers = append(p.servers, &server{uri: u})
+	}
+	if len(p.servers) == 0 {
+		return nil, fmt.Errorf("NewPool: %w", ErrNoServer)
+	}
+	return p, nil
+}
+
+// Servers returns the servers in the pool.
+func (p *Pool) Servers() []URI {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l := make([]URI, 0, len(p.servers))
+	for _, v := range p.servers {
+		l = append(l, v.uri)
+	}
+	return l
+}
+
+// MappedAddress queries the healthiest servers over network, dialing them with
+// dial, and returns the answer of the fastest one.
+func (p *Pool) MappedAddress(ctx context.Context, network string, dial DialFunc) (Mapping, error) {
+	candidates := p.candidates()
+	if len(candidates) == 0 {
+		return Mapping{}, fmt.Errorf("MappedAddress: %w", ErrNoServer)
+	}
+	parallel := p.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	var errs error
+	for len(candidates) > 0 {
+		n := parallel
+		if n > len(candidates) {
+			n = len(candidates)
+		}
+		batch := candidates[:n]
+		candidates = candidates[n:]
+
+		mappings := make([]Mapping, n)
+		qerrs := make([]error, n)
+		var wg sync.WaitGroup
+		for i, s := range batch {
+			i, s := i, s
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				mappings[i], qerrs[i] = p.query(ctx, network, s.uri, dial)
+			}()
+		}
+		wg.Wait()
+
+		var ok []Mapping
+		for i, s := range batch {
+			if qerrs[i] != nil {
+				errs = errors.Join(errs, qerrs[i])
+				if ctx.Err() == nil {
+					p.report(s, 0, qerrs[i])
+				}
+				continue
+			}
+			p.report(s, mappings[i].RTT, nil)
+			ok = append(ok, mappings[i])
+		}
+		if len(ok) == 0 {
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		sort.SliceStable(ok, func(i, j int) bool { return ok[i].RTT < ok[j].RTT })
+		for _, v := range ok[1:] {
+			if v.Addr != ok[0].Addr {
+				if p.OnMismatch != nil {
+					p.OnMismatch(&MismatchError{Mappings: ok})
+				}
+				break
+			}
+		}
+		return ok[0], nil
+	}
+	return Mapping{}, fmt.Errorf("MappedAddress: %w", errors.Join(ErrNoServer, errs))
+}
+
+func (p *Pool) query(ctx context.Context, network string, u URI, dial DialFunc) (Mapping, error) {
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	conn, err := u.Dial(ctx, network, dial, p.TLSConfig)
+	if err != nil {
+		return Mapping{}, fmt.Errorf("%v: %w", u, err)
+	}
+	defer conn.Close()
+	xorAddr, err := GetMappedAddress(ctx, conn)
+	if err != nil {
+		return Mapping{}, fmt.Errorf("%v: %w", u, err)
+	}
+	return Mapping{
+		Addr:   toAddrPort(xorAddr.IP, xorAddr.Port),
+		Server: u.String(),
+		RTT:    time.Since(start),
+	}, nil
+}
+
+// candidates returns the servers that are not backing off, fastest first.
+// Servers without a measured RTT sort first so they get measured. If every
+// server is backing off, all of them are returned.
+func (p *Pool) candidates() []*server {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var l []*server
+	for _, v := range p.servers {
+		if !v.retryAt.After(now) {
+			l = append(l, v)
+		}
+	}
+	if len(l) == 0 {
+		l = append(l, p.servers...)
+	}
+	sort.SliceStable(l, func(i, j int) bool { return l[i].rtt < l[j].rtt })
+	return l
+}
+
+func (p *Pool) report(s *server, rtt time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		backoff := minBackoff << s.failures
+		if backoff > maxBackoff || backoff <= 0 {
+			backoff = maxBackoff
+		} else {
+			s.failures++
+		}
+		s.retryAt = time.Now().Add(backoff)
+		return
+	}
+	s.failures = 0
+	s.retryAt = time.Time{}
+	if s.rtt == 0 {
+		s.rtt = rtt
+	} else {
+		s.rtt = (7*s.rtt + rtt) / 8
+	}
+}
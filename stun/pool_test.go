@@ -0,0 +1,180 @@
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xmdhs/natupnp/reuse"
+)
+
+// deadAddr returns a loopback address nothing listens on.
+func deadAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	return l.Addr().String()
+}
+
+// recordDial dials like net.Dialer and records the addresses dialed.
+type recordDial struct {
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (r *recordDial) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	r.mu.Lock()
+	r.addrs = append(r.addrs, addr)
+	r.mu.Unlock()
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+func (r *recordDial) take() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l := r.addrs
+	r.addrs = nil
+	return l
+}
+
+func TestPoolOrder(t *testing.T) {
+	a, b := startServer(t, false).Addr().String(), startServer(t, false).Addr().String()
+	dead := deadAddr(t)
+	p, err := NewPool(a, b, dead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.servers[0].rtt = 20 * time.Millisecond
+	p.servers[1].rtt = 10 * time.Millisecond
+
+	// dead has no RTT yet, so it is measured first.
+	var order []string
+	for _, s := range p.candidates() {
+		order = append(order, s.uri.String())
+	}
+	want := []string{"stun:" + dead, "stun:" + b, "stun:" + a}
+	if len(order) != 3 || order[0] != want[0] || order[1] != want[1] || order[2] != want[2] {
+		t.Fatalf("candidates = %v, want %v", order, want)
+	}
+
+	p.Parallel = 1
+	var r recordDial
+	m, err := p.MappedAddress(context.Background(), "tcp", r.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Server != "stun:"+b {
+		t.Errorf("answered by %v, want the fastest %v", m.Server, b)
+	}
+	if got := r.take(); len(got) != 2 || got[0] != dead || got[1] != b {
+		t.Errorf("dialed %v, want %v then %v", got, dead, b)
+	}
+}
+
+func TestPoolBackoff(t *testing.T) {
+	a := startServer(t, false).Addr().String()
+	dead := deadAddr(t)
+	p, err := NewPool(dead, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Parallel = 1
+	var r recordDial
+	query := func() []string {
+		t.Helper()
+		if _, err := p.MappedAddress(context.Background(), "tcp", r.dial); err != nil {
+			t.Fatal(err)
+		}
+		return r.take()
+	}
+
+	if got := query(); len(got) != 2 || got[0] != dead {
+		t.Fatalf("dialed %v, want %v then %v", got, dead, a)
+	}
+	if got := query(); len(got) != 1 || got[0] != a {
+		t.Fatalf("dialed %v while %v backs off, want %v only", got, dead, a)
+	}
+	backoff := func() time.Duration {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return time.Until(p.servers[0].retryAt)
+	}
+	if d := backoff(); d <= 0 || d > minBackoff {
+		t.Errorf("backoff = %v after one failure, want up to %v", d, minBackoff)
+	}
+
+	// Once the backoff expires, dead is tried again and backs off twice as
+	// long.
+	p.mu.Lock()
+	p.servers[0].retryAt = time.Now()
+	p.mu.Unlock()
+	if got := query(); len(got) != 2 || got[0] != dead {
+		t.Fatalf("dialed %v after the backoff, want %v then %v", got, dead, a)
+	}
+	if d := backoff(); d <= minBackoff || d > 2*minBackoff {
+		t.Errorf("backoff = %v after two failures, want up to %v", d, 2*minBackoff)
+	}
+}
+
+func TestPoolAllDead(t *testing.T) {
+	p, err := NewPool(deadAddr(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r recordDial
+	for i := 0; i < 2; i++ {
+		// A pool backing off everywhere still tries.
+		if _, err := p.MappedAddress(context.Background(), "tcp", r.dial); !errors.Is(err, ErrNoServer) {
+			t.Fatalf("err = %v, want %v", err, ErrNoServer)
+		}
+	}
+	if got := r.take(); len(got) != 2 {
+		t.Errorf("dialed %v, want twice", got)
+	}
+}
+
+func TestPoolMismatch(t *testing.T) {
+	a, b := startServer(t, false).Addr().String(), startServer(t, false).Addr().String()
+	var mismatch []error
+	p, err := NewPool(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.OnMismatch = func(err error) { mismatch = append(mismatch, err) }
+
+	// From one local port both servers see the same address.
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	laddr := l.LocalAddr().String()
+	l.Close()
+	sameDial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return reuse.DialContext(ctx, network, laddr, addr)
+	}
+	m, err := p.MappedAddress(context.Background(), "udp", sameDial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Addr != netip.MustParseAddrPort(laddr) || len(mismatch) != 0 {
+		t.Fatalf("mapped %v, mismatches %v, want %v and none", m.Addr, mismatch, laddr)
+	}
+
+	// From different ports, like a symmetric NAT, they disagree.
+	var r recordDial
+	if _, err := p.MappedAddress(context.Background(), "udp", r.dial); err != nil {
+		t.Fatal(err)
+	}
+	var me *MismatchError
+	if len(mismatch) != 1 || !errors.As(mismatch[0], &me) || len(me.Mappings) != 2 || me.Mappings[0].Addr == me.Mappings[1].Addr {
+		t.Errorf("mismatches = %v, want one between two addresses", mismatch)
+	}
+}
@@ -0,0 +1,382 @@
+package stun
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+const (
+	headerSize  = 20
+	tcpIdleTime = time.Minute
+)
+
+// Server answers STUN Binding requests over UDP and TCP.
+//
+// When an alternate address is configured the server also listens on the
+// alternate IP and port combinations and implements the RFC 5780 NAT
+// behavior discovery attributes (OTHER-ADDRESS, RESPONSE-ORIGIN and
+// CHANGE-REQUEST), so it can be used as the target of Detect.
+type Server struct {
+	// Software is sent in the SOFTWARE attribute if not empty.
+	Software string
+
+	addr  netip.AddrPort
+	other netip.AddrPort
+
+	mu     sync.Mutex
+	ips    [2]netip.Addr
+	ports  [2]uint16
+	udp    [2][2]*net.UDPConn
+	tcp    []net.Listener
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewServer returns a server for addr. other is the RFC 5780 alternate
+// address; its IP and port must both differ from addr. Pass the zero value to
+// disable RFC 5780. Port 0 picks a free port.
+func NewServer(addr, other netip.AddrPort) *Server {
+	return &Server{
+		addr:  addr,
+		other: other,
+		conns: map[net.Conn]struct{}{},
+	}
+}
+
+// ListenAndServe serves until ctx is done.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	if err := s.Start(ctx); err != nil {
+		return fmt.Errorf("ListenAndServe: %w", err)
+	}
+	<-ctx.Done()
+	return s.Close()
+}
+
+// Start opens all sockets and serves in the background until Close.
+func (s *Server) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rfc5780 := s.other.IsValid()
+	if rfc5780 && (s.addr.Addr() == s.other.Addr() || s.addr.Addr().IsUnspecified() || s.other.Addr().IsUnspecified()) {
+		return fmt.Errorf("Start: alternate address needs two distinct, specified IPs")
+	}
+	if rfc5780 && s.addr.Port() != 0 && s.addr.Port() == s.other.Port() {
+		return fmt.Errorf("Start: alternate address needs a different port")
+	}
+	s.ips = [2]netip.Addr{s.addr.Addr(), s.other.Addr()}
+	s.ports = [2]uint16{s.addr.Port(), s.other.Port()}
+
+	var lc net.ListenConfig
+	n := 1
+	if rfc5780 {
+		n = 2
+	}
+	for ip := 0; ip < n; ip++ {
+		for port := 0; port < n; port++ {
+			a := netip.AddrPortFrom(s.ips[ip], s.ports[port])
+			pc, err := lc.ListenPacket(ctx, "udp", a.String())
+			if err != nil {
+				s.closeLocked()
+				return fmt.Errorf("Start: %w", err)
+			}
+			s.udp[ip][port] = pc.(*net.UDPConn)
+			if s.ports[port] == 0 {
+				s.ports[port] = pc.LocalAddr().(*net.UDPAddr).AddrPort().Port()
+				a = netip.AddrPortFrom(s.ips[ip], s.ports[port])
+			}
+			l, err := lc.Listen(ctx, "tcp", a.String())
+			if err != nil {
+				s.closeLocked()
+				return fmt.Errorf("Start: %w", err)
+			}
+			s.tcp = append(s.tcp, l)
+		}
+	}
+
+	for ip := 0; ip < n; ip++ {
+		for port := 0; port < n; port++ {
+			ip, port := ip, port
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.serveUDP(ip, port)
+			}()
+		}
+	}
+	for _, l := range s.tcp {
+		l := l
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveTCP(l)
+		}()
+	}
+	return nil
+}
+
+// ListenTLS additionally serves STUN over TLS on addr, for stuns clients.
+// Call it after Start; the listener is closed by Close. It returns the
+// address actually listened on.
+func (s *Server) ListenTLS(ctx context.Context, addr netip.AddrPort, config *tls.Config) (netip.AddrPort, error) {
+	var lc net.ListenConfig
+	l, err := lc.Listen(ctx, "tcp", addr.String())
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("ListenTLS: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		l.Close()
+		return netip.AddrPort{}, fmt.Errorf("ListenTLS: %w", net.ErrClosed)
+	}
+	s.tcp = append(s.tcp, l)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.serveTCP(tls.NewListener(l, config))
+	}()
+	return l.Addr().(*net.TCPAddr).AddrPort(), nil
+}
+
+// Addr returns the primary address the server is listening on.
+func (s *Server) Addr() netip.AddrPort {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return netip.AddrPortFrom(s.ips[0], s.ports[0])
+}
+
+// OtherAddr returns the alternate address, or the zero value without RFC 5780.
+func (s *Server) OtherAddr() netip.AddrPort {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.other.IsValid() {
+		return netip.AddrPort{}
+	}
+	return netip.AddrPortFrom(s.ips[1], s.ports[1])
+}
+
+// Close stops the server and waits for all goroutines to exit.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	err := s.closeLocked()
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) closeLocked() error {
+	s.closed = true
+	var errs error
+	for _, v := range s.udp {
+		for _, c := range v {
+			if c != nil {
+				errs = errors.Join(errs, c.Close())
+			}
+		}
+	}
+	for _, l := range s.tcp {
+		errs = errors.Join(errs, l.Close())
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return errs
+}
+
+func (s *Server) serveUDP(ip, port int) {
+	conn := s.udp[ip][port]
+	buf := make([]byte, 1500)
+	for {
+		n, raddr, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		req := new(stun.Message)
+		if err := stun.Decode(append([]byte(nil), buf[:n]...), req); err != nil {
+			continue
+		}
+		res, from, to := s.handle(req, raddr, ip, port, true)
+		if res == nil {
+			continue
+		}
+		s.udp[from[0]][from[1]].WriteToUDPAddrPort(res.Raw, to)
+	}
+}
+
+func (s *Server) serveTCP(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			c.Close()
+			return
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, c)
+				s.mu.Unlock()
+			}()
+			s.serveConn(c)
+		}()
+	}
+}
+
+// serveConn answers requests on a stream connection (TCP or TLS) until the
+// peer goes away or stays idle for too long.
+func (s *Server) serveConn(c net.Conn) {
+	defer c.Close()
+	raddr, err := netip.ParseAddrPort(c.RemoteAddr().String())
+	if err != nil {
+		return
+	}
+	header := make([]byte, headerSize)
+	for {
+		c.SetReadDeadline(time.Now().Add(tcpIdleTime))
+		if _, err := io.ReadFull(c, header); err != nil {
+			return
+		}
+		if !stun.IsMessage(header) {
+			return
+		}
+		raw := make([]byte, headerSize+int(binary.BigEndian.Uint16(header[2:4])))
+		copy(raw, header)
+		if _, err := io.ReadFull(c, raw[headerSize:]); err != nil {
+			return
+		}
+		req := new(stun.Message)
+		if err := stun.Decode(raw, req); err != nil {
+			return
+		}
+		res, _, _ := s.handle(req, raddr, 0, 0, false)
+		if res == nil {
+			continue
+		}
+		if _, err := c.Write(res.Raw); err != nil {
+			return
+		}
+	}
+}
+
+// handle builds the response for req received from raddr on the socket
+// [ip][port]. It also returns the socket the response must be sent from and
+// the address it must be sent to, which differs from raddr for the RFC 5780
+// RESPONSE-PORT attribute.
+func (s *Server) handle(req *stun.Message, raddr netip.AddrPort, ip, port int, isUDP bool) (*stun.Message, [2]int, netip.AddrPort) {
+	from := [2]int{ip, port}
+	if req.Type.Method != stun.MethodBinding {
+		return nil, from, raddr
+	}
+	if req.Type.Class != stun.ClassRequest {
+		return nil, from, raddr
+	}
+	rfc5780 := s.other.IsValid()
+
+	var unknown stun.UnknownAttributes
+	for _, a := range req.Attributes {
+		switch a.Type {
+		case stun.AttrChangeRequest, stun.AttrResponsePort, stun.AttrPadding, stun.AttrFingerprint, stun.AttrSoftware:
+		default:
+			if a.Type.Required() {
+				unknown = append(unknown, a.Type)
+			}
+		}
+	}
+	if len(unknown) > 0 {
+		return s.errorResponse(req, stun.CodeUnknownAttribute, unknown), from, raddr
+	}
+
+	var change changeRequest
+	if err := change.GetFrom(req); err == nil && (change.IP || change.Port) {
+		if !isUDP {
+			return s.errorResponse(req, stun.CodeBadRequest, nil), from, raddr
+		}
+		if !rfc5780 {
+			return s.errorResponse(req, stun.CodeUnknownAttribute, stun.UnknownAttributes{stun.AttrChangeRequest}), from, raddr
+		}
+		if change.IP {
+			from[0] ^= 1
+		}
+		if change.Port {
+			from[1] ^= 1
+		}
+	}
+
+	to := raddr
+	if req.Contains(stun.AttrResponsePort) {
+		var p responsePort
+		if err := p.GetFrom(req); err != nil || p == 0 || !isUDP {
+			return s.errorResponse(req, stun.CodeBadRequest, nil), from, raddr
+		}
+		to = netip.AddrPortFrom(raddr.Addr(), uint16(p))
+	}
+
+	setters := []stun.Setter{
+		stun.NewTransactionIDSetter(req.TransactionID),
+		stun.NewType(stun.MethodBinding, stun.ClassSuccessResponse),
+		&stun.XORMappedAddress{IP: raddr.Addr().Unmap().AsSlice(), Port: int(raddr.Port())},
+	}
+	if rfc5780 {
+		origin := netip.AddrPortFrom(s.ips[from[0]], s.ports[from[1]])
+		other := netip.AddrPortFrom(s.ips[ip^1], s.ports[port^1])
+		setters = append(setters,
+			&stun.ResponseOrigin{IP: origin.Addr().AsSlice(), Port: int(origin.Port())},
+			&stun.OtherAddress{IP: other.Addr().AsSlice(), Port: int(other.Port())},
+		)
+	}
+	if s.Software != "" {
+		setters = append(setters, stun.NewSoftware(s.Software))
+	}
+	setters = append(setters, stun.Fingerprint)
+	res, err := stun.Build(setters...)
+	if err != nil {
+		return nil, from, raddr
+	}
+	return res, from, to
+}
+
+func (s *Server) errorResponse(req *stun.Message, code stun.ErrorCode, unknown stun.UnknownAttributes) *stun.Message {
+	setters := []stun.Setter{
+		stun.NewTransactionIDSetter(req.TransactionID),
+		stun.NewType(stun.MethodBinding, stun.ClassErrorResponse),
+		code,
+	}
+	if len(unknown) > 0 {
+		setters = append(setters, unknown)
+	}
+	if s.Software != "" {
+		setters = append(setters, stun.NewSoftware(s.Software))
+	}
+	setters = append(setters, stun.Fingerprint)
+	res, err := stun.Build(setters...)
+	if err != nil {
+		return nil
+	}
+	return res
+}
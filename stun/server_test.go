@@ -0,0 +1,131 @@
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/pion/stun"
+)
+
+func TestServerBinding(t *testing.T) {
+	s := startServer(t, false)
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			conn, err := net.Dial(network, s.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			addr, err := GetMappedAddress(context.Background(), conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := toAddrPort(addr.IP, addr.Port)
+			want := netip.MustParseAddrPort(conn.LocalAddr().String())
+			if got != want {
+				t.Errorf("mapped address = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestServerOtherAddress(t *testing.T) {
+	s := startServer(t, true)
+	conn := listenUDP(t)
+	res, err := binding(context.Background(), conn, net.UDPAddrFromAddrPort(s.Addr()), false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var origin stun.ResponseOrigin
+	if err := origin.GetFrom(res); err != nil {
+		t.Fatal(err)
+	}
+	want := netip.AddrPortFrom(s.Addr().Addr(), s.OtherAddr().Port())
+	if got := toAddrPort(origin.IP, origin.Port); got != want {
+		t.Errorf("RESPONSE-ORIGIN = %v, want %v", got, want)
+	}
+	var other stun.OtherAddress
+	if err := other.GetFrom(res); err != nil {
+		t.Fatal(err)
+	}
+	if got := toAddrPort(other.IP, other.Port); got != s.OtherAddr() {
+		t.Errorf("OTHER-ADDRESS = %v, want %v", got, s.OtherAddr())
+	}
+}
+
+func TestServerChangeRequestErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		rfc5780 bool
+		network string
+		code    stun.ErrorCode
+	}{
+		{"no alternate address", false, "udp", stun.CodeUnknownAttribute},
+		{"tcp", true, "tcp", stun.CodeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startServer(t, tt.rfc5780)
+			conn, err := net.Dial(tt.network, s.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			req := stun.MustBuild(stun.TransactionID, stun.BindingRequest, changeRequest{Port: true})
+			if tt.network == "tcp" {
+				_, err = roundTripStream(context.Background(), conn, req)
+			} else {
+				_, err = roundTrip(context.Background(), connPacketConn{conn}, conn.RemoteAddr(), req, DefaultRetransmit)
+			}
+			var re *ErrorResponse
+			if !errors.As(err, &re) || re.Code != tt.code {
+				t.Fatalf("err = %v, want error response %d", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestServerResponsePort(t *testing.T) {
+	s := startServer(t, false)
+	dial := func() net.Conn {
+		conn, err := net.Dial("udp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	conn, recv := dial(), dial()
+	port := netip.MustParseAddrPort(recv.LocalAddr().String()).Port()
+
+	addr, err := ResponsePortBinding(context.Background(), conn, port, recv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := netip.MustParseAddrPort(conn.LocalAddr().String()); addr != want {
+		t.Errorf("mapped address = %v, want %v", addr, want)
+	}
+
+	// The response goes to port, so conn never sees it.
+	if _, err := ResponsePortBinding(context.Background(), conn, port, conn); !errors.Is(err, ErrTimeout) {
+		t.Errorf("err = %v reading on conn, want %v", err, ErrTimeout)
+	}
+}
+
+func TestServerResponsePortTCP(t *testing.T) {
+	s := startServer(t, false)
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req := stun.MustBuild(stun.TransactionID, stun.BindingRequest, responsePort(1234))
+	_, err = roundTripStream(context.Background(), conn, req)
+	var re *ErrorResponse
+	if !errors.As(err, &re) || re.Code != stun.CodeBadRequest {
+		t.Fatalf("err = %v, want error response %d", err, stun.CodeBadRequest)
+	}
+}
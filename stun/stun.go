@@ -2,34 +2,59 @@ package stun
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/netip"
 
 	"github.com/pion/stun"
 )
 
-func GetMappedAddress(ctx context.Context, coon stun.Connection) (stun.XORMappedAddress, error) {
-	c, err := stun.NewClient(coon)
+// GetMappedAddress does a Binding transaction over conn. Datagram conns use
+// DefaultRetransmit, stream conns wait TCPTimeout; ctx may cut either short.
+func GetMappedAddress(ctx context.Context, conn net.Conn) (stun.XORMappedAddress, error) {
+	req, err := stun.Build(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
 	if err != nil {
 		return stun.XORMappedAddress{}, fmt.Errorf("GetMappedAddress: %w", err)
 	}
-	defer c.Close()
-
-	var eErr error
-	var xorAddr stun.XORMappedAddress
-	if err = c.Do(stun.MustBuild(stun.TransactionID, stun.BindingRequest), func(res stun.Event) {
-		if res.Error != nil {
-			eErr = res.Error
-			return
-		}
-		if getErr := xorAddr.GetFrom(res.Message); getErr != nil {
-			eErr = getErr
-			return
-		}
-	}); err != nil {
+	var res *stun.Message
+	if isStream(conn) {
+		res, err = roundTripStream(ctx, conn, req)
+	} else {
+		res, err = roundTrip(ctx, connPacketConn{conn}, conn.RemoteAddr(), req, DefaultRetransmit)
+	}
+	if err != nil {
 		return stun.XORMappedAddress{}, fmt.Errorf("GetMappedAddress: %w", err)
 	}
-	if eErr != nil {
-		return stun.XORMappedAddress{}, fmt.Errorf("GetMappedAddress: %w", eErr)
+	addr, err := mappedAddress(res)
+	if err != nil {
+		return stun.XORMappedAddress{}, fmt.Errorf("GetMappedAddress: %w", err)
+	}
+	return stun.XORMappedAddress{IP: addr.Addr().AsSlice(), Port: int(addr.Port())}, nil
+}
+
+// ResponsePortBinding does a Binding transaction over the datagram conn with
+// the RFC 5780 RESPONSE-PORT attribute, asking the server to send the
+// response to port at the source address of the request. The response is
+// read from recv, e.g. another socket whose binding has that port, or conn
+// itself. No response is an expected outcome, so it gives up sooner than
+// GetMappedAddress, with an error wrapping ErrTimeout. It returns the mapped
+// address of conn.
+func ResponsePortBinding(ctx context.Context, conn net.Conn, port uint16, recv net.Conn) (netip.AddrPort, error) {
+	if isStream(conn) || isStream(recv) {
+		return netip.AddrPort{}, errors.New("ResponsePortBinding: RESPONSE-PORT needs udp")
+	}
+	req, err := stun.Build(stun.TransactionID, stun.BindingRequest, responsePort(port), stun.Fingerprint)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("ResponsePortBinding: %w", err)
+	}
+	res, err := roundTripVia(ctx, connPacketConn{conn}, connPacketConn{recv}, conn.RemoteAddr(), req, filteringRetransmit)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("ResponsePortBinding: %w", err)
+	}
+	addr, err := mappedAddress(res)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("ResponsePortBinding: %w", err)
 	}
-	return xorAddr, nil
+	return addr, nil
 }
@@ -0,0 +1,227 @@
+package stun
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+// ErrTimeout is returned when a transaction got no response after all
+// retransmissions (UDP) or within the transaction timeout (TCP).
+var ErrTimeout = errors.New("stun transaction timed out")
+
+var errNotSTUN = errors.New("not a stun message")
+
+// ErrorResponse is a STUN error response from the server.
+type ErrorResponse struct {
+	Code   stun.ErrorCode
+	Reason string
+}
+
+func (e *ErrorResponse) Error() string {
+	return fmt.Sprintf("stun error response: %d %s", e.Code, e.Reason)
+}
+
+// MissingAttributeError is returned when a response lacks a required
+// attribute.
+type MissingAttributeError struct {
+	Attr stun.AttrType
+}
+
+func (e *MissingAttributeError) Error() string {
+	return fmt.Sprintf("stun response missing attribute %v", e.Attr)
+}
+
+// Retransmit is the RFC 8489 section 6.2.1 retransmission schedule for
+// unreliable transports. A request is sent Rc times, the interval starting at
+// RTO and doubling each time. After the last request the client waits Rm
+// times RTO before giving up.
+type Retransmit struct {
+	RTO time.Duration
+	Rc  int
+	Rm  int
+}
+
+// DefaultRetransmit is the schedule recommended by RFC 8489, 39.5 s in total.
+var DefaultRetransmit = Retransmit{RTO: 500 * time.Millisecond, Rc: 7, Rm: 16}
+
+// TCPTimeout is the RFC 8489 transaction timeout Ti for reliable transports.
+var TCPTimeout = 39500 * time.Millisecond
+
+// aLongTimeAgo is a deadline in the past, used to interrupt blocked reads.
+var aLongTimeAgo = time.Unix(1, 0)
+
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// interruptOnDone makes blocked I/O on conn return once ctx is done. Callers
+// must check ctx.Err() after every deadline they set, and call the returned
+// function before resetting the deadline for good.
+func interruptOnDone(ctx context.Context, conn deadliner) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// roundTrip sends req to raddr over conn and waits for the response with the
+// same transaction ID, retransmitting on schedule r. Responses may come from
+// any source address, which is what the RFC 5780 CHANGE-REQUEST tests rely
+// on.
+func roundTrip(ctx context.Context, conn net.PacketConn, raddr net.Addr, req *stun.Message, r Retransmit) (*stun.Message, error) {
+	return roundTripVia(ctx, conn, conn, raddr, req, r)
+}
+
+// roundTripVia is roundTrip with the requests sent over conn and the
+// response read from recv, for the RFC 5780 RESPONSE-PORT attribute.
+func roundTripVia(ctx context.Context, conn, recv net.PacketConn, raddr net.Addr, req *stun.Message, r Retransmit) (*stun.Message, error) {
+	defer recv.SetDeadline(time.Time{})
+	stop := interruptOnDone(ctx, recv)
+	defer stop()
+
+	buf := make([]byte, 1500)
+	interval := r.RTO
+	for i := 0; i < r.Rc; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("roundTripVia: %w", err)
+		}
+		if _, err := conn.WriteTo(req.Raw, raddr); err != nil {
+			return nil, fmt.Errorf("roundTripVia: %w", err)
+		}
+		wait := interval
+		if i == r.Rc-1 {
+			wait = time.Duration(r.Rm) * r.RTO
+		}
+		interval *= 2
+		recv.SetReadDeadline(time.Now().Add(wait))
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("roundTripVia: %w", err)
+		}
+		for {
+			n, _, err := recv.ReadFrom(buf)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, fmt.Errorf("roundTripVia: %w", ctx.Err())
+				}
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() {
+					break
+				}
+				return nil, fmt.Errorf("roundTripVia: %w", err)
+			}
+			res := new(stun.Message)
+			if err := stun.Decode(append([]byte(nil), buf[:n]...), res); err != nil {
+				continue
+			}
+			if res.TransactionID != req.TransactionID {
+				continue
+			}
+			if err := checkResponse(res); err != nil {
+				return nil, fmt.Errorf("roundTripVia: %w", err)
+			}
+			return res, nil
+		}
+	}
+	return nil, fmt.Errorf("roundTripVia: %w", ErrTimeout)
+}
+
+// roundTripStream does a transaction over a reliable, connected transport
+// such as TCP or TLS. The request is sent once and the response is awaited
+// for TCPTimeout.
+func roundTripStream(ctx context.Context, conn net.Conn, req *stun.Message) (*stun.Message, error) {
+	defer conn.SetDeadline(time.Time{})
+	stop := interruptOnDone(ctx, conn)
+	defer stop()
+
+	conn.SetDeadline(time.Now().Add(TCPTimeout))
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("roundTripStream: %w", err)
+	}
+	if _, err := conn.Write(req.Raw); err != nil {
+		return nil, fmt.Errorf("roundTripStream: %w", streamErr(ctx, err))
+	}
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return nil, fmt.Errorf("roundTripStream: %w", streamErr(ctx, err))
+		}
+		if !stun.IsMessage(header) {
+			return nil, fmt.Errorf("roundTripStream: %w", errNotSTUN)
+		}
+		raw := make([]byte, headerSize+int(binary.BigEndian.Uint16(header[2:4])))
+		copy(raw, header)
+		if _, err := io.ReadFull(conn, raw[headerSize:]); err != nil {
+			return nil, fmt.Errorf("roundTripStream: %w", streamErr(ctx, err))
+		}
+		res := new(stun.Message)
+		if err := stun.Decode(raw, res); err != nil {
+			return nil, fmt.Errorf("roundTripStream: %w", err)
+		}
+		if res.TransactionID != req.TransactionID {
+			continue
+		}
+		if err := checkResponse(res); err != nil {
+			return nil, fmt.Errorf("roundTripStream: %w", err)
+		}
+		return res, nil
+	}
+}
+
+func streamErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return ErrTimeout
+	}
+	return err
+}
+
+func checkResponse(res *stun.Message) error {
+	if res.Type.Class != stun.ClassErrorResponse {
+		return nil
+	}
+	var code stun.ErrorCodeAttribute
+	if err := code.GetFrom(res); err != nil {
+		return &MissingAttributeError{Attr: stun.AttrErrorCode}
+	}
+	return &ErrorResponse{Code: code.Code, Reason: string(code.Reason)}
+}
+
+// isStream reports whether conn is a reliable transport.
+func isStream(conn net.Conn) bool {
+	return !strings.HasPrefix(conn.LocalAddr().Network(), "udp")
+}
+
+// connPacketConn adapts a connected datagram net.Conn to net.PacketConn.
+type connPacketConn struct {
+	net.Conn
+}
+
+func (c connPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, err := c.Read(p)
+	return n, c.RemoteAddr(), err
+}
+
+func (c connPacketConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	return c.Write(p)
+}
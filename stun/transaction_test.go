@@ -0,0 +1,223 @@
+package stun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+// responder serves udp on loopback, answering every request with the packets
+// f returns, and records when requests arrived.
+type responder struct {
+	conn net.PacketConn
+	f    func(req *stun.Message) [][]byte
+
+	mu   sync.Mutex
+	seen []time.Time
+}
+
+func startResponder(t *testing.T, f func(req *stun.Message) [][]byte) *responder {
+	t.Helper()
+	r := &responder{conn: listenUDP(t), f: f}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := r.conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			r.seen = append(r.seen, time.Now())
+			r.mu.Unlock()
+			req := new(stun.Message)
+			if err := stun.Decode(append([]byte(nil), buf[:n]...), req); err != nil || f == nil {
+				continue
+			}
+			for _, p := range f(req) {
+				r.conn.WriteTo(p, addr)
+			}
+		}
+	}()
+	return r
+}
+
+func (r *responder) arrivals() []time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]time.Time(nil), r.seen...)
+}
+
+func (r *responder) roundTrip(t *testing.T, ctx context.Context, retransmit Retransmit) (*stun.Message, error) {
+	conn := listenUDP(t)
+	req := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	return roundTrip(ctx, conn, r.conn.LocalAddr(), req, retransmit)
+}
+
+func TestRoundTripRetransmit(t *testing.T) {
+	r := startResponder(t, nil)
+	retransmit := Retransmit{RTO: 40 * time.Millisecond, Rc: 4, Rm: 8}
+	start := time.Now()
+	_, err := r.roundTrip(t, context.Background(), retransmit)
+	elapsed := time.Since(start)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("err = %v, want %v", err, ErrTimeout)
+	}
+
+	// Sent at 0, 40, 120 and 280ms, then waited 8 RTO.
+	if want := 280*time.Millisecond + 8*retransmit.RTO; elapsed < want || elapsed > want+200*time.Millisecond {
+		t.Errorf("gave up after %v, want %v", elapsed, want)
+	}
+	seen := r.arrivals()
+	if len(seen) != retransmit.Rc {
+		t.Fatalf("%d requests, want %d", len(seen), retransmit.Rc)
+	}
+	want := retransmit.RTO
+	for i := 1; i < len(seen); i++ {
+		if gap := seen[i].Sub(seen[i-1]); gap < want-5*time.Millisecond || gap > want+50*time.Millisecond {
+			t.Errorf("request %d after %v, want %v", i, gap, want)
+		}
+		want *= 2
+	}
+}
+
+func TestRoundTripContext(t *testing.T) {
+	r := startResponder(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := r.roundTrip(t, ctx, DefaultRetransmit)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 300*time.Millisecond {
+		t.Errorf("returned after %v, want soon after the deadline", d)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := r.roundTrip(t, ctx, DefaultRetransmit); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestRoundTripStreamTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		// Accept and stay silent.
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	req := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+
+	defer func(d time.Duration) { TCPTimeout = d }(TCPTimeout)
+	TCPTimeout = 100 * time.Millisecond
+	if _, err := roundTripStream(context.Background(), dial(), req); !errors.Is(err, ErrTimeout) {
+		t.Errorf("err = %v, want %v", err, ErrTimeout)
+	}
+
+	TCPTimeout = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := roundTripStream(ctx, dial(), req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestRoundTripResponses(t *testing.T) {
+	build := func(setters ...stun.Setter) []byte {
+		return stun.MustBuild(setters...).Raw
+	}
+	errorResponse := stun.NewType(stun.MethodBinding, stun.ClassErrorResponse)
+	tests := []struct {
+		name    string
+		respond func(req *stun.Message) [][]byte
+		check   func(t *testing.T, res *stun.Message, err error)
+	}{
+		{
+			name: "error response",
+			respond: func(req *stun.Message) [][]byte {
+				return [][]byte{build(req, errorResponse, stun.CodeStaleNonce)}
+			},
+			check: func(t *testing.T, _ *stun.Message, err error) {
+				var re *ErrorResponse
+				if !errors.As(err, &re) || re.Code != stun.CodeStaleNonce || re.Reason != "Stale Nonce" {
+					t.Errorf("err = %v, want error response %d", err, stun.CodeStaleNonce)
+				}
+			},
+		},
+		{
+			name: "error response without code",
+			respond: func(req *stun.Message) [][]byte {
+				return [][]byte{build(req, errorResponse)}
+			},
+			check: func(t *testing.T, _ *stun.Message, err error) {
+				var me *MissingAttributeError
+				if !errors.As(err, &me) || me.Attr != stun.AttrErrorCode {
+					t.Errorf("err = %v, want missing %v", err, stun.AttrErrorCode)
+				}
+			},
+		},
+		{
+			name: "no mapped address",
+			respond: func(req *stun.Message) [][]byte {
+				return [][]byte{build(req, stun.BindingSuccess)}
+			},
+			check: func(t *testing.T, res *stun.Message, err error) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				var me *MissingAttributeError
+				if _, err := mappedAddress(res); !errors.As(err, &me) || me.Attr != stun.AttrXORMappedAddress {
+					t.Errorf("err = %v, want missing %v", err, stun.AttrXORMappedAddress)
+				}
+			},
+		},
+		{
+			name: "other transaction and garbage first",
+			respond: func(req *stun.Message) [][]byte {
+				return [][]byte{
+					[]byte("not stun"),
+					build(stun.TransactionID, stun.BindingSuccess, &stun.XORMappedAddress{IP: net.IPv4(1, 1, 1, 1), Port: 1}),
+					build(req, stun.BindingSuccess, &stun.XORMappedAddress{IP: net.IPv4(2, 2, 2, 2), Port: 2}),
+				}
+			},
+			check: func(t *testing.T, res *stun.Message, err error) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if addr, err := mappedAddress(res); err != nil || addr.String() != "2.2.2.2:2" {
+					t.Errorf("mapped address = %v, %v, want the one of the request", addr, err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := startResponder(t, tt.respond)
+			res, err := r.roundTrip(t, context.Background(), Retransmit{RTO: 100 * time.Millisecond, Rc: 2, Rm: 2})
+			tt.check(t, res, err)
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package stun
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/stun"
+)
+
+const (
+	DefaultPort       = 3478
+	DefaultSecurePort = 5349
+)
+
+// URI is a STUN server as described by RFC 7064.
+//
+// A stun URI is used over plain UDP or TCP. A stuns URI is used over TLS when
+// mapping a TCP port and over DTLS when mapping a UDP port, so the binding
+// still comes from the mapped local port.
+type URI struct {
+	Secure bool
+	Host   string
+	Port   int
+}
+
+// ParseURI parses stun:host[:port] and stuns:host[:port]. For compatibility a
+// bare host[:port] is read as a stun URI.
+func ParseURI(raw string) (URI, error) {
+	raw = strings.TrimSpace(raw)
+	if !strings.HasPrefix(raw, "stun:") && !strings.HasPrefix(raw, "stuns:") {
+		if strings.Contains(raw, "://") || strings.HasPrefix(raw, "turn:") || strings.HasPrefix(raw, "turns:") {
+			return URI{}, fmt.Errorf("ParseURI: %w: %v", stun.ErrSchemeType, raw)
+		}
+		host, port, err := net.SplitHostPort(raw)
+		if err != nil {
+			host, port = strings.Trim(raw, "[]"), strconv.Itoa(DefaultPort)
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil || p <= 0 || p > 65535 {
+			return URI{}, fmt.Errorf("ParseURI: %w: %v", stun.ErrPort, raw)
+		}
+		if host == "" {
+			return URI{}, fmt.Errorf("ParseURI: %w: %v", stun.ErrHost, raw)
+		}
+		return URI{Host: host, Port: p}, nil
+	}
+	u, err := stun.ParseURI(raw)
+	if err != nil {
+		return URI{}, fmt.Errorf("ParseURI: %w", err)
+	}
+	return URI{
+		Secure: u.Scheme == stun.SchemeTypeSTUNS,
+		Host:   u.Host,
+		Port:   u.Port,
+	}, nil
+}
+
+// Addr returns host:port for dialing.
+func (u URI) Addr() string {
+	return net.JoinHostPort(u.Host, strconv.Itoa(u.Port))
+}
+
+func (u URI) String() string {
+	scheme := "stun:"
+	if u.Secure {
+		scheme = "stuns:"
+	}
+	return scheme + u.Addr()
+}
+
+// Dial connects to the server over network with dial and, for a stuns URI,
+// wraps the connection in TLS or DTLS, see secure.
+func (u URI) Dial(ctx context.Context, network string, dial DialFunc, config *tls.Config) (net.Conn, error) {
+	conn, err := dial(ctx, network, u.Addr())
+	if err != nil {
+		return nil, fmt.Errorf("Dial: %w", err)
+	}
+	if !u.Secure {
+		return conn, nil
+	}
+	sc, err := u.secure(ctx, conn, config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Dial: %w", err)
+	}
+	return sc, nil
+}
+
+// secure wraps conn in TLS (stream conns) or DTLS (datagram conns) for a
+// stuns URI. config may be nil; its RootCAs and InsecureSkipVerify are also
+// used for DTLS.
+func (u URI) secure(ctx context.Context, conn net.Conn, config *tls.Config) (net.Conn, error) {
+	var c *tls.Config
+	if config != nil {
+		c = config.Clone()
+	} else {
+		c = &tls.Config{}
+	}
+	if c.ServerName == "" {
+		c.ServerName = u.Host
+	}
+	if isStream(conn) {
+		tc := tls.Client(conn, c)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return nil, fmt.Errorf("secure: %w", err)
+		}
+		return tc, nil
+	}
+	dc, err := dtls.ClientWithContext(ctx, conn, &dtls.Config{
+		ServerName:         c.ServerName,
+		RootCAs:            c.RootCAs,
+		Certificates:       c.Certificates,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("secure: %w", err)
+	}
+	return dc, nil
+}
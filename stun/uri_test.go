@@ -0,0 +1,114 @@
+package stun
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestParseURI(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want URI
+	}{
+		{"stun:example.com", URI{Host: "example.com", Port: DefaultPort}},
+		{"stun:example.com:3479", URI{Host: "example.com", Port: 3479}},
+		{"stuns:example.com", URI{Secure: true, Host: "example.com", Port: DefaultSecurePort}},
+		{"stuns:[2001:db8::1]:443", URI{Secure: true, Host: "2001:db8::1", Port: 443}},
+		{"example.com", URI{Host: "example.com", Port: DefaultPort}},
+		{"example.com:19302", URI{Host: "example.com", Port: 19302}},
+		{"[2001:db8::1]", URI{Host: "2001:db8::1", Port: DefaultPort}},
+	}
+	for _, tt := range tests {
+		got, err := ParseURI(tt.raw)
+		if err != nil {
+			t.Errorf("ParseURI(%q): %v", tt.raw, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseURI(%q) = %+v, want %+v", tt.raw, got, tt.want)
+		}
+	}
+	for _, raw := range []string{"turn:example.com", "http://example.com", "example.com:0", ":3478"} {
+		if _, err := ParseURI(raw); err == nil {
+			t.Errorf("ParseURI(%q) succeeded", raw)
+		}
+	}
+}
+
+// selfSigned returns a certificate for 127.0.0.1 and a pool trusting it.
+func selfSigned(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "stun test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, roots
+}
+
+func TestPoolSTUNS(t *testing.T) {
+	s := startServer(t, false)
+	cert, roots := selfSigned(t)
+	addr, err := s.ListenTLS(context.Background(), netip.MustParseAddrPort("127.0.0.1:0"), &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPool("stuns:" + addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var local netip.AddrPort
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, addr)
+		if err == nil {
+			local = netip.MustParseAddrPort(conn.LocalAddr().String())
+		}
+		return conn, err
+	}
+
+	if _, err := p.MappedAddress(context.Background(), "tcp", dial); err == nil {
+		t.Fatal("MappedAddress succeeded without trusting the server certificate")
+	}
+
+	p, _ = NewPool("stuns:" + addr.String())
+	p.TLSConfig = &tls.Config{RootCAs: roots}
+	m, err := p.MappedAddress(context.Background(), "tcp", dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Addr != local {
+		t.Errorf("mapped address = %v, want %v", m.Addr, local)
+	}
+	if want := "stuns:" + addr.String(); m.Server != want {
+		t.Errorf("Server = %v, want %v", m.Server, want)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/xmdhs/natupnp/stun"
+)
+
+func stunServer(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("stun-server", flag.ExitOnError)
+	listen := fs.String("listen", "0.0.0.0:3478", "listen addr")
+	other := fs.String("other", "", "RFC 5780 alternate addr, ip and port must differ from -listen")
+	tlsListen := fs.String("tls", "", "also serve stuns over tls on this addr, e.g. 0.0.0.0:5349")
+	cert := fs.String("cert", "", "tls certificate file")
+	key := fs.String("key", "", "tls key file")
+	fs.Parse(args)
+
+	addr, err := netip.ParseAddrPort(*listen)
+	if err != nil {
+		return fmt.Errorf("stunServer: %w", err)
+	}
+	var otherAddr netip.AddrPort
+	if *other != "" {
+		otherAddr, err = netip.ParseAddrPort(*other)
+		if err != nil {
+			return fmt.Errorf("stunServer: %w", err)
+		}
+	}
+
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	s := stun.NewServer(addr, otherAddr)
+	s.Software = "github.com/xmdhs/natupnp"
+	if err := s.Start(ctx); err != nil {
+		return fmt.Errorf("stunServer: %w", err)
+	}
+	if *tlsListen != "" {
+		if err := serveTLS(ctx, s, *tlsListen, *cert, *key); err != nil {
+			s.Close()
+			return fmt.Errorf("stunServer: %w", err)
+		}
+	}
+	log.Println("stun server listening on", s.Addr())
+	if o := s.OtherAddr(); o.IsValid() {
+		log.Println("alternate address", o)
+	}
+	<-ctx.Done()
+	return s.Close()
+}
+
+func serveTLS(ctx context.Context, s *stun.Server, listen, cert, key string) error {
+	addr, err := netip.ParseAddrPort(listen)
+	if err != nil {
+		return fmt.Errorf("serveTLS: %w", err)
+	}
+	c, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return fmt.Errorf("serveTLS: %w", err)
+	}
+	addr, err = s.ListenTLS(ctx, addr, &tls.Config{Certificates: []tls.Certificate{c}})
+	if err != nil {
+		return fmt.Errorf("serveTLS: %w", err)
+	}
+	log.Println("stuns (tls) listening on", addr)
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/xmdhs/natupnp/natmap"
+	"github.com/xmdhs/natupnp/upnp"
+)
+
+func upnpCommand(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("upnpCommand: usage: natupnp upnp list|add|delete [flags]")
+	}
+	var err error
+	switch args[0] {
+	case "list":
+		err = upnpList(ctx, args[1:])
+	case "add":
+		err = upnpAdd(ctx, args[1:])
+	case "delete":
+		err = upnpDelete(ctx, args[1:])
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+	if err != nil {
+		return fmt.Errorf("upnpCommand: %w", err)
+	}
+	return nil
+}
+
+// gatewayOptions pins the upnp gateway by UDN or location url, and by
+// interface.
+func gatewayOptions(gateway, iface string) []upnp.Option {
+	var opts []upnp.Option
+	switch {
+	case strings.Contains(gateway, "://"):
+		opts = append(opts, upnp.WithLocation(gateway))
+	case gateway != "":
+		opts = append(opts, upnp.WithUDN(gateway))
+	}
+	if iface != "" {
+		opts = append(opts, upnp.WithInterface(iface))
+	}
+	return opts
+}
+
+// parseUpstream parses the -upstream flag, an ip with an optional port that
+// defaults to the SSDP port. The empty string is the zero value, letting
+// Gateway.Upstream guess it.
+func parseUpstream(s string) (netip.AddrPort, error) {
+	if s == "" {
+		return netip.AddrPort{}, nil
+	}
+	up, err := netip.ParseAddrPort(s)
+	if err != nil {
+		ip, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.AddrPort{}, fmt.Errorf("parseUpstream: %w", err)
+		}
+		up = netip.AddrPortFrom(ip, 1900)
+	}
+	return up, nil
+}
+
+func upnpList(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("upnp list", flag.ExitOnError)
+	gateway := fs.String("gateway", gateway, "only this gateway, by UDN or location url")
+	iface := fs.String("gateway-if", gatewayIf, "only gateways found on this network interface")
+	timeout := fs.Duration("timeout", time.Minute, "timeout")
+	fs.Parse(args)
+
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	l, err := upnp.Gateways(ctx, gatewayOptions(*gateway, *iface)...)
+	if err != nil {
+		return fmt.Errorf("upnpList: %w", err)
+	}
+	for _, g := range l {
+		fmt.Println("gateway:", g)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "PROTOCOL\tEXTERNAL\tINTERNAL\tENABLED\tLEASE\tDESCRIPTION")
+		for _, m := range g.PortMappings(ctx) {
+			external := fmt.Sprint(m.ExternalPort)
+			if m.RemoteHost != "" {
+				external = m.RemoteHost + " " + external
+			}
+			lease := "permanent"
+			if m.LeaseDuration != 0 {
+				lease = (time.Duration(m.LeaseDuration) * time.Second).String()
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v:%v\t%v\t%v\t%v\n", m.Protocol, external, m.InternalClient, m.InternalPort, m.Enabled, lease, m.Description)
+		}
+		w.Flush()
+		fmt.Println()
+	}
+	return nil
+}
+
+func upnpAdd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("upnp add", flag.ExitOnError)
+	gateway := fs.String("gateway", gateway, "only this gateway, by UDN or location url")
+	iface := fs.String("gateway-if", gatewayIf, "only gateways found on this network interface")
+	external := fs.Uint("e", 0, "external port")
+	internal := fs.Uint("i", 0, "internal port, defaults to -e")
+	client := fs.String("c", "", "internal client, defaults to the local addr")
+	protocol := fs.String("proto", "TCP", "TCP or UDP")
+	lease := fs.Duration("lease", 0, "lease duration, 0 for permanent")
+	desc := fs.String("desc", natmap.Description, "description")
+	timeout := fs.Duration("timeout", time.Minute, "timeout")
+	fs.Parse(args)
+
+	if *external == 0 || *external > 65535 || *internal > 65535 {
+		return errors.New("upnpAdd: -e must be a port")
+	}
+	if *internal == 0 {
+		*internal = *external
+	}
+	if *client == "" {
+		*client = getLocalAddrPort().Addr().String()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	l, err := upnp.Gateways(ctx, gatewayOptions(*gateway, *iface)...)
+	if err != nil {
+		return fmt.Errorf("upnpAdd: %w", err)
+	}
+	var errs error
+	for _, g := range l {
+		err := g.AddPortMapping(ctx, upnp.PortMapping{
+			ExternalPort:   uint16(*external),
+			Protocol:       strings.ToUpper(*protocol),
+			InternalPort:   uint16(*internal),
+			InternalClient: *client,
+			Enabled:        true,
+			Description:    *desc,
+			LeaseDuration:  uint32(*lease / time.Second),
+		})
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("%v: %w", g, err))
+			continue
+		}
+		fmt.Printf("added %v %v -> %v:%v on %v\n", strings.ToUpper(*protocol), *external, *client, *internal, g)
+	}
+	if errs != nil {
+		return fmt.Errorf("upnpAdd: %w", errs)
+	}
+	return nil
+}
+
+func upnpDelete(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("upnp delete", flag.ExitOnError)
+	gateway := fs.String("gateway", gateway, "only this gateway, by UDN or location url")
+	iface := fs.String("gateway-if", gatewayIf, "only gateways found on this network interface")
+	external := fs.Uint("e", 0, "external port")
+	protocol := fs.String("proto", "TCP", "TCP or UDP")
+	remote := fs.String("r", "", "remote host of the mapping")
+	timeout := fs.Duration("timeout", time.Minute, "timeout")
+	fs.Parse(args)
+
+	if *external == 0 || *external > 65535 {
+		return errors.New("upnpDelete: -e must be a port")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	l, err := upnp.Gateways(ctx, gatewayOptions(*gateway, *iface)...)
+	if err != nil {
+		return fmt.Errorf("upnpDelete: %w", err)
+	}
+	var errs error
+	for _, g := range l {
+		if err := g.DeletePortMapping(ctx, *remote, uint16(*external), strings.ToUpper(*protocol)); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("%v: %w", g, err))
+			continue
+		}
+		fmt.Printf("deleted %v %v on %v\n", strings.ToUpper(*protocol), *external, g)
+	}
+	if errs != nil {
+		return fmt.Errorf("upnpDelete: %w", errs)
+	}
+	return nil
+}
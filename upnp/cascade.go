@@ -0,0 +1,214 @@
+package upnp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"time"
+)
+
+// ErrNotCascaded is returned by Upstream when the external address of the
+// gateway is public, so there is no gateway above it to map on.
+var ErrNotCascaded = errors.New("gateway has a public external address")
+
+// ssdpPort is the port upstream gateways are searched on.
+const ssdpPort = 1900
+
+// searchTimeout is how long Upstream waits for SSDP responses.
+const searchTimeout = 2 * time.Second
+
+// ExternalIP returns the external address of the gateway.
+func (g *Gateway) ExternalIP(ctx context.Context) (netip.Addr, error) {
+	s, err := g.c.GetExternalIPAddressCtx(ctx)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("ExternalIP: %w", err)
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("ExternalIP: %w", err)
+	}
+	return ip.Unmap(), nil
+}
+
+// ExternalIP returns the external address of the first gateway selected by
+// opts.
+func ExternalIP(ctx context.Context, opts ...Option) (netip.Addr, error) {
+	gateways, err := pickGateways(ctx, opts)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("ExternalIP: %w", err)
+	}
+	ip, err := gateways[0].ExternalIP(ctx)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("ExternalIP: %w", err)
+	}
+	return ip, nil
+}
+
+// Upstream finds the gateway one NAT hop above g, e.g. the ISP modem in router
+// mode in front of our own router. SSDP multicast does not cross g, so a
+// unicast search is sent to host, or, if host is the zero value, to x.x.x.1 of
+// the /24 of g's external address. It returns an error wrapping
+// ErrNotCascaded if g's external address is public and one wrapping ErrNoIGD
+// if nothing answered.
+func (g *Gateway) Upstream(ctx context.Context, host netip.AddrPort) (*Gateway, error) {
+	ip, err := g.ExternalIP(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Upstream: %w", err)
+	}
+	if !ip.IsPrivate() {
+		return nil, fmt.Errorf("Upstream: %w: %v", ErrNotCascaded, ip)
+	}
+	if !host.IsValid() {
+		if !ip.Is4() {
+			return nil, fmt.Errorf("Upstream: %w: no upstream guess for %v", ErrNoIGD, ip)
+		}
+		b := ip.As4()
+		b[3] = 1
+		host = netip.AddrPortFrom(netip.AddrFrom4(b), ssdpPort)
+		if host.Addr() == ip {
+			return nil, fmt.Errorf("Upstream: %w: no upstream guess for %v", ErrNoIGD, ip)
+		}
+	}
+
+	locs, err := searchUnicast(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("Upstream: %w", err)
+	}
+	for _, loc := range locs {
+		ip2, ip1, ppp1, err := discoverURL(ctx, loc)
+		if err != nil {
+			continue
+		}
+		for _, v := range [][]routerClient{ip2, ip1, ppp1} {
+			if len(v) > 0 {
+				return newGateway(v[0]), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("Upstream: %w at %v", ErrNoIGD, host)
+}
+
+// searchUnicast sends an SSDP M-SEARCH for IGDs to host and returns the
+// locations of the answers.
+func searchUnicast(ctx context.Context, host netip.AddrPort) ([]*url.URL, error) {
+	var lc net.ListenConfig
+	pc, err := lc.ListenPacket(ctx, "udp", ":0")
+	if err != nil {
+		return nil, fmt.Errorf("searchUnicast: %w", err)
+	}
+	defer pc.Close()
+	conn := pc.(*net.UDPConn)
+
+	deadline := time.Now().Add(searchTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	for _, st := range []string{
+		"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+		"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+	} {
+		req := "M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: 239.255.255.250:1900\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: 1\r\n" +
+			"ST: " + st + "\r\n\r\n"
+		if _, err := conn.WriteToUDPAddrPort([]byte(req), host); err != nil {
+			return nil, fmt.Errorf("searchUnicast: %w", err)
+		}
+	}
+
+	var (
+		locs []*url.URL
+		seen = map[string]bool{}
+		buf  = make([]byte, 2048)
+	)
+	for {
+		n, _, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			break
+		}
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		loc, err := res.Location()
+		if err != nil || seen[loc.String()] {
+			continue
+		}
+		seen[loc.String()] = true
+		locs = append(locs, loc)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("searchUnicast: %w", err)
+	}
+	return locs, nil
+}
+
+// Hop is a port mapping on an upstream gateway, chained to the mapping on the
+// gateway below it.
+type Hop struct {
+	Gateway *Gateway
+	// ExternalPort is the port on the external address of Gateway.
+	ExternalPort uint16
+	// InternalClient and InternalPort are the external address and port of
+	// the gateway below.
+	InternalClient string
+	InternalPort   uint16
+}
+
+// MapUpstream chains port, an external port mapped on the gateways selected by
+// opts, through the upstream gateway of each of them, see Gateway.Upstream
+// and Gateway.MapPort. Gateways with a public external address are skipped.
+// The hops mapped are returned even if others failed.
+func MapUpstream(ctx context.Context, protocol string, port uint16, description string, lease uint32, r PortRange, upstream netip.AddrPort, opts ...Option) ([]Hop, error) {
+	gateways, err := pickGateways(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("MapUpstream: %w", err)
+	}
+	var (
+		hops []Hop
+		errs error
+	)
+	for _, g := range gateways {
+		up, err := g.Upstream(ctx, upstream)
+		if errors.Is(err, ErrNotCascaded) {
+			continue
+		}
+		if err != nil {
+			errs = errors.Join(errs, err)
+			continue
+		}
+		ip, err := g.ExternalIP(ctx)
+		if err != nil {
+			errs = errors.Join(errs, err)
+			continue
+		}
+		ext, err := up.MapPort(ctx, protocol, port, port, ip.String(), description, lease, r)
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("%v: %w", up, err))
+			continue
+		}
+		hops = append(hops, Hop{Gateway: up, ExternalPort: ext, InternalClient: ip.String(), InternalPort: port})
+	}
+	if errs != nil {
+		return hops, fmt.Errorf("MapUpstream: %w", errs)
+	}
+	return hops, nil
+}
@@ -0,0 +1,87 @@
+package upnp_test
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/xmdhs/natupnp/upnp"
+	"github.com/xmdhs/natupnp/upnp/fakeigd"
+)
+
+// startCascade serves a router behind an ISP modem, both on loopback. The
+// modem answers unicast SSDP at the returned address.
+func startCascade(t *testing.T) (router, modem *fakeigd.Device, loc upnp.Option, upstream netip.AddrPort) {
+	t.Helper()
+	router = &fakeigd.Device{UDN: "uuid:fa4e16d0-0000-4000-8000-0000000000a1", ExternalIP: "192.168.1.2"}
+	modem = &fakeigd.Device{UDN: "uuid:fa4e16d0-0000-4000-8000-0000000000a2", Version: 1}
+	loc = start(t, router)
+	start(t, modem)
+	upstream, err := modem.ListenSSDPUnicast(netip.MustParseAddrPort("127.0.0.1:0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return router, modem, loc, upstream
+}
+
+func TestUpstream(t *testing.T) {
+	ctx := context.Background()
+	_, modem, loc, upstream := startCascade(t)
+	gateways, err := upnp.PickGateways(ctx, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up, err := gateways[0].Upstream(ctx, upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.UDN != modem.UDN || up.Location != modem.Location() {
+		t.Errorf("upstream = %v at %v, want %v at %v", up.UDN, up.Location, modem.UDN, modem.Location())
+	}
+
+	// The modem has a public address, nothing is above it.
+	if _, err := up.Upstream(ctx, upstream); !errors.Is(err, upnp.ErrNotCascaded) {
+		t.Errorf("err = %v above the modem, want %v", err, upnp.ErrNotCascaded)
+	}
+}
+
+func TestUpstreamNotFound(t *testing.T) {
+	ctx := context.Background()
+	d := &fakeigd.Device{ExternalIP: "192.168.1.2"}
+	gateways, err := upnp.PickGateways(ctx, start(t, d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gateways[0].Upstream(ctx, netip.MustParseAddrPort("127.0.0.1:9")); !errors.Is(err, upnp.ErrNoIGD) {
+		t.Errorf("err = %v, want %v", err, upnp.ErrNoIGD)
+	}
+}
+
+func TestMapUpstream(t *testing.T) {
+	ctx := context.Background()
+	router, modem, loc, upstream := startCascade(t)
+	port, err := upnp.MapPort(ctx, "TCP", 2000, 2000, "127.0.0.1", "test", 3600, upnp.PortRange{}, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hops, err := upnp.MapUpstream(ctx, "TCP", port, "test", 3600, upnp.PortRange{}, upstream, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hops) != 1 || hops[0].Gateway.UDN != modem.UDN {
+		t.Fatalf("hops = %+v, want one on the modem", hops)
+	}
+	h := hops[0]
+	if h.ExternalPort != port || h.InternalClient != router.ExternalIP || h.InternalPort != port {
+		t.Errorf("hop = %+v, want %d to %v:%d", h, port, router.ExternalIP, port)
+	}
+	if m, ok := mapping(modem, "TCP", h.ExternalPort); !ok || m.InternalClient != "192.168.1.2" || m.InternalPort != port || m.Description != "test" {
+		t.Errorf("modem mapping = %+v, %v, want one to the router", m, ok)
+	}
+
+	// A router with a public address is not cascaded.
+	if hops, err := upnp.MapUpstream(ctx, "TCP", port, "test", 3600, upnp.PortRange{}, upstream, upnp.WithLocation(modem.Location())); err != nil || len(hops) != 0 {
+		t.Errorf("hops = %+v, %v above the modem, want none", hops, err)
+	}
+}
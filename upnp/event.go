@@ -0,0 +1,279 @@
+package upnp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoEvents is returned when a gateway service has no event URL.
+var ErrNoEvents = errors.New("gateway service does not support events")
+
+const (
+	// subscriptionTimeout is the subscription duration asked for.
+	subscriptionTimeout = 30 * time.Minute
+	// subscribeRetry is how long to wait after a failed renewal.
+	subscribeRetry = 30 * time.Second
+	// unsubscribeTimeout bounds the UNSUBSCRIBE on Close.
+	unsubscribeTimeout = 5 * time.Second
+)
+
+// Subscription is a GENA event subscription to a gateway service.
+type Subscription struct {
+	g        *Gateway
+	eventURL string
+	callback string
+	onEvent  func(map[string]string)
+	onError  func(error)
+
+	srv    *http.Server
+	cancel func()
+	wg     sync.WaitGroup
+
+	mu  sync.Mutex
+	sid string
+}
+
+// Subscribe subscribes to the evented state variables of g, such as
+// ExternalIPAddress and ConnectionStatus. onEvent is called with the variables
+// of every NOTIFY, including the initial one gateways send right after
+// subscribing. The subscription is renewed, and renewal failures are passed
+// to onError if not nil, until ctx is done or Close is called.
+func (g *Gateway) Subscribe(ctx context.Context, onEvent func(vars map[string]string), onError func(error)) (*Subscription, error) {
+	sc := g.c.GetServiceClient()
+	if sc.Service == nil || !sc.Service.EventSubURL.Ok || sc.Service.EventSubURL.Str == "" {
+		return nil, fmt.Errorf("Subscribe: %w", ErrNoEvents)
+	}
+	eventURL := sc.Service.EventSubURL.URL
+
+	// Listen on the address the gateway reaches us at.
+	port := eventURL.Port()
+	if port == "" {
+		port = "80"
+	}
+	probe, err := net.Dial("udp", net.JoinHostPort(eventURL.Hostname(), port))
+	if err != nil {
+		return nil, fmt.Errorf("Subscribe: %w", err)
+	}
+	local := probe.LocalAddr().(*net.UDPAddr).AddrPort().Addr()
+	probe.Close()
+	var lc net.ListenConfig
+	l, err := lc.Listen(ctx, "tcp", netip.AddrPortFrom(local, 0).String())
+	if err != nil {
+		return nil, fmt.Errorf("Subscribe: %w", err)
+	}
+
+	token := make([]byte, 8)
+	rand.Read(token)
+	path := "/natupnp/" + hex.EncodeToString(token)
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Subscription{
+		g:        g,
+		eventURL: eventURL.String(),
+		callback: "http://" + l.Addr().String() + path,
+		onEvent:  onEvent,
+		onError:  onError,
+		cancel:   cancel,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, s.serveNotify)
+	s.srv = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.srv.Serve(l)
+	}()
+
+	timeout, err := s.subscribe(ctx)
+	if err != nil {
+		cancel()
+		s.srv.Close()
+		s.wg.Wait()
+		return nil, fmt.Errorf("Subscribe: %w", err)
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.renew(ctx, timeout)
+	}()
+	return s, nil
+}
+
+// Close unsubscribes and stops the callback server.
+func (s *Subscription) Close() error {
+	s.cancel()
+	s.wg.Wait()
+	return nil
+}
+
+// Subscribe subscribes to every gateway selected by opts, see
+// Gateway.Subscribe. The subscriptions made are returned even if others
+// failed.
+func Subscribe(ctx context.Context, onEvent func(g *Gateway, vars map[string]string), onError func(error), opts ...Option) ([]*Subscription, error) {
+	gateways, err := pickGateways(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("Subscribe: %w", err)
+	}
+	var (
+		subs []*Subscription
+		errs error
+	)
+	for _, g := range gateways {
+		g := g
+		s, err := g.Subscribe(ctx, func(vars map[string]string) {
+			onEvent(g, vars)
+		}, onError)
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("%v: %w", g, err))
+			continue
+		}
+		subs = append(subs, s)
+	}
+	if errs != nil {
+		return subs, fmt.Errorf("Subscribe: %w", errs)
+	}
+	return subs, nil
+}
+
+// renew keeps the subscription alive until ctx is done, then unsubscribes.
+func (s *Subscription) renew(ctx context.Context, timeout time.Duration) {
+	defer func() {
+		uctx, cancel := context.WithTimeout(context.Background(), unsubscribeTimeout)
+		defer cancel()
+		s.unsubscribe(uctx)
+		s.srv.Close()
+	}()
+	wait := timeout / 2
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		t, err := s.resubscribe(ctx)
+		if err != nil {
+			// The gateway may have dropped the subscription, e.g. after a
+			// reboot, so start a new one.
+			t, err = s.subscribe(ctx)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if s.onError != nil {
+				s.onError(fmt.Errorf("renew: %v: %w", s.g, err))
+			}
+			wait = subscribeRetry
+			continue
+		}
+		wait = t / 2
+	}
+}
+
+func (s *Subscription) subscribe(ctx context.Context) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, "SUBSCRIBE", s.eventURL, nil)
+	if err != nil {
+		return 0, fmt.Errorf("subscribe: %w", err)
+	}
+	req.Header.Set("CALLBACK", "<"+s.callback+">")
+	req.Header.Set("NT", "upnp:event")
+	req.Header.Set("TIMEOUT", "Second-"+strconv.Itoa(int(subscriptionTimeout/time.Second)))
+	sid, timeout, err := doGENA(req)
+	if err != nil {
+		return 0, fmt.Errorf("subscribe: %w", err)
+	}
+	s.mu.Lock()
+	s.sid = sid
+	s.mu.Unlock()
+	return timeout, nil
+}
+
+func (s *Subscription) resubscribe(ctx context.Context) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, "SUBSCRIBE", s.eventURL, nil)
+	if err != nil {
+		return 0, fmt.Errorf("resubscribe: %w", err)
+	}
+	s.mu.Lock()
+	req.Header.Set("SID", s.sid)
+	s.mu.Unlock()
+	req.Header.Set("TIMEOUT", "Second-"+strconv.Itoa(int(subscriptionTimeout/time.Second)))
+	_, timeout, err := doGENA(req)
+	if err != nil {
+		return 0, fmt.Errorf("resubscribe: %w", err)
+	}
+	return timeout, nil
+}
+
+func (s *Subscription) unsubscribe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "UNSUBSCRIBE", s.eventURL, nil)
+	if err != nil {
+		return fmt.Errorf("unsubscribe: %w", err)
+	}
+	s.mu.Lock()
+	req.Header.Set("SID", s.sid)
+	s.mu.Unlock()
+	if _, _, err := doGENA(req); err != nil {
+		return fmt.Errorf("unsubscribe: %w", err)
+	}
+	return nil
+}
+
+// doGENA sends a GENA request and returns the SID and TIMEOUT of the
+// response.
+func doGENA(req *http.Request) (string, time.Duration, error) {
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("doGENA: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("doGENA: %v %v", req.Method, res.Status)
+	}
+	timeout := subscriptionTimeout
+	if v, ok := strings.CutPrefix(res.Header.Get("TIMEOUT"), "Second-"); ok {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			timeout = time.Duration(n) * time.Second
+		}
+	}
+	return res.Header.Get("SID"), timeout, nil
+}
+
+// propertySet is the body of a GENA NOTIFY.
+type propertySet struct {
+	Properties []struct {
+		Vars []struct {
+			XMLName xml.Name
+			Value   string `xml:",chardata"`
+		} `xml:",any"`
+	} `xml:"urn:schemas-upnp-org:event-1-0 property"`
+}
+
+func (s *Subscription) serveNotify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "NOTIFY" || r.Header.Get("NT") != "upnp:event" || r.Header.Get("NTS") != "upnp:propchange" {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	var ps propertySet
+	if err := xml.NewDecoder(r.Body).Decode(&ps); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	vars := map[string]string{}
+	for _, p := range ps.Properties {
+		for _, v := range p.Vars {
+			vars[v.XMLName.Local] = strings.TrimSpace(v.Value)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	s.onEvent(vars)
+}
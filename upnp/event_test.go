@@ -0,0 +1,93 @@
+package upnp_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/xmdhs/natupnp/upnp"
+	"github.com/xmdhs/natupnp/upnp/fakeigd"
+)
+
+// subscribe subscribes to d and returns the ExternalIPAddress of every event.
+func subscribe(t *testing.T, d *fakeigd.Device) (*upnp.Subscription, <-chan string) {
+	t.Helper()
+	ctx := context.Background()
+	gateways, err := upnp.PickGateways(ctx, start(t, d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips := make(chan string, 16)
+	sub, err := gateways[0].Subscribe(ctx, func(vars map[string]string) {
+		ips <- vars["ExternalIPAddress"]
+	}, func(err error) { t.Log(err) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sub.Close() })
+	return sub, ips
+}
+
+func next(t *testing.T, ips <-chan string) string {
+	t.Helper()
+	select {
+	case ip := <-ips:
+		return ip
+	case <-time.After(3 * time.Second):
+		t.Fatal("no event")
+		return ""
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	d := &fakeigd.Device{}
+	sub, ips := subscribe(t, d)
+
+	// The gateway reports the current state right after subscribing.
+	if ip := next(t, ips); ip != "203.0.113.1" {
+		t.Errorf("initial ExternalIPAddress = %q, want 203.0.113.1", ip)
+	}
+	d.SetExternalIP("203.0.113.2")
+	if ip := next(t, ips); ip != "203.0.113.2" {
+		t.Errorf("ExternalIPAddress = %q after a reconnect, want 203.0.113.2", ip)
+	}
+
+	if err := sub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !called(d, "UNSUBSCRIBE") {
+		t.Errorf("UNSUBSCRIBE not called on Close: %v", d.Calls())
+	}
+}
+
+func TestSubscribeRenew(t *testing.T) {
+	d := &fakeigd.Device{SubscriptionTimeout: 1}
+	_, ips := subscribe(t, d)
+	next(t, ips)
+
+	subscribes := func() int {
+		n := 0
+		for _, v := range d.Calls() {
+			if v == "SUBSCRIBE" {
+				n++
+			}
+		}
+		return n
+	}
+	// Renewed at half the timeout.
+	time.Sleep(700 * time.Millisecond)
+	if n := subscribes(); n < 2 {
+		t.Fatalf("%d SUBSCRIBE, want a renewal", n)
+	}
+
+	// The renewal fails once the gateway forgot the subscription, so a new
+	// one is made and events keep coming.
+	d.Reboot()
+	if ip := next(t, ips); ip != "203.0.113.1" {
+		t.Errorf("initial ExternalIPAddress = %q after the reboot, want 203.0.113.1", ip)
+	}
+	d.SetExternalIP("203.0.113.2")
+	if ip := next(t, ips); ip != "203.0.113.2" {
+		t.Errorf("ExternalIPAddress = %q, want 203.0.113.2", ip)
+	}
+}
@@ -0,0 +1,122 @@
+package fakeigd
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// subscriber is a GENA subscription to the device.
+type subscriber struct {
+	callback string
+	seq      uint32
+}
+
+var sidCounter atomic.Uint64
+
+// SetExternalIP changes the external address and notifies subscribers, like
+// a gateway does after a PPPoE reconnect.
+func (d *Device) SetExternalIP(ip string) {
+	d.mu.Lock()
+	d.ExternalIP = ip
+	subs := make([]string, 0, len(d.subs))
+	for sid := range d.subs {
+		subs = append(subs, sid)
+	}
+	d.mu.Unlock()
+	for _, sid := range subs {
+		d.notify(sid)
+	}
+}
+
+func (d *Device) serveEvent(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "SUBSCRIBE":
+		sid := r.Header.Get("SID")
+		d.mu.Lock()
+		d.calls = append(d.calls, "SUBSCRIBE")
+		if sid != "" {
+			_, ok := d.subs[sid]
+			d.mu.Unlock()
+			if !ok {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			d.writeSubscribed(w, sid)
+			return
+		}
+		callback := strings.Trim(r.Header.Get("CALLBACK"), "<>")
+		if callback == "" || r.Header.Get("NT") != "upnp:event" {
+			d.mu.Unlock()
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		sid = fmt.Sprintf("uuid:fakeigd-sub-%d", sidCounter.Add(1))
+		if d.subs == nil {
+			d.subs = map[string]*subscriber{}
+		}
+		d.subs[sid] = &subscriber{callback: callback}
+		d.mu.Unlock()
+		d.writeSubscribed(w, sid)
+		// The initial event follows the response.
+		go d.notify(sid)
+
+	case "UNSUBSCRIBE":
+		sid := r.Header.Get("SID")
+		d.mu.Lock()
+		d.calls = append(d.calls, "UNSUBSCRIBE")
+		_, ok := d.subs[sid]
+		delete(d.subs, sid)
+		d.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusPreconditionFailed)
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (d *Device) writeSubscribed(w http.ResponseWriter, sid string) {
+	w.Header().Set("SID", sid)
+	w.Header().Set("TIMEOUT", fmt.Sprintf("Second-%d", d.SubscriptionTimeout))
+	w.WriteHeader(http.StatusOK)
+}
+
+// notify sends the evented variables to the subscriber sid.
+func (d *Device) notify(sid string) {
+	d.mu.Lock()
+	s, ok := d.subs[sid]
+	if !ok {
+		d.mu.Unlock()
+		return
+	}
+	seq := s.seq
+	s.seq++
+	callback := s.callback
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0"?><e:propertyset xmlns:e="urn:schemas-upnp-org:event-1-0"><e:property><ExternalIPAddress>`)
+	xml.EscapeText(&b, []byte(d.ExternalIP))
+	b.WriteString(`</ExternalIPAddress></e:property><e:property><ConnectionStatus>Connected</ConnectionStatus></e:property></e:propertyset>`)
+	d.mu.Unlock()
+
+	req, err := http.NewRequest("NOTIFY", callback, &b)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("NT", "upnp:event")
+	req.Header.Set("NTS", "upnp:propchange")
+	req.Header.Set("SID", sid)
+	req.Header.Set("SEQ", fmt.Sprint(seq))
+	c := http.Client{Timeout: 5 * time.Second}
+	res, err := c.Do(req)
+	if err != nil {
+		return
+	}
+	res.Body.Close()
+}
@@ -0,0 +1,207 @@
+// Package fakeigd is an in-memory UPnP Internet Gateway Device, for running
+// the upnp and natmap packages without a router.
+//
+// It serves a device description with a WANIPConnection service, and for IGDv2
+// a WANIPv6FirewallControl service, over HTTP and, optionally, answers SSDP
+// searches. Port mappings and pinholes are kept in memory and never forward
+// traffic.
+package fakeigd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// UPnP error codes the device returns.
+const (
+	ErrInvalidAction                = 401
+	ErrInvalidArgs                  = 402
+	ErrSpecifiedArrayIndexInvalid   = 713
+	ErrNoSuchEntryInArray           = 714
+	ErrConflictInMappingEntry       = 718
+	ErrOnlyPermanentLeasesSupported = 725
+	ErrNoPortMapsAvailable          = 728
+)
+
+// Mapping is an entry of the mapping table.
+type Mapping struct {
+	RemoteHost     string
+	ExternalPort   uint16
+	Protocol       string
+	InternalPort   uint16
+	InternalClient string
+	Enabled        bool
+	Description    string
+	LeaseDuration  uint32
+}
+
+// Device is a fake IGD. Set the exported fields before Start.
+type Device struct {
+	// Version is the WANIPConnection version, 1 or 2. IGDv2 also implements
+	// AddAnyPortMapping. It defaults to 2.
+	Version int
+	// UDN defaults to a fixed uuid.
+	UDN string
+	// ExternalIP is returned by GetExternalIPAddress. It defaults to
+	// 203.0.113.1.
+	ExternalIP string
+	// PermanentOnly rejects non-zero leases like old IGDv1 gateways do.
+	PermanentOnly bool
+	// Fail, if not nil, is called before every action. A non-zero code is
+	// returned as UPnP error instead of running the action.
+	Fail func(action string) int
+	// Hijack, if set, replaces the internal client of every added mapping,
+	// like gateways that accept a mapping but forward it elsewhere.
+	Hijack string
+	// FirewallDisabled reports the IPv6 firewall as disabled, so no pinholes
+	// are needed.
+	FirewallDisabled bool
+	// NoInboundPinholes makes the IPv6 firewall reject AddPinhole.
+	NoInboundPinholes bool
+	// SubscriptionTimeout is how many seconds event subscriptions are granted
+	// for. It defaults to 1800.
+	SubscriptionTimeout int
+
+	mu        sync.Mutex
+	mappings  []Mapping
+	pinholes  []Pinhole
+	pinholeID uint16
+	calls     []string
+	subs      map[string]*subscriber
+	http      *http.Server
+	l         net.Listener
+	ssdp      []net.PacketConn
+	wg        sync.WaitGroup
+}
+
+// Start serves the device on a free port of ip, e.g. 127.0.0.1.
+func (d *Device) Start(ctx context.Context, ip netip.Addr) error {
+	if d.Version == 0 {
+		d.Version = 2
+	}
+	if d.Version != 1 && d.Version != 2 {
+		return fmt.Errorf("Start: unsupported version %d", d.Version)
+	}
+	if d.UDN == "" {
+		d.UDN = "uuid:fa4e16d0-0000-4000-8000-000000000001"
+	}
+	if d.ExternalIP == "" {
+		d.ExternalIP = "203.0.113.1"
+	}
+	if d.SubscriptionTimeout == 0 {
+		d.SubscriptionTimeout = 1800
+	}
+
+	var lc net.ListenConfig
+	l, err := lc.Listen(ctx, "tcp", netip.AddrPortFrom(ip, 0).String())
+	if err != nil {
+		return fmt.Errorf("Start: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(descPath, d.serveDescription)
+	mux.HandleFunc(scpdPath, d.serveSCPD)
+	mux.HandleFunc(controlPath, d.serveControl)
+	mux.HandleFunc(eventPath, d.serveEvent)
+	mux.HandleFunc(firewallSCPDPath, d.serveFirewallSCPD)
+	mux.HandleFunc(firewallControlPath, d.serveFirewallControl)
+	d.l = l
+	d.http = &http.Server{Handler: mux}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.http.Serve(l)
+	}()
+	return nil
+}
+
+// Location returns the URL of the device description, for
+// upnp.WithLocation.
+func (d *Device) Location() string {
+	return "http://" + d.l.Addr().String() + descPath
+}
+
+// DeviceType returns the device type of the root device.
+func (d *Device) DeviceType() string {
+	return fmt.Sprintf("urn:schemas-upnp-org:device:InternetGatewayDevice:%d", d.Version)
+}
+
+// ServiceType returns the service type of the WANIPConnection service.
+func (d *Device) ServiceType() string {
+	return fmt.Sprintf("urn:schemas-upnp-org:service:WANIPConnection:%d", d.Version)
+}
+
+// Mappings returns a copy of the mapping table.
+func (d *Device) Mappings() []Mapping {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Mapping(nil), d.mappings...)
+}
+
+// SetMapping adds or replaces m in the mapping table, e.g. to simulate another
+// host holding a port.
+func (d *Device) SetMapping(m Mapping) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.setLocked(m)
+}
+
+// Reboot drops all port mappings, pinholes and event subscriptions, like a
+// gateway reboot.
+func (d *Device) Reboot() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.mappings = nil
+	d.pinholes = nil
+	d.subs = nil
+}
+
+// Calls returns the names of the actions called so far, in order.
+func (d *Device) Calls() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.calls...)
+}
+
+// Close stops the device.
+func (d *Device) Close() error {
+	var err error
+	if d.http != nil {
+		err = d.http.Close()
+	}
+	d.mu.Lock()
+	for _, c := range d.ssdp {
+		err = errors.Join(err, c.Close())
+	}
+	d.mu.Unlock()
+	d.wg.Wait()
+	return err
+}
+
+func (d *Device) setLocked(m Mapping) {
+	for i, v := range d.mappings {
+		if sameEntry(v, m.RemoteHost, m.ExternalPort, m.Protocol) {
+			d.mappings[i] = m
+			return
+		}
+	}
+	d.mappings = append(d.mappings, m)
+}
+
+func (d *Device) findLocked(remoteHost string, port uint16, protocol string) (int, bool) {
+	for i, v := range d.mappings {
+		if sameEntry(v, remoteHost, port, protocol) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func sameEntry(m Mapping, remoteHost string, port uint16, protocol string) bool {
+	return m.RemoteHost == remoteHost && m.ExternalPort == port && strings.EqualFold(m.Protocol, protocol)
+}
@@ -0,0 +1,134 @@
+package fakeigd
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+)
+
+const (
+	firewallServiceType = "urn:schemas-upnp-org:service:WANIPv6FirewallControl:1"
+	firewallSCPDPath    = "/WANIPv6FC.xml"
+	firewallControlPath = "/ctl/IP6FCtl"
+)
+
+// UPnP error codes of WANIPv6FirewallControl the device returns.
+const (
+	ErrFirewallDisabled         = 702
+	ErrInboundPinholeNotAllowed = 703
+	ErrNoSuchEntry              = 704
+)
+
+// Pinhole is an entry of the IPv6 firewall.
+type Pinhole struct {
+	ID             uint16
+	RemoteHost     string
+	RemotePort     uint16
+	InternalClient string
+	InternalPort   uint16
+	Protocol       uint16
+	LeaseTime      uint32
+}
+
+// Pinholes returns a copy of the pinholes of the IPv6 firewall.
+func (d *Device) Pinholes() []Pinhole {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Pinhole(nil), d.pinholes...)
+}
+
+func (d *Device) firewallService() string {
+	if d.Version < 2 {
+		return ""
+	}
+	return `<service>
+<serviceType>` + firewallServiceType + `</serviceType>
+<serviceId>urn:upnp-org:serviceId:WANIPv6Firewall1</serviceId>
+<SCPDURL>` + firewallSCPDPath + `</SCPDURL>
+<controlURL>` + firewallControlPath + `</controlURL>
+<eventSubURL></eventSubURL>
+</service>
+`
+}
+
+func (d *Device) serveFirewallSCPD(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	io.WriteString(w, `<?xml version="1.0"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<actionList>
+<action><name>GetFirewallStatus</name></action>
+<action><name>AddPinhole</name></action>
+<action><name>UpdatePinhole</name></action>
+<action><name>DeletePinhole</name></action>
+</actionList>
+</scpd>
+`)
+}
+
+func (d *Device) serveFirewallControl(w http.ResponseWriter, r *http.Request) {
+	d.serveSOAP(w, r, firewallServiceType, d.doFirewall)
+}
+
+// doFirewall runs a WANIPv6FirewallControl action.
+func (d *Device) doFirewall(action string, args map[string]string) ([]arg, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch action {
+	case "GetFirewallStatus":
+		return []arg{
+			{"FirewallEnabled", boolString(!d.FirewallDisabled)},
+			{"InboundPinholeAllowed", boolString(!d.NoInboundPinholes)},
+		}, 0
+
+	case "AddPinhole":
+		if d.FirewallDisabled {
+			return nil, ErrFirewallDisabled
+		}
+		if d.NoInboundPinholes {
+			return nil, ErrInboundPinholeNotAllowed
+		}
+		rport, err1 := strconv.ParseUint(args["RemotePort"], 10, 16)
+		iport, err2 := strconv.ParseUint(args["InternalPort"], 10, 16)
+		proto, err3 := strconv.ParseUint(args["Protocol"], 10, 16)
+		lease, err4 := strconv.ParseUint(args["LeaseTime"], 10, 32)
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil || lease < 1 || lease > 86400 || args["InternalClient"] == "" {
+			return nil, ErrInvalidArgs
+		}
+		d.pinholeID++
+		d.pinholes = append(d.pinholes, Pinhole{
+			ID:             d.pinholeID,
+			RemoteHost:     args["RemoteHost"],
+			RemotePort:     uint16(rport),
+			InternalClient: args["InternalClient"],
+			InternalPort:   uint16(iport),
+			Protocol:       uint16(proto),
+			LeaseTime:      uint32(lease),
+		})
+		return []arg{{"UniqueID", strconv.Itoa(int(d.pinholeID))}}, 0
+
+	case "UpdatePinhole", "DeletePinhole":
+		id, err := strconv.ParseUint(args["UniqueID"], 10, 16)
+		if err != nil {
+			return nil, ErrInvalidArgs
+		}
+		for i, p := range d.pinholes {
+			if p.ID != uint16(id) {
+				continue
+			}
+			if action == "DeletePinhole" {
+				d.pinholes = append(d.pinholes[:i], d.pinholes[i+1:]...)
+				return nil, 0
+			}
+			lease, err := strconv.ParseUint(args["NewLeaseTime"], 10, 32)
+			if err != nil || lease < 1 || lease > 86400 {
+				return nil, ErrInvalidArgs
+			}
+			d.pinholes[i].LeaseTime = uint32(lease)
+			return nil, 0
+		}
+		return nil, ErrNoSuchEntry
+	}
+	return nil, ErrInvalidAction
+}
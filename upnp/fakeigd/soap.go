@@ -0,0 +1,325 @@
+package fakeigd
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	descPath    = "/rootDesc.xml"
+	scpdPath    = "/WANIPCn.xml"
+	controlPath = "/ctl/IPConn"
+	eventPath   = "/evt/IPConn"
+)
+
+func (d *Device) serveDescription(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<device>
+<deviceType>%[1]s</deviceType>
+<friendlyName>fakeigd</friendlyName>
+<manufacturer>natupnp</manufacturer>
+<modelName>fakeigd</modelName>
+<UDN>%[2]s</UDN>
+<deviceList>
+<device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:%[3]d</deviceType>
+<friendlyName>WANDevice</friendlyName>
+<UDN>%[2]s-wan</UDN>
+<deviceList>
+<device>
+<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:%[3]d</deviceType>
+<friendlyName>WANConnectionDevice</friendlyName>
+<UDN>%[2]s-wanconn</UDN>
+<serviceList>
+<service>
+<serviceType>%[4]s</serviceType>
+<serviceId>urn:upnp-org:serviceId:WANIPConn1</serviceId>
+<SCPDURL>%[5]s</SCPDURL>
+<controlURL>%[6]s</controlURL>
+<eventSubURL>%[7]s</eventSubURL>
+</service>
+%[8]s</serviceList>
+</device>
+</deviceList>
+</device>
+</deviceList>
+</device>
+</root>
+`, d.DeviceType(), d.UDN, d.Version, d.ServiceType(), scpdPath, controlPath, eventPath, d.firewallService())
+}
+
+func (d *Device) serveSCPD(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	io.WriteString(w, `<?xml version="1.0"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<actionList>
+<action><name>AddPortMapping</name></action>
+`)
+	if d.Version >= 2 {
+		io.WriteString(w, "<action><name>AddAnyPortMapping</name></action>\n")
+	}
+	io.WriteString(w, `<action><name>DeletePortMapping</name></action>
+<action><name>GetSpecificPortMappingEntry</name></action>
+<action><name>GetGenericPortMappingEntry</name></action>
+<action><name>GetExternalIPAddress</name></action>
+</actionList>
+</scpd>
+`)
+}
+
+// soapRequest is the body of a SOAP action call.
+type soapRequest struct {
+	Body struct {
+		Action struct {
+			XMLName xml.Name
+			Args    []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:",any"`
+	} `xml:"Body"`
+}
+
+// arg is a name/value pair of a SOAP response.
+type arg struct {
+	name, value string
+}
+
+func (d *Device) serveControl(w http.ResponseWriter, r *http.Request) {
+	d.serveSOAP(w, r, d.ServiceType(), d.do)
+}
+
+// serveSOAP decodes a SOAP action call and answers it with do.
+func (d *Device) serveSOAP(w http.ResponseWriter, r *http.Request, serviceType string, do func(action string, args map[string]string) ([]arg, int)) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req soapRequest
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	action := req.Body.Action.XMLName.Local
+	args := map[string]string{}
+	for _, a := range req.Body.Action.Args {
+		args[a.XMLName.Local] = strings.TrimSpace(a.Value)
+	}
+
+	d.mu.Lock()
+	d.calls = append(d.calls, action)
+	d.mu.Unlock()
+
+	if d.Fail != nil {
+		if code := d.Fail(action); code != 0 {
+			writeFault(w, code)
+			return
+		}
+	}
+	out, code := do(action, args)
+	if code != 0 {
+		writeFault(w, code)
+		return
+	}
+	writeResponse(w, serviceType, action, out)
+}
+
+// do runs action and returns its out arguments or a UPnP error code.
+func (d *Device) do(action string, args map[string]string) ([]arg, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch action {
+	case "GetExternalIPAddress":
+		return []arg{{"NewExternalIPAddress", d.ExternalIP}}, 0
+
+	case "AddPortMapping", "AddAnyPortMapping":
+		if action == "AddAnyPortMapping" && d.Version < 2 {
+			return nil, ErrInvalidAction
+		}
+		m, ok := parseMapping(args)
+		if !ok {
+			return nil, ErrInvalidArgs
+		}
+		if m.LeaseDuration != 0 && d.PermanentOnly {
+			return nil, ErrOnlyPermanentLeasesSupported
+		}
+		client := m.InternalClient
+		taken := func(port uint16) bool {
+			i, ok := d.findLocked(m.RemoteHost, port, m.Protocol)
+			if !ok {
+				return false
+			}
+			v := d.mappings[i]
+			return v.InternalClient != client || v.InternalPort != m.InternalPort
+		}
+		if d.Hijack != "" {
+			m.InternalClient = d.Hijack
+		}
+		if action == "AddPortMapping" {
+			if taken(m.ExternalPort) {
+				return nil, ErrConflictInMappingEntry
+			}
+			d.setLocked(m)
+			return nil, 0
+		}
+		for i := 0; i < 65535; i++ {
+			port := uint16((int(m.ExternalPort)+i-1)%65535 + 1)
+			if port < 1024 || taken(port) {
+				continue
+			}
+			m.ExternalPort = port
+			d.setLocked(m)
+			return []arg{{"NewReservedPort", strconv.Itoa(int(port))}}, 0
+		}
+		return nil, ErrNoPortMapsAvailable
+
+	case "DeletePortMapping":
+		port, err := strconv.ParseUint(args["NewExternalPort"], 10, 16)
+		if err != nil {
+			return nil, ErrInvalidArgs
+		}
+		i, ok := d.findLocked(args["NewRemoteHost"], uint16(port), args["NewProtocol"])
+		if !ok {
+			return nil, ErrNoSuchEntryInArray
+		}
+		d.mappings = append(d.mappings[:i], d.mappings[i+1:]...)
+		return nil, 0
+
+	case "GetSpecificPortMappingEntry":
+		port, err := strconv.ParseUint(args["NewExternalPort"], 10, 16)
+		if err != nil {
+			return nil, ErrInvalidArgs
+		}
+		i, ok := d.findLocked(args["NewRemoteHost"], uint16(port), args["NewProtocol"])
+		if !ok {
+			return nil, ErrNoSuchEntryInArray
+		}
+		m := d.mappings[i]
+		return []arg{
+			{"NewInternalPort", strconv.Itoa(int(m.InternalPort))},
+			{"NewInternalClient", m.InternalClient},
+			{"NewEnabled", boolString(m.Enabled)},
+			{"NewPortMappingDescription", m.Description},
+			{"NewLeaseDuration", strconv.FormatUint(uint64(m.LeaseDuration), 10)},
+		}, 0
+
+	case "GetGenericPortMappingEntry":
+		i, err := strconv.ParseUint(args["NewPortMappingIndex"], 10, 16)
+		if err != nil {
+			return nil, ErrInvalidArgs
+		}
+		if int(i) >= len(d.mappings) {
+			return nil, ErrSpecifiedArrayIndexInvalid
+		}
+		m := d.mappings[i]
+		return []arg{
+			{"NewRemoteHost", m.RemoteHost},
+			{"NewExternalPort", strconv.Itoa(int(m.ExternalPort))},
+			{"NewProtocol", m.Protocol},
+			{"NewInternalPort", strconv.Itoa(int(m.InternalPort))},
+			{"NewInternalClient", m.InternalClient},
+			{"NewEnabled", boolString(m.Enabled)},
+			{"NewPortMappingDescription", m.Description},
+			{"NewLeaseDuration", strconv.FormatUint(uint64(m.LeaseDuration), 10)},
+		}, 0
+	}
+	return nil, ErrInvalidAction
+}
+
+func parseMapping(args map[string]string) (Mapping, bool) {
+	ext, err1 := strconv.ParseUint(args["NewExternalPort"], 10, 16)
+	in, err2 := strconv.ParseUint(args["NewInternalPort"], 10, 16)
+	lease, err3 := strconv.ParseUint(args["NewLeaseDuration"], 10, 32)
+	if err1 != nil || err2 != nil || err3 != nil || in == 0 || args["NewInternalClient"] == "" {
+		return Mapping{}, false
+	}
+	proto := strings.ToUpper(args["NewProtocol"])
+	if proto != "TCP" && proto != "UDP" {
+		return Mapping{}, false
+	}
+	return Mapping{
+		RemoteHost:     args["NewRemoteHost"],
+		ExternalPort:   uint16(ext),
+		Protocol:       proto,
+		InternalPort:   uint16(in),
+		InternalClient: args["NewInternalClient"],
+		Enabled:        args["NewEnabled"] == "1" || args["NewEnabled"] == "true",
+		Description:    args["NewPortMappingDescription"],
+		LeaseDuration:  uint32(lease),
+	}, true
+}
+
+func boolString(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+func writeResponse(w http.ResponseWriter, serviceType, action string, out []arg) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<u:%sResponse xmlns:u="%s">`, action, serviceType)
+	for _, a := range out {
+		fmt.Fprintf(&b, "<%s>", a.name)
+		xml.EscapeText(&b, []byte(a.value))
+		fmt.Fprintf(&b, "</%s>", a.name)
+	}
+	fmt.Fprintf(&b, `</u:%sResponse>`, action)
+	writeEnvelope(w, http.StatusOK, b.String())
+}
+
+func writeFault(w http.ResponseWriter, code int) {
+	writeEnvelope(w, http.StatusInternalServerError, fmt.Sprintf(`<s:Fault>
+<faultcode>s:Client</faultcode>
+<faultstring>UPnPError</faultstring>
+<detail>
+<UPnPError xmlns="urn:schemas-upnp-org:control-1-0">
+<errorCode>%d</errorCode>
+<errorDescription>%s</errorDescription>
+</UPnPError>
+</detail>
+</s:Fault>`, code, errorDescription(code)))
+}
+
+func writeEnvelope(w http.ResponseWriter, status int, body string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>%s</s:Body></s:Envelope>`, body)
+}
+
+func errorDescription(code int) string {
+	switch code {
+	case ErrInvalidAction:
+		return "Invalid Action"
+	case ErrInvalidArgs:
+		return "Invalid Args"
+	case ErrSpecifiedArrayIndexInvalid:
+		return "SpecifiedArrayIndexInvalid"
+	case ErrNoSuchEntryInArray:
+		return "NoSuchEntryInArray"
+	case ErrConflictInMappingEntry:
+		return "ConflictInMappingEntry"
+	case ErrOnlyPermanentLeasesSupported:
+		return "OnlyPermanentLeasesSupported"
+	case ErrNoPortMapsAvailable:
+		return "NoPortMapsAvailable"
+	case ErrFirewallDisabled:
+		return "FirewallDisabled"
+	case ErrInboundPinholeNotAllowed:
+		return "InboundPinholeNotAllowed"
+	case ErrNoSuchEntry:
+		return "NoSuchEntry"
+	}
+	return "Action Failed"
+}
@@ -0,0 +1,87 @@
+package fakeigd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+var ssdpAddr = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+
+// ListenSSDP answers SSDP M-SEARCH requests on the multicast group of iface,
+// or of the default interface if iface is nil, until Close. Call it after
+// Start.
+func (d *Device) ListenSSDP(iface *net.Interface) error {
+	conn, err := net.ListenMulticastUDP("udp4", iface, ssdpAddr)
+	if err != nil {
+		return fmt.Errorf("ListenSSDP: %w", err)
+	}
+	d.goServeSSDP(conn)
+	return nil
+}
+
+// ListenSSDPUnicast answers SSDP M-SEARCH requests sent to addr, the way an
+// upstream gateway answers a unicast search, until Close. Port 0 picks a free
+// port. It returns the address listened on.
+func (d *Device) ListenSSDPUnicast(addr netip.AddrPort) (netip.AddrPort, error) {
+	conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(addr))
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("ListenSSDPUnicast: %w", err)
+	}
+	d.goServeSSDP(conn)
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort(), nil
+}
+
+func (d *Device) goServeSSDP(conn *net.UDPConn) {
+	d.mu.Lock()
+	d.ssdp = append(d.ssdp, conn)
+	d.mu.Unlock()
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.serveSSDP(conn)
+	}()
+}
+
+func (d *Device) serveSSDP(conn *net.UDPConn) {
+	buf := make([]byte, 2048)
+	for {
+		n, raddr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" || req.Header.Get("MAN") != `"ssdp:discover"` {
+			continue
+		}
+		st := req.Header.Get("ST")
+		if !d.matchST(st) {
+			continue
+		}
+		res := fmt.Sprintf("HTTP/1.1 200 OK\r\n"+
+			"CACHE-CONTROL: max-age=120\r\n"+
+			"EXT:\r\n"+
+			"LOCATION: %s\r\n"+
+			"SERVER: natupnp/fakeigd UPnP/1.1\r\n"+
+			"ST: %s\r\n"+
+			"USN: %s::%s\r\n"+
+			"\r\n", d.Location(), st, d.UDN, st)
+		conn.WriteToUDP([]byte(res), raddr)
+	}
+}
+
+func (d *Device) matchST(st string) bool {
+	switch strings.TrimSpace(st) {
+	case "ssdp:all", "upnp:rootdevice", d.UDN, d.DeviceType(), d.ServiceType():
+		return true
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Gateway is a WAN connection service of an Internet Gateway Device.
+type Gateway struct {
+	// Location is the URL of the device description.
+	Location     string
+	UDN          string
+	FriendlyName string
+	// Service is the service type, e.g.
+	// urn:schemas-upnp-org:service:WANIPConnection:2.
+	Service string
+
+	c routerClient
+}
+
+func newGateway(c routerClient) *Gateway {
+	sc := c.GetServiceClient()
+	g := &Gateway{c: c}
+	if sc.Location != nil {
+		g.Location = sc.Location.String()
+	}
+	if sc.RootDevice != nil {
+		g.UDN = sc.RootDevice.Device.UDN
+		g.FriendlyName = sc.RootDevice.Device.FriendlyName
+	}
+	if sc.Service != nil {
+		g.Service = sc.Service.ServiceType
+	}
+	return g
+}
+
+// Gateways returns the WANIPConnection2, WANIPConnection1 and
+// WANPPPConnection1 services of every gateway selected by opts. A device can
+// have several of them.
+func Gateways(ctx context.Context, opts ...Option) ([]*Gateway, error) {
+	l, err := gateways(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("Gateways: %w", err)
+	}
+	return l, nil
+}
+
+func (g *Gateway) String() string {
+	return fmt.Sprintf("%v (%v) %v %v", g.FriendlyName, g.UDN, g.Service, g.Location)
+}
+
+// PortMappings returns the mapping table of the gateway.
+func (g *Gateway) PortMappings(ctx context.Context) []PortMapping {
+	return listPortMappings(ctx, g.c)
+}
+
+// AddPortMapping adds a mapping on the gateway and reads it back, see
+// VerifyPortMapping. A gateway that only supports permanent leases gets the
+// mapping with a lease of 0 instead.
+func (g *Gateway) AddPortMapping(ctx context.Context, m PortMapping) error {
+	err := addPortMapping(ctx, g.c, m.RemoteHost, m.ExternalPort, m.Protocol, m.InternalPort, m.InternalClient, m.Enabled, m.Description, m.LeaseDuration)
+	if err != nil {
+		return fmt.Errorf("AddPortMapping: %w", err)
+	}
+	return nil
+}
+
+// DeletePortMapping removes a mapping from the gateway.
+func (g *Gateway) DeletePortMapping(ctx context.Context, remoteHost string, externalPort uint16, protocol string) error {
+	err := g.c.DeletePortMappingCtx(ctx, remoteHost, externalPort, protocol)
+	if err != nil {
+		return fmt.Errorf("DeletePortMapping: %w", err)
+	}
+	return nil
+}
+
+// DeletePortMappings deletes the mappings of the gateway for which match
+// returns true, and returns the deleted ones.
+func (g *Gateway) DeletePortMappings(ctx context.Context, match func(PortMapping) bool) ([]PortMapping, error) {
+	var (
+		deleted []PortMapping
+		errs    error
+	)
+	for _, v := range listPortMappings(ctx, g.c) {
+		if !match(v) {
+			continue
+		}
+		if err := g.c.DeletePortMappingCtx(ctx, v.RemoteHost, v.ExternalPort, v.Protocol); err != nil {
+			errs = errors.Join(errs, err)
+			continue
+		}
+		deleted = append(deleted, v)
+	}
+	if errs != nil {
+		return deleted, fmt.Errorf("DeletePortMappings: %w", errs)
+	}
+	return deleted, nil
+}
@@ -0,0 +1,106 @@
+package upnp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/huin/goupnp"
+)
+
+// config selects the gateways an operation applies to.
+type config struct {
+	location *url.URL
+	udn      string
+	iface    *net.Interface
+	gateways []*Gateway
+}
+
+// Option pins the gateway the functions of this package talk to. Without
+// options every gateway found over SSDP is used.
+type Option func(*config) error
+
+func newConfig(opts []Option) (*config, error) {
+	c := &config{}
+	for _, o := range opts {
+		if err := o(c); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// WithLocation uses the gateway whose device description is at location,
+// without SSDP discovery.
+func WithLocation(location string) Option {
+	return func(c *config) error {
+		u, err := url.Parse(location)
+		if err != nil {
+			return fmt.Errorf("WithLocation: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return errors.New("WithLocation: location must be a http url")
+		}
+		c.location = u
+		return nil
+	}
+}
+
+// WithUDN only uses the gateway with the given UDN, e.g.
+// uuid:00000000-0000-0000-0000-000000000000.
+func WithUDN(udn string) Option {
+	return func(c *config) error {
+		c.udn = udn
+		return nil
+	}
+}
+
+// WithInterface only uses gateways discovered on the named network interface.
+// It cannot be combined with WithLocation.
+func WithInterface(name string) Option {
+	return func(c *config) error {
+		i, err := net.InterfaceByName(name)
+		if err != nil {
+			return fmt.Errorf("WithInterface: %w", err)
+		}
+		c.iface = i
+		return nil
+	}
+}
+
+// WithGateways uses the given gateways, e.g. from PickGateways, without
+// discovery. The other options are ignored.
+func WithGateways(gateways ...*Gateway) Option {
+	return func(c *config) error {
+		if len(gateways) == 0 {
+			return errors.New("WithGateways: no gateway")
+		}
+		c.gateways = gateways
+		return nil
+	}
+}
+
+// match reports whether the service sc passes the UDN and interface filters.
+func (c *config) match(sc *goupnp.ServiceClient) bool {
+	if c.udn != "" && (sc.RootDevice == nil || sc.RootDevice.Device.UDN != c.udn) {
+		return false
+	}
+	if c.iface != nil {
+		local := sc.LocalAddr()
+		if local == nil {
+			return false
+		}
+		addrs, err := c.iface.Addrs()
+		if err != nil {
+			return false
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(local) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
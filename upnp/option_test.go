@@ -0,0 +1,86 @@
+package upnp_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/xmdhs/natupnp/upnp"
+	"github.com/xmdhs/natupnp/upnp/fakeigd"
+)
+
+func TestWithUDN(t *testing.T) {
+	ctx := context.Background()
+	a := &fakeigd.Device{UDN: "uuid:fa4e16d0-0000-4000-8000-0000000000b1"}
+	b := &fakeigd.Device{UDN: "uuid:fa4e16d0-0000-4000-8000-0000000000b2"}
+	start(t, a)
+	locB := start(t, b)
+
+	gateways, err := upnp.PickGateways(ctx, locB, upnp.WithUDN(b.UDN))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gateways) != 1 || gateways[0].UDN != b.UDN || gateways[0].Location != b.Location() {
+		t.Fatalf("gateways = %v, want %v", gateways, b.UDN)
+	}
+	res, err := upnp.AddPortMapping(ctx, "", 8080, "TCP", 80, "127.0.0.1", true, "test", 3600, locB, upnp.WithUDN(b.UDN))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].Gateway.UDN != b.UDN {
+		t.Errorf("results = %+v, want one on %v", res, b.UDN)
+	}
+	if _, ok := mapping(b, "TCP", 8080); !ok {
+		t.Error("no mapping on the pinned gateway")
+	}
+
+	// The device at the location is not the one pinned.
+	locA := upnp.WithLocation(a.Location())
+	if _, err := upnp.PickGateways(ctx, locA, upnp.WithUDN(b.UDN)); !errors.Is(err, upnp.ErrNoIGD) {
+		t.Errorf("PickGateways: err = %v, want %v", err, upnp.ErrNoIGD)
+	}
+	res, err = upnp.AddPortMapping(ctx, "", 8080, "TCP", 80, "127.0.0.1", true, "test", 3600, locA, upnp.WithUDN(b.UDN))
+	if !errors.Is(err, upnp.ErrNoIGD) || res != nil {
+		t.Errorf("AddPortMapping: %+v, err = %v, want %v", res, err, upnp.ErrNoIGD)
+	}
+	if n := len(a.Mappings()); n != 0 {
+		t.Errorf("%d mappings on the other gateway", n)
+	}
+}
+
+func TestNoIGD(t *testing.T) {
+	ctx := context.Background()
+	// A UPnP device, but not an Internet Gateway Device.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		io.WriteString(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<device>
+<deviceType>urn:schemas-upnp-org:device:MediaServer:1</deviceType>
+<friendlyName>nas</friendlyName>
+<UDN>uuid:fa4e16d0-0000-4000-8000-0000000000c1</UDN>
+</device>
+</root>
+`)
+	}))
+	t.Cleanup(srv.Close)
+	loc := upnp.WithLocation(srv.URL)
+
+	if g, err := upnp.PickGateways(ctx, loc); !errors.Is(err, upnp.ErrNoIGD) {
+		t.Errorf("PickGateways: %v, err = %v, want %v", g, err, upnp.ErrNoIGD)
+	}
+	if g, err := upnp.Gateways(ctx, loc); !errors.Is(err, upnp.ErrNoIGD) {
+		t.Errorf("Gateways: %v, err = %v, want %v", g, err, upnp.ErrNoIGD)
+	}
+	res, err := upnp.AddPortMapping(ctx, "", 8080, "TCP", 80, "127.0.0.1", true, "test", 3600, loc)
+	if !errors.Is(err, upnp.ErrNoIGD) || res != nil {
+		t.Errorf("AddPortMapping: %+v, err = %v, want %v", res, err, upnp.ErrNoIGD)
+	}
+	if _, err := upnp.ExternalIP(ctx, loc); !errors.Is(err, upnp.ErrNoIGD) {
+		t.Errorf("ExternalIP: err = %v, want %v", err, upnp.ErrNoIGD)
+	}
+}
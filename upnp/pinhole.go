@@ -0,0 +1,210 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/huin/goupnp"
+	"github.com/huin/goupnp/dcps/ocf/internetgateway2"
+)
+
+// ErrNoFirewall is returned when no gateway has a WANIPv6FirewallControl
+// service.
+var ErrNoFirewall = errors.New("no UPnP IPv6 firewall control found")
+
+// ErrPinholeNotAllowed is returned when the firewall does not let inbound
+// pinholes be opened.
+var ErrPinholeNotAllowed = errors.New("inbound pinholes not allowed")
+
+// MaxPinholeLease is the longest pinhole lease in seconds. Pinholes are never
+// permanent.
+const MaxPinholeLease = 86400
+
+// UPnP error codes of WANIPv6FirewallControl.
+const (
+	errFirewallDisabled         = 702
+	errInboundPinholeNotAllowed = 703
+)
+
+// firewallClient is implemented by WANIPv6FirewallControl1 clients.
+type firewallClient interface {
+	AddPinholeCtx(ctx context.Context, RemoteHost string, RemotePort uint16, InternalClient string, InternalPort uint16, Protocol uint16, LeaseTime uint32) (UniqueID uint16, err error)
+	UpdatePinholeCtx(ctx context.Context, UniqueID uint16, NewLeaseTime uint32) error
+	DeletePinholeCtx(ctx context.Context, UniqueID uint16) error
+	GetFirewallStatusCtx(ctx context.Context) (FirewallEnabled bool, InboundPinholeAllowed bool, err error)
+	GetServiceClient() *goupnp.ServiceClient
+}
+
+// Firewall is the IPv6 firewall control service of an Internet Gateway
+// Device. On IPv6 there is no NAT to map through, but the firewall of the
+// gateway drops inbound connections unless a pinhole is opened.
+type Firewall struct {
+	// Location is the URL of the device description.
+	Location     string
+	UDN          string
+	FriendlyName string
+
+	c firewallClient
+}
+
+func newFirewall(c firewallClient) *Firewall {
+	sc := c.GetServiceClient()
+	f := &Firewall{c: c}
+	if sc.Location != nil {
+		f.Location = sc.Location.String()
+	}
+	if sc.RootDevice != nil {
+		f.UDN = sc.RootDevice.Device.UDN
+		f.FriendlyName = sc.RootDevice.Device.FriendlyName
+	}
+	return f
+}
+
+func (f *Firewall) String() string {
+	return fmt.Sprintf("%v (%v) %v", f.FriendlyName, f.UDN, f.Location)
+}
+
+// Firewalls returns the WANIPv6FirewallControl1 services of every gateway
+// selected by opts. It returns an error wrapping ErrNoFirewall if there is
+// none.
+func Firewalls(ctx context.Context, opts ...Option) ([]*Firewall, error) {
+	c, err := newConfig(opts)
+	if err != nil {
+		return nil, fmt.Errorf("Firewalls: %w", err)
+	}
+	var clients []*internetgateway2.WANIPv6FirewallControl1
+	if c.location != nil {
+		root, err := goupnp.DeviceByURLCtx(ctx, c.location)
+		if err != nil {
+			return nil, fmt.Errorf("Firewalls: %w", err)
+		}
+		clients, _ = internetgateway2.NewWANIPv6FirewallControl1ClientsFromRootDevice(root, c.location)
+	} else {
+		clients, _, err = internetgateway2.NewWANIPv6FirewallControl1ClientsCtx(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Firewalls: %w", err)
+		}
+	}
+	var l []*Firewall
+	for _, v := range clients {
+		if c.match(v.GetServiceClient()) {
+			l = append(l, newFirewall(v))
+		}
+	}
+	if len(l) == 0 {
+		return nil, fmt.Errorf("Firewalls: %w", ErrNoFirewall)
+	}
+	return l, nil
+}
+
+// Status reports whether the firewall is enabled and whether it allows
+// inbound pinholes.
+func (f *Firewall) Status(ctx context.Context) (enabled, inboundAllowed bool, err error) {
+	enabled, inboundAllowed, err = f.c.GetFirewallStatusCtx(ctx)
+	if err != nil {
+		return false, false, fmt.Errorf("Status: %w", err)
+	}
+	return enabled, inboundAllowed, nil
+}
+
+// AddPinhole lets any remote host reach internalClient:internalPort for lease
+// seconds, 1 to MaxPinholeLease, and returns the id of the pinhole.
+func (f *Firewall) AddPinhole(ctx context.Context, protocol string, internalClient netip.Addr, internalPort uint16, lease uint32) (uint16, error) {
+	proto, err := ipProtocol(protocol)
+	if err != nil {
+		return 0, fmt.Errorf("AddPinhole: %w", err)
+	}
+	id, err := f.c.AddPinholeCtx(ctx, "", 0, internalClient.String(), internalPort, proto, lease)
+	if err != nil {
+		if errorCode(err) == errInboundPinholeNotAllowed {
+			err = errors.Join(ErrPinholeNotAllowed, err)
+		}
+		return 0, fmt.Errorf("AddPinhole: %w", err)
+	}
+	return id, nil
+}
+
+// UpdatePinhole sets the lease of the pinhole id to lease seconds from now.
+func (f *Firewall) UpdatePinhole(ctx context.Context, id uint16, lease uint32) error {
+	if err := f.c.UpdatePinholeCtx(ctx, id, lease); err != nil {
+		return fmt.Errorf("UpdatePinhole: %w", err)
+	}
+	return nil
+}
+
+// DeletePinhole closes the pinhole id.
+func (f *Firewall) DeletePinhole(ctx context.Context, id uint16) error {
+	if err := f.c.DeletePinholeCtx(ctx, id); err != nil {
+		return fmt.Errorf("DeletePinhole: %w", err)
+	}
+	return nil
+}
+
+// Pinhole is a pinhole opened on a firewall.
+type Pinhole struct {
+	Firewall *Firewall
+	ID       uint16
+}
+
+// Update sets the lease of the pinhole to lease seconds from now.
+func (p Pinhole) Update(ctx context.Context, lease uint32) error {
+	return p.Firewall.UpdatePinhole(ctx, p.ID, lease)
+}
+
+// Delete closes the pinhole.
+func (p Pinhole) Delete(ctx context.Context) error {
+	return p.Firewall.DeletePinhole(ctx, p.ID)
+}
+
+// AddPinhole opens a pinhole to internalClient:internalPort on every firewall
+// selected by opts, see Firewall.AddPinhole. Disabled firewalls need none and
+// are skipped. The pinholes opened are returned even if others failed.
+func AddPinhole(ctx context.Context, protocol string, internalClient netip.Addr, internalPort uint16, lease uint32, opts ...Option) ([]Pinhole, error) {
+	firewalls, err := Firewalls(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("AddPinhole: %w", err)
+	}
+	var (
+		l    []Pinhole
+		errs error
+	)
+	for _, f := range firewalls {
+		// Not every gateway implements GetFirewallStatus, so only a
+		// definite answer is trusted.
+		enabled, allowed, err := f.Status(ctx)
+		if err == nil && !enabled {
+			continue
+		}
+		if err == nil && !allowed {
+			errs = errors.Join(errs, fmt.Errorf("%v: %w", f, ErrPinholeNotAllowed))
+			continue
+		}
+		id, err := f.AddPinhole(ctx, protocol, internalClient, internalPort, lease)
+		if errorCode(err) == errFirewallDisabled {
+			continue
+		}
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("%v: %w", f, err))
+			continue
+		}
+		l = append(l, Pinhole{Firewall: f, ID: id})
+	}
+	if errs != nil {
+		return l, fmt.Errorf("AddPinhole: %w", errs)
+	}
+	return l, nil
+}
+
+// ipProtocol returns the IANA protocol number WANIPv6FirewallControl takes.
+func ipProtocol(protocol string) (uint16, error) {
+	switch strings.ToUpper(protocol) {
+	case "TCP":
+		return 6, nil
+	case "UDP":
+		return 17, nil
+	}
+	return 0, fmt.Errorf("ipProtocol: unknown protocol %q", protocol)
+}
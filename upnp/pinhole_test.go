@@ -0,0 +1,90 @@
+package upnp_test
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/xmdhs/natupnp/upnp"
+	"github.com/xmdhs/natupnp/upnp/fakeigd"
+)
+
+var client6 = netip.MustParseAddr("2001:db8::2")
+
+func TestPinhole(t *testing.T) {
+	ctx := context.Background()
+	d := &fakeigd.Device{}
+	loc := start(t, d)
+	l, err := upnp.AddPinhole(ctx, "UDP", client6, 8080, 3600, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l) != 1 || l[0].Firewall.UDN != d.UDN {
+		t.Fatalf("pinholes = %+v, want one on %v", l, d.UDN)
+	}
+	want := fakeigd.Pinhole{ID: l[0].ID, InternalClient: client6.String(), InternalPort: 8080, Protocol: 17, LeaseTime: 3600}
+	if got := d.Pinholes(); len(got) != 1 || got[0] != want {
+		t.Errorf("firewall pinholes = %+v, want %+v", got, want)
+	}
+
+	if err := l[0].Update(ctx, 7200); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.Pinholes(); len(got) != 1 || got[0].LeaseTime != 7200 {
+		t.Errorf("firewall pinholes = %+v after Update, want a 7200s lease", got)
+	}
+
+	if err := l[0].Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.Pinholes(); len(got) != 0 {
+		t.Errorf("firewall pinholes = %+v after Delete, want none", got)
+	}
+	if err := l[0].Update(ctx, 3600); err == nil {
+		t.Error("Update of a deleted pinhole succeeded")
+	}
+}
+
+func TestPinholeFirewallStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		d    *fakeigd.Device
+		err  error
+	}{
+		{"disabled", &fakeigd.Device{FirewallDisabled: true}, nil},
+		{"inbound not allowed", &fakeigd.Device{NoInboundPinholes: true}, upnp.ErrPinholeNotAllowed},
+		{"IGDv1", &fakeigd.Device{Version: 1}, upnp.ErrNoFirewall},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := upnp.AddPinhole(context.Background(), "TCP", client6, 8080, 3600, start(t, tt.d))
+			if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if len(l) != 0 || len(tt.d.Pinholes()) != 0 {
+				t.Errorf("pinholes = %+v, firewall %+v, want none", l, tt.d.Pinholes())
+			}
+		})
+	}
+}
+
+func TestFirewallAddPinhole(t *testing.T) {
+	ctx := context.Background()
+	d := &fakeigd.Device{NoInboundPinholes: true}
+	firewalls, err := upnp.Firewalls(ctx, start(t, d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := firewalls[0]
+	enabled, allowed, err := f.Status(ctx)
+	if err != nil || !enabled || allowed {
+		t.Errorf("status = %v, %v, %v, want enabled without inbound pinholes", enabled, allowed, err)
+	}
+	if _, err := f.AddPinhole(ctx, "TCP", client6, 8080, 3600); !errors.Is(err, upnp.ErrPinholeNotAllowed) {
+		t.Errorf("err = %v, want %v", err, upnp.ErrPinholeNotAllowed)
+	}
+	if _, err := f.AddPinhole(ctx, "SCTP", client6, 8080, 3600); err == nil {
+		t.Error("AddPinhole of an unknown protocol succeeded")
+	}
+}
@@ -0,0 +1,145 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+)
+
+// PortRange is an inclusive range of external ports. The zero value means
+// any port.
+type PortRange struct {
+	Min, Max uint16
+}
+
+// maxPortTries bounds how many ports of a range MapPort tries.
+const maxPortTries = 64
+
+// anyPortMapper is implemented by IGDv2 WANIPConnection clients.
+type anyPortMapper interface {
+	AddAnyPortMappingCtx(
+		ctx context.Context,
+		NewRemoteHost string,
+		NewExternalPort uint16,
+		NewProtocol string,
+		NewInternalPort uint16,
+		NewInternalClient string,
+		NewEnabled bool,
+		NewPortMappingDescription string,
+		NewLeaseDuration uint32,
+	) (NewReservedPort uint16, err error)
+}
+
+// MapPort maps internalClient:internalPort on every gateway selected by opts
+// without taking over mappings of other hosts, and returns the external port.
+//
+// The preferred external port is tried first. If it is taken and r is the
+// zero value, a single IGDv2 gateway is asked for any free port with
+// AddAnyPortMapping; otherwise free ports of r, or of 1024-65535 for the zero
+// value, are tried from a random offset.
+func MapPort(ctx context.Context, protocol string, preferred, internalPort uint16, internalClient, description string, lease uint32, r PortRange, opts ...Option) (uint16, error) {
+	gateways, err := pickGateways(ctx, opts)
+	if err != nil {
+		return 0, fmt.Errorf("MapPort: %w", err)
+	}
+	port, err := mapPort(ctx, gateways, protocol, preferred, internalPort, internalClient, description, lease, r)
+	if err != nil {
+		return 0, fmt.Errorf("MapPort: %w", err)
+	}
+	return port, nil
+}
+
+// MapPort is MapPort of the package for the gateway g alone.
+func (g *Gateway) MapPort(ctx context.Context, protocol string, preferred, internalPort uint16, internalClient, description string, lease uint32, r PortRange) (uint16, error) {
+	port, err := mapPort(ctx, []*Gateway{g}, protocol, preferred, internalPort, internalClient, description, lease, r)
+	if err != nil {
+		return 0, fmt.Errorf("MapPort: %w", err)
+	}
+	return port, nil
+}
+
+func mapPort(ctx context.Context, gateways []*Gateway, protocol string, preferred, internalPort uint16, internalClient, description string, lease uint32, r PortRange) (uint16, error) {
+	err := mapPortOnAll(ctx, gateways, protocol, preferred, internalPort, internalClient, description, lease)
+	if err == nil {
+		return preferred, nil
+	}
+	if !errors.Is(err, ErrPortConflict) {
+		return 0, fmt.Errorf("mapPort: %w", err)
+	}
+
+	if r == (PortRange{}) {
+		if c, ok := gateways[0].c.(anyPortMapper); ok && len(gateways) == 1 {
+			port, err := c.AddAnyPortMappingCtx(ctx, "", preferred, protocol, internalPort, internalClient, true, description, lease)
+			if lease != 0 && errorCode(err) == errOnlyPermanentLeasesSupported {
+				port, err = c.AddAnyPortMappingCtx(ctx, "", preferred, protocol, internalPort, internalClient, true, description, 0)
+			}
+			if err != nil {
+				return 0, fmt.Errorf("mapPort: %w", err)
+			}
+			err = verifyPortMapping(ctx, gateways[0].c, PortMapping{ExternalPort: port, Protocol: protocol, InternalPort: internalPort, InternalClient: internalClient, Enabled: true})
+			if err != nil {
+				return 0, fmt.Errorf("mapPort: %w", err)
+			}
+			return port, nil
+		}
+		r = PortRange{Min: 1024, Max: 65535}
+	}
+	if r.Min > r.Max || r.Min == 0 {
+		return 0, fmt.Errorf("mapPort: invalid port range %d-%d", r.Min, r.Max)
+	}
+	n := int(r.Max-r.Min) + 1
+	start := rand.Intn(n)
+	for i := 0; i < n && i < maxPortTries; i++ {
+		port := r.Min + uint16((start+i)%n)
+		if port == preferred {
+			continue
+		}
+		err := mapPortOnAll(ctx, gateways, protocol, port, internalPort, internalClient, description, lease)
+		if err == nil {
+			return port, nil
+		}
+		if !errors.Is(err, ErrPortConflict) {
+			return 0, fmt.Errorf("mapPort: %w", err)
+		}
+	}
+	return 0, fmt.Errorf("mapPort: %w", ErrPortConflict)
+}
+
+// mapPortOnAll maps port on every gateway, or on none of them if the port is
+// taken on one.
+func mapPortOnAll(ctx context.Context, gateways []*Gateway, protocol string, port, internalPort uint16, internalClient, description string, lease uint32) error {
+	for _, g := range gateways {
+		if err := checkPort(ctx, g.c, protocol, port, internalPort, internalClient); err != nil {
+			return fmt.Errorf("mapPortOnAll: %w", err)
+		}
+	}
+	for i, g := range gateways {
+		err := addPortMapping(ctx, g.c, "", port, protocol, internalPort, internalClient, true, description, lease)
+		if err == nil {
+			continue
+		}
+		for _, v := range gateways[:i] {
+			v.c.DeletePortMappingCtx(ctx, "", port, protocol)
+		}
+		if errorCode(err) == errConflictInMappingEntry {
+			err = errors.Join(ErrPortConflict, err)
+		}
+		return fmt.Errorf("mapPortOnAll: %w", err)
+	}
+	return nil
+}
+
+// checkPort returns ErrPortConflict if port is mapped on c to another client
+// than internalClient:internalPort. Gateways without
+// GetSpecificPortMappingEntry are checked by walking the mapping table.
+func checkPort(ctx context.Context, c routerClient, protocol string, port, internalPort uint16, internalClient string) error {
+	m, ok, err := getPortMapping(ctx, c, "", port, protocol)
+	if err != nil {
+		return fmt.Errorf("checkPort: %w", err)
+	}
+	if ok && (m.InternalPort != internalPort || !sameHost(m.InternalClient, internalClient)) {
+		return fmt.Errorf("checkPort: %w: %d is mapped to %s:%d", ErrPortConflict, port, m.InternalClient, m.InternalPort)
+	}
+	return nil
+}
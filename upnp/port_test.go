@@ -0,0 +1,218 @@
+package upnp_test
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/huin/goupnp/soap"
+	"github.com/xmdhs/natupnp/upnp"
+	"github.com/xmdhs/natupnp/upnp/fakeigd"
+)
+
+const other = "192.168.1.9"
+
+// start serves d on loopback and returns the option selecting it.
+func start(t *testing.T, d *fakeigd.Device) upnp.Option {
+	t.Helper()
+	if err := d.Start(context.Background(), netip.MustParseAddr("127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return upnp.WithLocation(d.Location())
+}
+
+// mapping returns the entry of d for port, or false.
+func mapping(d *fakeigd.Device, protocol string, port uint16) (fakeigd.Mapping, bool) {
+	for _, m := range d.Mappings() {
+		if m.Protocol == protocol && m.ExternalPort == port {
+			return m, true
+		}
+	}
+	return fakeigd.Mapping{}, false
+}
+
+func TestAddPortMapping(t *testing.T) {
+	d := &fakeigd.Device{}
+	loc := start(t, d)
+	res, err := upnp.AddPortMapping(context.Background(), "", 8080, "TCP", 80, "127.0.0.1", true, "test", 3600, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].Err != nil || res[0].Gateway.UDN != d.UDN {
+		t.Errorf("results = %+v, want one success on %v", res, d.UDN)
+	}
+	want := fakeigd.Mapping{ExternalPort: 8080, Protocol: "TCP", InternalPort: 80, InternalClient: "127.0.0.1", Enabled: true, Description: "test", LeaseDuration: 3600}
+	if m, _ := mapping(d, "TCP", 8080); m != want {
+		t.Errorf("mapping = %+v, want %+v", m, want)
+	}
+}
+
+func TestAddPortMappingPermanentOnly(t *testing.T) {
+	d := &fakeigd.Device{PermanentOnly: true}
+	loc := start(t, d)
+	if _, err := upnp.AddPortMapping(context.Background(), "", 8080, "UDP", 80, "127.0.0.1", true, "test", 3600, loc); err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := mapping(d, "UDP", 8080); !ok || m.LeaseDuration != 0 {
+		t.Errorf("mapping = %+v, %v, want a permanent one", m, ok)
+	}
+}
+
+func TestAddPortMappingSOAPError(t *testing.T) {
+	d := &fakeigd.Device{Fail: func(action string) int {
+		if action == "AddPortMapping" {
+			return 501
+		}
+		return 0
+	}}
+	loc := start(t, d)
+	res, err := upnp.AddPortMapping(context.Background(), "", 8080, "TCP", 80, "127.0.0.1", true, "test", 3600, loc)
+	var fault *soap.SOAPFaultError
+	if !errors.As(err, &fault) || fault.Detail.UPnPError.Errorcode != 501 {
+		t.Fatalf("err = %v, want UPnP error 501", err)
+	}
+	if len(res) != 1 || res[0].Err == nil {
+		t.Errorf("results = %+v, want the failure", res)
+	}
+	if l := d.Mappings(); len(l) != 0 {
+		t.Errorf("mappings = %+v, want none", l)
+	}
+}
+
+func TestAddPortMappingHijacked(t *testing.T) {
+	d := &fakeigd.Device{Hijack: other}
+	loc := start(t, d)
+	_, err := upnp.AddPortMapping(context.Background(), "", 8080, "TCP", 80, "127.0.0.1", true, "test", 3600, loc)
+	if !errors.Is(err, upnp.ErrMappingMismatch) {
+		t.Fatalf("err = %v, want %v", err, upnp.ErrMappingMismatch)
+	}
+}
+
+func TestMapPort(t *testing.T) {
+	taken := fakeigd.Mapping{ExternalPort: 2000, Protocol: "TCP", InternalPort: 2000, InternalClient: other, Enabled: true}
+	tests := []struct {
+		name     string
+		d        *fakeigd.Device
+		taken    bool
+		r        upnp.PortRange
+		want     func(port uint16) bool
+		wantCall string
+	}{
+		{
+			name: "free",
+			d:    &fakeigd.Device{},
+			want: func(port uint16) bool { return port == 2000 },
+		},
+		{
+			name:  "range",
+			d:     &fakeigd.Device{Version: 1},
+			taken: true,
+			r:     upnp.PortRange{Min: 3000, Max: 3010},
+			want:  func(port uint16) bool { return port >= 3000 && port <= 3010 },
+		},
+		{
+			name:  "any port v1",
+			d:     &fakeigd.Device{Version: 1},
+			taken: true,
+			want:  func(port uint16) bool { return port >= 1024 && port != 2000 },
+		},
+		{
+			name:     "any port v2",
+			d:        &fakeigd.Device{},
+			taken:    true,
+			want:     func(port uint16) bool { return port != 2000 },
+			wantCall: "AddAnyPortMapping",
+		},
+		{
+			name:     "any port permanent only",
+			d:        &fakeigd.Device{PermanentOnly: true},
+			taken:    true,
+			want:     func(port uint16) bool { return port != 2000 },
+			wantCall: "AddAnyPortMapping",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc := start(t, tt.d)
+			if tt.taken {
+				tt.d.SetMapping(taken)
+			}
+			port, err := upnp.MapPort(context.Background(), "TCP", 2000, 2000, "127.0.0.1", "test", 3600, tt.r, loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.want(port) {
+				t.Errorf("port = %d", port)
+			}
+			m, ok := mapping(tt.d, "TCP", port)
+			if !ok || m.InternalClient != "127.0.0.1" || m.InternalPort != 2000 {
+				t.Errorf("mapping = %+v, %v, want one to 127.0.0.1:2000", m, ok)
+			}
+			if tt.d.PermanentOnly && m.LeaseDuration != 0 {
+				t.Errorf("lease = %d, want permanent", m.LeaseDuration)
+			}
+			if m, _ := mapping(tt.d, "TCP", 2000); tt.taken && m != taken {
+				t.Errorf("mapping of the other host = %+v, want %+v", m, taken)
+			}
+			if tt.wantCall != "" && !called(tt.d, tt.wantCall) {
+				t.Errorf("%s not called: %v", tt.wantCall, tt.d.Calls())
+			}
+		})
+	}
+}
+
+func TestMapPortRenew(t *testing.T) {
+	d := &fakeigd.Device{}
+	loc := start(t, d)
+	d.SetMapping(fakeigd.Mapping{ExternalPort: 2000, Protocol: "UDP", InternalPort: 2000, InternalClient: "127.0.0.1", Enabled: true})
+	port, err := upnp.MapPort(context.Background(), "UDP", 2000, 2000, "127.0.0.1", "test", 3600, upnp.PortRange{}, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 2000 || len(d.Mappings()) != 1 {
+		t.Errorf("port = %d, mappings = %+v, want the own mapping refreshed", port, d.Mappings())
+	}
+}
+
+func TestMapPortConflict(t *testing.T) {
+	d := &fakeigd.Device{}
+	loc := start(t, d)
+	d.SetMapping(fakeigd.Mapping{ExternalPort: 2000, Protocol: "TCP", InternalPort: 2000, InternalClient: other, Enabled: true})
+	d.SetMapping(fakeigd.Mapping{ExternalPort: 3000, Protocol: "TCP", InternalPort: 3000, InternalClient: other, Enabled: true})
+	_, err := upnp.MapPort(context.Background(), "TCP", 2000, 2000, "127.0.0.1", "test", 3600, upnp.PortRange{Min: 3000, Max: 3000}, loc)
+	if !errors.Is(err, upnp.ErrPortConflict) {
+		t.Fatalf("err = %v, want %v", err, upnp.ErrPortConflict)
+	}
+	if l := d.Mappings(); len(l) != 2 {
+		t.Errorf("mappings = %+v, want the other host's only", l)
+	}
+}
+
+func TestMapPortSOAPError(t *testing.T) {
+	d := &fakeigd.Device{Fail: func(action string) int {
+		if action == "AddPortMapping" {
+			return fakeigd.ErrNoPortMapsAvailable
+		}
+		return 0
+	}}
+	loc := start(t, d)
+	_, err := upnp.MapPort(context.Background(), "TCP", 2000, 2000, "127.0.0.1", "test", 3600, upnp.PortRange{}, loc)
+	var fault *soap.SOAPFaultError
+	if !errors.As(err, &fault) || fault.Detail.UPnPError.Errorcode != fakeigd.ErrNoPortMapsAvailable {
+		t.Fatalf("err = %v, want UPnP error %d", err, fakeigd.ErrNoPortMapsAvailable)
+	}
+	if errors.Is(err, upnp.ErrPortConflict) {
+		t.Errorf("err = %v, not a conflict", err)
+	}
+}
+
+func called(d *fakeigd.Device, action string) bool {
+	for _, v := range d.Calls() {
+		if v == action {
+			return true
+		}
+	}
+	return false
+}
@@ -2,12 +2,42 @@ package upnp
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/url"
+	"sync"
 
+	"github.com/huin/goupnp"
 	"github.com/huin/goupnp/dcps/ocf/internetgateway2"
+	"github.com/huin/goupnp/soap"
 	"golang.org/x/sync/errgroup"
 )
 
+// ErrNoIGD is returned when no UPnP Internet Gateway Device answered.
+var ErrNoIGD = errors.New("no UPnP IGD found")
+
+// ErrPortConflict is returned when the external port is already mapped to
+// another internal client or port.
+var ErrPortConflict = errors.New("external port mapped to another client")
+
+// UPnP error codes of WANIPConnection.
+const (
+	errNoSuchEntryInArray           = 714
+	errConflictInMappingEntry       = 718
+	errOnlyPermanentLeasesSupported = 725
+)
+
+// Result is the outcome of an operation on one gateway.
+type Result struct {
+	Gateway *Gateway
+	Err     error
+}
+
+// AddPortMapping adds the mapping on every gateway selected by opts and
+// returns the result of each. The error joins the failures. Gateways that only
+// support permanent leases get the mapping with a lease of 0 instead. The
+// mapping is read back after adding it, see Gateway.VerifyPortMapping, as some
+// gateways accept it but drop it or map another client.
 func AddPortMapping(ctx context.Context,
 	NewRemoteHost string,
 	NewExternalPort uint16,
@@ -17,30 +47,166 @@ func AddPortMapping(ctx context.Context,
 	NewEnabled bool,
 	NewPortMappingDescription string,
 	NewLeaseDuration uint32,
+	opts ...Option,
+) ([]Result, error) {
+	gateways, err := pickGateways(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("AddPortMapping: %w", err)
+	}
+
+	results := make([]Result, len(gateways))
+	var wg sync.WaitGroup
+	for i, g := range gateways {
+		i, g := i, g
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := addPortMapping(ctx, g.c, NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort, NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+			results[i] = Result{Gateway: g, Err: err}
+		}()
+	}
+	wg.Wait()
+
+	var errs error
+	for _, r := range results {
+		if r.Err != nil {
+			errs = errors.Join(errs, fmt.Errorf("%v: %w", r.Gateway, r.Err))
+		}
+	}
+	if errs != nil {
+		return results, fmt.Errorf("AddPortMapping: %w", errs)
+	}
+	return results, nil
+}
+
+func addPortMapping(ctx context.Context, c routerClient,
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	NewInternalPort uint16,
+	NewInternalClient string,
+	NewEnabled bool,
+	NewPortMappingDescription string,
+	NewLeaseDuration uint32,
+) error {
+	err := c.AddPortMappingCtx(ctx, NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort, NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+	if NewLeaseDuration != 0 && errorCode(err) == errOnlyPermanentLeasesSupported {
+		err = c.AddPortMappingCtx(ctx, NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort, NewInternalClient, NewEnabled, NewPortMappingDescription, 0)
+	}
+	if err != nil {
+		return err
+	}
+	return verifyPortMapping(ctx, c, PortMapping{
+		RemoteHost:     NewRemoteHost,
+		ExternalPort:   NewExternalPort,
+		Protocol:       NewProtocol,
+		InternalPort:   NewInternalPort,
+		InternalClient: NewInternalClient,
+		Enabled:        NewEnabled,
+	})
+}
+
+// DeletePortMapping removes a mapping from every gateway selected by opts.
+func DeletePortMapping(ctx context.Context,
+	NewRemoteHost string,
+	NewExternalPort uint16,
+	NewProtocol string,
+	opts ...Option,
 ) error {
-	clients, err := pickRouterClient(ctx)
+	gateways, err := pickGateways(ctx, opts)
 	if err != nil {
-		return fmt.Errorf("AddPortMapping: %w", err)
+		return fmt.Errorf("DeletePortMapping: %w", err)
 	}
 
 	tasks, _ := errgroup.WithContext(ctx)
 
-	for _, v := range clients {
+	for _, v := range gateways {
 		v := v
 		tasks.Go(func() error {
-			return v.AddPortMapping(NewRemoteHost, NewExternalPort, NewProtocol, NewInternalPort, NewInternalClient, NewEnabled, NewPortMappingDescription, NewLeaseDuration)
+			return v.c.DeletePortMappingCtx(ctx, NewRemoteHost, NewExternalPort, NewProtocol)
 		})
 	}
 
 	if err := tasks.Wait(); err != nil {
-		return fmt.Errorf("AddPortMapping: %w", err)
+		return fmt.Errorf("DeletePortMapping: %w", err)
 	}
-
 	return nil
 }
 
+// PortMapping is an entry of a gateway's port mapping table.
+type PortMapping struct {
+	RemoteHost     string
+	ExternalPort   uint16
+	Protocol       string
+	InternalPort   uint16
+	InternalClient string
+	Enabled        bool
+	Description    string
+	LeaseDuration  uint32
+}
+
+// maxEntries bounds the walk of the mapping table, in case a gateway never
+// reports the end of it.
+const maxEntries = 1024
+
+// ListPortMappings returns the mapping tables of every gateway selected by
+// opts.
+func ListPortMappings(ctx context.Context, opts ...Option) ([]PortMapping, error) {
+	gateways, err := pickGateways(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("ListPortMappings: %w", err)
+	}
+	var l []PortMapping
+	for _, v := range gateways {
+		l = append(l, listPortMappings(ctx, v.c)...)
+	}
+	return l, nil
+}
+
+// DeletePortMappings deletes, on every gateway selected by opts, the mappings
+// for which match returns true, and returns the deleted ones.
+func DeletePortMappings(ctx context.Context, match func(PortMapping) bool, opts ...Option) ([]PortMapping, error) {
+	gateways, err := pickGateways(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("DeletePortMappings: %w", err)
+	}
+	var (
+		deleted []PortMapping
+		errs    error
+	)
+	for _, g := range gateways {
+		l, err := g.DeletePortMappings(ctx, match)
+		deleted = append(deleted, l...)
+		errs = errors.Join(errs, err)
+	}
+	if errs != nil {
+		return deleted, fmt.Errorf("DeletePortMappings: %w", errs)
+	}
+	return deleted, nil
+}
+
+// listPortMappings walks the mapping table of c until the gateway reports an
+// invalid index.
+func listPortMappings(ctx context.Context, c routerClient) []PortMapping {
+	var l []PortMapping
+	for i := uint16(0); i < maxEntries; i++ {
+		var (
+			m   PortMapping
+			err error
+		)
+		m.RemoteHost, m.ExternalPort, m.Protocol, m.InternalPort, m.InternalClient,
+			m.Enabled, m.Description, m.LeaseDuration, err = c.GetGenericPortMappingEntryCtx(ctx, i)
+		if err != nil {
+			break
+		}
+		l = append(l, m)
+	}
+	return l
+}
+
 type routerClient interface {
-	AddPortMapping(
+	AddPortMappingCtx(
+		ctx context.Context,
 		NewRemoteHost string,
 		NewExternalPort uint16,
 		NewProtocol string,
@@ -51,13 +217,102 @@ type routerClient interface {
 		NewLeaseDuration uint32,
 	) (err error)
 
-	GetExternalIPAddress() (
+	DeletePortMappingCtx(
+		ctx context.Context,
+		NewRemoteHost string,
+		NewExternalPort uint16,
+		NewProtocol string,
+	) (err error)
+
+	GetGenericPortMappingEntryCtx(
+		ctx context.Context,
+		NewPortMappingIndex uint16,
+	) (NewRemoteHost string, NewExternalPort uint16, NewProtocol string, NewInternalPort uint16, NewInternalClient string, NewEnabled bool, NewPortMappingDescription string, NewLeaseDuration uint32, err error)
+
+	GetSpecificPortMappingEntryCtx(
+		ctx context.Context,
+		NewRemoteHost string,
+		NewExternalPort uint16,
+		NewProtocol string,
+	) (NewInternalPort uint16, NewInternalClient string, NewEnabled bool, NewPortMappingDescription string, NewLeaseDuration uint32, err error)
+
+	GetExternalIPAddressCtx(ctx context.Context) (
 		NewExternalIPAddress string,
 		err error,
 	)
+
+	GetServiceClient() *goupnp.ServiceClient
+}
+
+// PickGateways returns the gateways selected by opts, one service per device,
+// see Gateways.
+func PickGateways(ctx context.Context, opts ...Option) ([]*Gateway, error) {
+	l, err := pickGateways(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("PickGateways: %w", err)
+	}
+	return l, nil
+}
+
+// pickGateways returns the gateways selected by opts. Of the services of one
+// device only the best one is used, WANIPConnection2 over WANIPConnection1 over
+// WANPPPConnection1. It returns an error wrapping ErrNoIGD if there is none.
+func pickGateways(ctx context.Context, opts []Option) ([]*Gateway, error) {
+	all, err := gateways(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("pickGateways: %w", err)
+	}
+	seen := map[string]bool{}
+	var l []*Gateway
+	for _, g := range all {
+		key := g.UDN
+		if key == "" {
+			key = g.Location
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		l = append(l, g)
+	}
+	return l, nil
+}
+
+// gateways returns the services selected by opts, best service family first.
+func gateways(ctx context.Context, opts []Option) ([]*Gateway, error) {
+	c, err := newConfig(opts)
+	if err != nil {
+		return nil, fmt.Errorf("gateways: %w", err)
+	}
+	if c.gateways != nil {
+		return c.gateways, nil
+	}
+	var ip2, ip1, ppp1 []routerClient
+	if c.location != nil {
+		ip2, ip1, ppp1, err = discoverURL(ctx, c.location)
+	} else {
+		ip2, ip1, ppp1, err = discover(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("gateways: %w", err)
+	}
+	var l []*Gateway
+	for _, v := range [][]routerClient{ip2, ip1, ppp1} {
+		for _, rc := range v {
+			if c.match(rc.GetServiceClient()) {
+				l = append(l, newGateway(rc))
+			}
+		}
+	}
+	if len(l) == 0 {
+		return nil, fmt.Errorf("gateways: %w", ErrNoIGD)
+	}
+	return l, nil
 }
 
-func pickRouterClient(ctx context.Context) ([]routerClient, error) {
+// discover searches for the WANIPConnection2, WANIPConnection1 and
+// WANPPPConnection1 services.
+func discover(ctx context.Context) (ip2, ip1, ppp1 []routerClient, err error) {
 	tasks, _ := errgroup.WithContext(ctx)
 	var ip1Clients []*internetgateway2.WANIPConnection1
 	tasks.Go(func() error {
@@ -79,19 +334,31 @@ func pickRouterClient(ctx context.Context) ([]routerClient, error) {
 	})
 
 	if err := tasks.Wait(); err != nil {
-		return nil, fmt.Errorf("pickRouterClient: %w", err)
+		return nil, nil, nil, fmt.Errorf("discover: %w", err)
 	}
+	return any2slice[routerClient](ip2Clients), any2slice[routerClient](ip1Clients), any2slice[routerClient](ppp1Clients), nil
+}
+
+// discoverURL is discover for the device description at loc. A service the
+// device does not have is not an error.
+func discoverURL(ctx context.Context, loc *url.URL) (ip2, ip1, ppp1 []routerClient, err error) {
+	root, err := goupnp.DeviceByURLCtx(ctx, loc)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("discoverURL: %w", err)
+	}
+	ip2Clients, _ := internetgateway2.NewWANIPConnection2ClientsFromRootDevice(root, loc)
+	ip1Clients, _ := internetgateway2.NewWANIPConnection1ClientsFromRootDevice(root, loc)
+	ppp1Clients, _ := internetgateway2.NewWANPPPConnection1ClientsFromRootDevice(root, loc)
+	return any2slice[routerClient](ip2Clients), any2slice[routerClient](ip1Clients), any2slice[routerClient](ppp1Clients), nil
+}
 
-	switch {
-	case len(ip2Clients) >= 1:
-		return any2slice[routerClient](ip2Clients), nil
-	case len(ip1Clients) >= 1:
-		return any2slice[routerClient](ip1Clients), nil
-	case len(ppp1Clients) >= 1:
-		return any2slice[routerClient](ppp1Clients), nil
-	default:
-		return nil, nil
+// errorCode returns the UPnP error code in err, or 0.
+func errorCode(err error) int {
+	var fault *soap.SOAPFaultError
+	if errors.As(err, &fault) {
+		return fault.Detail.UPnPError.Errorcode
 	}
+	return 0
 }
 
 func any2slice[T, E any](list []E) []T {
@@ -0,0 +1,95 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// ErrMappingLost is returned when a port mapping is not on the gateway,
+// e.g. because the gateway silently dropped it or rebooted.
+var ErrMappingLost = errors.New("port mapping not found on gateway")
+
+// ErrMappingMismatch is returned when the port mapping read back from the
+// gateway is not the one added, e.g. it points to another internal client.
+var ErrMappingMismatch = errors.New("port mapping differs from the one added")
+
+// VerifyPortMapping reads m back from every gateway selected by opts and
+// checks its internal client, internal port and enabled flag, see
+// Gateway.VerifyPortMapping.
+func VerifyPortMapping(ctx context.Context, m PortMapping, opts ...Option) error {
+	gateways, err := pickGateways(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("VerifyPortMapping: %w", err)
+	}
+	var errs error
+	for _, g := range gateways {
+		if err := verifyPortMapping(ctx, g.c, m); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("%v: %w", g, err))
+		}
+	}
+	if errs != nil {
+		return fmt.Errorf("VerifyPortMapping: %w", errs)
+	}
+	return nil
+}
+
+// VerifyPortMapping reads m back from the gateway. It returns an error
+// wrapping ErrMappingLost if the gateway has no mapping for the external port
+// and one wrapping ErrMappingMismatch if the mapping is not m.
+func (g *Gateway) VerifyPortMapping(ctx context.Context, m PortMapping) error {
+	if err := verifyPortMapping(ctx, g.c, m); err != nil {
+		return fmt.Errorf("VerifyPortMapping: %w", err)
+	}
+	return nil
+}
+
+func verifyPortMapping(ctx context.Context, c routerClient, want PortMapping) error {
+	got, ok, err := getPortMapping(ctx, c, want.RemoteHost, want.ExternalPort, want.Protocol)
+	if err != nil {
+		return fmt.Errorf("verifyPortMapping: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("verifyPortMapping: %w: %s %d", ErrMappingLost, want.Protocol, want.ExternalPort)
+	}
+	if got.InternalPort != want.InternalPort || !sameHost(got.InternalClient, want.InternalClient) || got.Enabled != want.Enabled {
+		return fmt.Errorf("verifyPortMapping: %w: %s %d is mapped to %s:%d (enabled %v)",
+			ErrMappingMismatch, want.Protocol, want.ExternalPort, got.InternalClient, got.InternalPort, got.Enabled)
+	}
+	return nil
+}
+
+// getPortMapping reads the mapping of port from c. Gateways without
+// GetSpecificPortMappingEntry are read by walking the mapping table. ok is
+// false if there is no such mapping.
+func getPortMapping(ctx context.Context, c routerClient, remoteHost string, port uint16, protocol string) (m PortMapping, ok bool, err error) {
+	m = PortMapping{RemoteHost: remoteHost, ExternalPort: port, Protocol: protocol}
+	m.InternalPort, m.InternalClient, m.Enabled, m.Description, m.LeaseDuration, err = c.GetSpecificPortMappingEntryCtx(ctx, remoteHost, port, protocol)
+	if errorCode(err) == errNoSuchEntryInArray {
+		return PortMapping{}, false, nil
+	}
+	if err == nil {
+		return m, true, nil
+	}
+	if errorCode(err) == 0 {
+		return PortMapping{}, false, fmt.Errorf("getPortMapping: %w", err)
+	}
+	for _, v := range listPortMappings(ctx, c) {
+		if v.ExternalPort == port && strings.EqualFold(v.Protocol, protocol) && v.RemoteHost == remoteHost {
+			return v, true, nil
+		}
+	}
+	return PortMapping{}, false, nil
+}
+
+// sameHost compares two internal clients, as addresses if both are ones.
+func sameHost(a, b string) bool {
+	x, err1 := netip.ParseAddr(a)
+	y, err2 := netip.ParseAddr(b)
+	if err1 == nil && err2 == nil {
+		return x.Unmap() == y.Unmap()
+	}
+	return strings.EqualFold(a, b)
+}